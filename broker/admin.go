@@ -0,0 +1,135 @@
+package broker
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/baetyl/baetyl-go/v2/errors"
+	"github.com/baetyl/baetyl-go/v2/log"
+
+	"github.com/baetyl/baetyl-broker/v2/session"
+)
+
+// Admin the config of the admin api server, the api is not authenticated,
+// so the server is bound to localhost by default and should never be exposed
+type Admin struct {
+	Address string `yaml:"address" json:"address" default:"127.0.0.1:8006"`
+}
+
+// AdminHandler returns the handler of the admin api
+func (b *Broker) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/delayed", b.ServeDelayed)
+	mux.HandleFunc("/retained", b.ServeRetained)
+	mux.HandleFunc("/bans", b.ServeBans)
+	return mux
+}
+
+// serveAdmin serves the admin api on its own listener
+func (b *Broker) serveAdmin() error {
+	if b.cfg.Admin.Address == "" {
+		return nil
+	}
+	l, err := net.Listen("tcp", b.cfg.Admin.Address)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	b.admin = &http.Server{Handler: b.AdminHandler()}
+	go b.admin.Serve(l)
+	b.log.Info("admin api has initialized", log.Any("address", l.Addr()))
+	return nil
+}
+
+// ServeDelayed serves the admin api of delayed messages,
+// GET lists all pending delayed messages, DELETE cancels the delayed message specified by query 'id'
+func (b *Broker) ServeDelayed(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, b.ses.ListDelayedMessages())
+	case http.MethodDelete:
+		id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "id is invalid", http.StatusBadRequest)
+			return
+		}
+		err = b.ses.CancelDelayedMessage(id)
+		if err == session.ErrSessionDelayedMessageNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			b.log.Error("failed to cancel delayed message", log.Any("id", id), log.Error(err))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// ServeRetained serves the admin api of retained messages,
+// GET lists the audits of all retained messages, including who set each of them last
+func (b *Broker) ServeRetained(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, b.ses.ListRetainedMessages())
+}
+
+// ServeBans serves the admin api of bans, GET lists all bans, POST adds the ban in body at runtime,
+// DELETE deletes the ban added at runtime specified by query 'type' and 'value'
+func (b *Broker) ServeBans(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, b.ses.ListBans())
+	case http.MethodPost:
+		var ban session.Ban
+		err := json.NewDecoder(r.Body).Decode(&ban)
+		if err != nil {
+			http.Error(w, "ban is invalid", http.StatusBadRequest)
+			return
+		}
+		err = b.ses.AddBan(ban)
+		if err == session.ErrSessionBanInvalid {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			b.log.Error("failed to add ban", log.Any("type", ban.Type), log.Any("value", ban.Value), log.Error(err))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		ban := session.Ban{Type: r.URL.Query().Get("type"), Value: r.URL.Query().Get("value")}
+		err := b.ses.DelBan(ban)
+		switch err {
+		case nil:
+			w.WriteHeader(http.StatusNoContent)
+		case session.ErrSessionBanNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case session.ErrSessionBanNotDeletable:
+			http.Error(w, err.Error(), http.StatusForbidden)
+		default:
+			b.log.Error("failed to delete ban", log.Any("type", ban.Type), log.Any("value", ban.Value), log.Error(err))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+}
@@ -1,6 +1,8 @@
 package broker
 
 import (
+	"net/http"
+
 	"github.com/baetyl/baetyl-go/v2/errors"
 	"github.com/baetyl/baetyl-go/v2/log"
 
@@ -11,15 +13,17 @@ import (
 // Config all config of broker
 type Config struct {
 	Listeners []listener.Listener `yaml:"listeners" json:"listeners"`
+	Admin     Admin               `yaml:"admin" json:"admin"`
 	Session   session.Config      `yaml:",inline" json:",inline"`
 }
 
 // Broker message broker
 type Broker struct {
-	cfg Config
-	ses *session.Manager
-	lis *listener.Manager
-	log *log.Logger
+	cfg   Config
+	ses   *session.Manager
+	lis   *listener.Manager
+	admin *http.Server // the server of admin api
+	log   *log.Logger
 }
 
 // NewBroker creates a new broker
@@ -39,11 +43,23 @@ func NewBroker(cfg Config) (*Broker, error) {
 		b.Close()
 		return nil, errors.Trace(err)
 	}
+
+	err = b.serveAdmin()
+	if err != nil {
+		b.Close()
+		return nil, errors.Trace(err)
+	}
 	return b, nil
 }
 
 // Close closes broker
 func (b *Broker) Close() {
+	if b.admin != nil {
+		err := b.admin.Close()
+		if err != nil {
+			b.log.Info("failed to close admin server", log.Error(err))
+		}
+	}
 	if b.lis != nil {
 		err := b.lis.Close()
 		if err != nil {
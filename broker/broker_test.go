@@ -1,17 +1,31 @@
 package broker
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/256dpi/gomqtt/transport"
 	"github.com/baetyl/baetyl-go/v2/mqtt"
 	"github.com/baetyl/baetyl-go/v2/utils"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 
+	"github.com/baetyl/baetyl-broker/v2/session"
 	_ "github.com/baetyl/baetyl-broker/v2/store/pebble"
 )
 
@@ -352,6 +366,107 @@ func TestBrokerMqttConnectSSLNormal(t *testing.T) {
 	assert.NoError(t, cli.Close())
 }
 
+func TestBrokerMqttCertIdentity(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer os.RemoveAll("var")
+
+	var confIdentity = `
+listeners:
+  - address: ssl://0.0.0.0:1884
+    ca: ../example/var/lib/baetyl/testcert/ca.crt
+    key: ../example/var/lib/baetyl/testcert/server.key
+    cert: ../example/var/lib/baetyl/testcert/server.crt
+principals:
+  - username: BAETYL-client
+    permissions:
+      - action: pub
+        permit: ["#"]
+session:
+  certIdentity:
+    template: ${subject.ou}-${cn}
+    forceClientID: true
+`
+	file := path.Join(dir, "service.yml")
+	err = ioutil.WriteFile(file, []byte(confIdentity), 0644)
+	assert.NoError(t, err)
+
+	b := initBroker(t, file)
+	defer b.Close()
+
+	tlsconfig, err := utils.NewTLSConfigClient(utils.Certificate{
+		CA:                 "../example/var/lib/baetyl/testcert/ca.crt",
+		Cert:               "../example/var/lib/baetyl/testcert/client.crt",
+		Key:                "../example/var/lib/baetyl/testcert/client.key",
+		InsecureSkipVerify: true,
+	})
+	assert.NoError(t, err)
+
+	connect := func(clientID string, cleanSession bool) string {
+		conn, err := mqtt.NewDialer(tlsconfig, 0).Dial("ssl://127.0.0.1:1884")
+		assert.NoError(t, err)
+		defer conn.Close()
+		pkt := mqtt.NewConnect()
+		pkt.ClientID = clientID
+		pkt.CleanSession = cleanSession
+		assert.NoError(t, conn.Send(pkt, false))
+		res, err := conn.Receive()
+		assert.NoError(t, err)
+		return res.String()
+	}
+
+	// the client ID does not match the certificate identity
+	assert.Equal(t, "<Connack SessionPresent=false ReturnCode=2>", connect("ssl-1", true))
+	assert.Equal(t, "<Connack SessionPresent=false ReturnCode=0>", connect("BAETYL-client", true))
+	// the client ID is not set, uses the certificate identity instead
+	assert.Equal(t, "<Connack SessionPresent=false ReturnCode=0>", connect("", true))
+}
+
+func TestBrokerMqttConnectUnixNormal(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer os.RemoveAll("var")
+
+	sock := path.Join(dir, "broker.sock")
+	var confUnix = fmt.Sprintf(`
+listeners:
+  - address: unix://%s
+    socketMode: "0660"
+principals:
+  - username: local
+    uid: %d
+    permissions:
+      - action: pub
+        permit: ["local/#"]
+`, sock, os.Getuid())
+	file := path.Join(dir, "service.yml")
+	err = ioutil.WriteFile(file, []byte(confUnix), 0644)
+	assert.NoError(t, err)
+
+	b := initBroker(t, file)
+	defer b.Close()
+
+	raw, err := net.Dial("unix", sock)
+	assert.NoError(t, err)
+	conn := transport.NewNetConn(raw)
+	defer conn.Close()
+
+	// authenticated by peer credentials without password
+	pkt := mqtt.NewConnect()
+	pkt.ClientID = "unix-1"
+	assert.NoError(t, conn.Send(pkt, false))
+	res, err := conn.Receive()
+	assert.NoError(t, err)
+	assert.Equal(t, "<Connack SessionPresent=false ReturnCode=0>", res.String())
+
+	assert.NoError(t, conn.Send(newPublishPacket(1, 1, "local/a", "hi"), false))
+	res, err = conn.Receive()
+	assert.NoError(t, err)
+	assert.Equal(t, "<Puback ID=1>", res.String())
+}
+
 func TestBrokerMqttConnectWebsocketNormal(t *testing.T) {
 	dir, err := ioutil.TempDir("", t.Name())
 	assert.NoError(t, err)
@@ -429,6 +544,305 @@ func TestBrokerMqttConnectWebSocketSSLNormal(t *testing.T) {
 	assert.NoError(t, cli.Close())
 }
 
+func TestBrokerGRPC(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer os.RemoveAll("var")
+
+	var confGRPC = `
+listeners:
+  - address: grpc://127.0.0.1:8273
+    maxConcurrentStreams: 10
+  - address: grpcs://127.0.0.1:8274
+    ca: ../example/var/lib/baetyl/testcert/ca.crt
+    key: ../example/var/lib/baetyl/testcert/server.key
+    cert: ../example/var/lib/baetyl/testcert/server.crt
+principals:
+  - username: test
+    password: hahaha
+    permissions:
+      - action: sub
+        permit: ["grpc/#"]
+  - username: BAETYL-client
+    permissions:
+      - action: pub
+        permit: ["grpc/#"]
+session:
+  certIdentity:
+    template: ${subject.ou}-${cn}
+`
+	file := path.Join(dir, "service.yml")
+	err = ioutil.WriteFile(file, []byte(confGRPC), 0644)
+	assert.NoError(t, err)
+
+	b := initBroker(t, file)
+	defer b.Close()
+
+	// subscribes with username and password
+	conn, err := grpc.Dial("127.0.0.1:8273", grpc.WithInsecure())
+	assert.NoError(t, err)
+	defer conn.Close()
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "clientid", "grpc-1", "username", "test", "password", "hahaha")
+	stream, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}, "/broker.Broker/Subscribe")
+	assert.NoError(t, err)
+	assert.NoError(t, stream.SendMsg(&mqtt.Message{Context: mqtt.Context{ID: 1, QOS: 1, Flags: session.GRPCFlagSubscribe, Topic: "grpc/#"}}))
+	msg := new(mqtt.Message)
+	assert.NoError(t, stream.RecvMsg(msg))
+	assert.Equal(t, "Context:<ID:1 QOS:1 Flags:4 Topic:\"grpc/#\" > ", msg.String())
+
+	// publishes with the client certificate
+	tlsconfig, err := utils.NewTLSConfigClient(utils.Certificate{
+		CA:                 "../example/var/lib/baetyl/testcert/ca.crt",
+		Cert:               "../example/var/lib/baetyl/testcert/client.crt",
+		Key:                "../example/var/lib/baetyl/testcert/client.key",
+		InsecureSkipVerify: true,
+	})
+	assert.NoError(t, err)
+	sconn, err := grpc.Dial("127.0.0.1:8274", grpc.WithTransportCredentials(credentials.NewTLS(tlsconfig)))
+	assert.NoError(t, err)
+	defer sconn.Close()
+	res := new(mqtt.Message)
+	err = sconn.Invoke(context.Background(), "/broker.Broker/Publish", &mqtt.Message{Context: mqtt.Context{ID: 9, QOS: 1, Topic: "grpc/a"}, Content: []byte("hi")}, res)
+	assert.NoError(t, err)
+	assert.Equal(t, "Context:<ID:9 QOS:1 Flags:2 Topic:\"grpc/a\" > ", res.String())
+
+	assert.NoError(t, stream.RecvMsg(msg))
+	assert.Equal(t, "Context:<ID:1 QOS:1 Topic:\"grpc/a\" > Content:\"hi\" ", msg.String())
+	assert.NoError(t, stream.SendMsg(&mqtt.Message{Context: mqtt.Context{ID: 1, Flags: session.GRPCFlagAck}}))
+
+	// the subscriber is not permitted to publish
+	ctx = metadata.AppendToOutgoingContext(context.Background(), "username", "test", "password", "hahaha")
+	err = conn.Invoke(ctx, "/broker.Broker/Publish", &mqtt.Message{Context: mqtt.Context{Topic: "grpc/a"}}, res)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// the session of the subscriber
+	ses := new(session.SessionReply)
+	err = conn.Invoke(ctx, "/broker.Broker/GetSession", &session.SessionRequest{ClientID: "grpc-1"}, ses)
+	assert.NoError(t, err)
+	assert.Equal(t, "ClientID:\"grpc-1\" Owner:\"test\" Connected:true Subscriptions:<Topic:\"grpc/#\" QOS:1 > ", ses.String())
+
+	assert.NoError(t, stream.CloseSend())
+	assert.Equal(t, io.EOF, stream.RecvMsg(msg))
+}
+
+func TestBrokerHTTP(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer os.RemoveAll("var")
+
+	var confHTTP = `
+listeners:
+  - address: tcp://127.0.0.1:1883
+  - address: http://127.0.0.1:8280
+principals:
+  - username: test
+    password: hahaha
+    permissions:
+      - action: pubsub
+        permit: ["http/#"]
+`
+	file := path.Join(dir, "service.yml")
+	err = ioutil.WriteFile(file, []byte(confHTTP), 0644)
+	assert.NoError(t, err)
+
+	b := initBroker(t, file)
+	defer b.Close()
+
+	// subscribes by mqtt
+	conn, err := mqtt.NewDialer(nil, 0).Dial("tcp://127.0.0.1:1883")
+	assert.NoError(t, err)
+	defer conn.Close()
+	pkt := mqtt.NewConnect()
+	pkt.ClientID = "http-sub"
+	pkt.Username, pkt.Password = "test", "hahaha"
+	assert.NoError(t, conn.Send(pkt, false))
+	res, err := conn.Receive()
+	assert.NoError(t, err)
+	assert.Equal(t, "<Connack SessionPresent=false ReturnCode=0>", res.String())
+	assert.NoError(t, conn.Send(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "http/#", QOS: 1}}}, false))
+	res, err = conn.Receive()
+	assert.NoError(t, err)
+	assert.Equal(t, "<Suback ID=1 ReturnCodes=[1]>", res.String())
+
+	// publishes by http
+	req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:8280/publish?topic=http/a&qos=1", strings.NewReader("hi"))
+	assert.NoError(t, err)
+	req.SetBasicAuth("test", "hahaha")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	res, err = conn.Receive()
+	assert.NoError(t, err)
+	assert.Equal(t, "<Publish ID=1 Message=<Message Topic=\"http/a\" QOS=1 Retain=false Payload=6869> Dup=false>", res.String())
+}
+
+func TestBrokerServeDelayed(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer os.RemoveAll("var")
+
+	file := path.Join(dir, "conf.yml")
+	err = ioutil.WriteFile(file, []byte(conf), 0644)
+	assert.NoError(t, err)
+
+	b := initBroker(t, file)
+	defer b.Close()
+
+	obs := newMockObserver(t)
+	ops := mqtt.NewClientOptions()
+	ops.Address = "tcp://127.0.0.1:1883"
+	ops.Username = "test"
+	ops.Password = "hahaha"
+	ops.ClientID = "delayed-1"
+	cli := mqtt.NewClient(ops)
+	err = cli.Start(obs)
+	assert.NoError(t, err)
+
+	pub := newPublishPacket(1, 1, "$delayed/100/test", "hi")
+	err = cli.Send(pub)
+	assert.NoError(t, err)
+	obs.assertPkts(&mqtt.Puback{ID: 1})
+	assert.NoError(t, cli.Close())
+
+	w := httptest.NewRecorder()
+	b.ServeDelayed(w, httptest.NewRequest(http.MethodGet, "/delayed", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var ms []session.DelayedMessage
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &ms))
+	assert.Len(t, ms, 1)
+	assert.Equal(t, "test", ms[0].Topic)
+
+	w = httptest.NewRecorder()
+	b.ServeDelayed(w, httptest.NewRequest(http.MethodDelete, "/delayed?id=x", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	b.ServeDelayed(w, httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/delayed?id=%d", ms[0].ID), nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = httptest.NewRecorder()
+	b.ServeDelayed(w, httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/delayed?id=%d", ms[0].ID), nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	b.ServeDelayed(w, httptest.NewRequest(http.MethodGet, "/delayed", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "[]", w.Body.String())
+}
+
+func TestBrokerServeRetained(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer os.RemoveAll("var")
+
+	file := path.Join(dir, "conf.yml")
+	err = ioutil.WriteFile(file, []byte(conf), 0644)
+	assert.NoError(t, err)
+
+	b := initBroker(t, file)
+	defer b.Close()
+
+	obs := newMockObserver(t)
+	ops := mqtt.NewClientOptions()
+	ops.Address = "tcp://127.0.0.1:1883"
+	ops.Username = "test"
+	ops.Password = "hahaha"
+	ops.ClientID = "retained-1"
+	cli := mqtt.NewClient(ops)
+	err = cli.Start(obs)
+	assert.NoError(t, err)
+
+	pub := newPublishPacket(1, 1, "test", "hi")
+	pub.Message.Retain = true
+	err = cli.Send(pub)
+	assert.NoError(t, err)
+	obs.assertPkts(&mqtt.Puback{ID: 1})
+	assert.NoError(t, cli.Close())
+
+	w := httptest.NewRecorder()
+	b.ServeRetained(w, httptest.NewRequest(http.MethodGet, "/retained", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var ms []session.RetainedMessage
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &ms))
+	assert.Len(t, ms, 1)
+	assert.Equal(t, "test", ms[0].Topic)
+	assert.Equal(t, "retained-1", ms[0].ClientID)
+	assert.Equal(t, "test", ms[0].Username)
+
+	w = httptest.NewRecorder()
+	b.ServeRetained(w, httptest.NewRequest(http.MethodDelete, "/retained", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestBrokerServeBans(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer os.RemoveAll("var")
+
+	file := path.Join(dir, "conf.yml")
+	err = ioutil.WriteFile(file, []byte(conf), 0644)
+	assert.NoError(t, err)
+
+	b := initBroker(t, file)
+	defer b.Close()
+
+	connect := func(code mqtt.ConnackCode) {
+		conn, err := mqtt.NewDialer(nil, 0).Dial("tcp://127.0.0.1:1883")
+		assert.NoError(t, err)
+		defer conn.Close()
+		pkt := &mqtt.Connect{ClientID: "bans-1", Username: "test", Password: "hahaha", Version: 3, CleanSession: true}
+		assert.NoError(t, conn.Send(pkt, false))
+		res, err := conn.Receive()
+		assert.NoError(t, err)
+		assert.Equal(t, code, res.(*mqtt.Connack).ReturnCode)
+	}
+	connect(mqtt.ConnectionAccepted)
+
+	w := httptest.NewRecorder()
+	b.ServeBans(w, httptest.NewRequest(http.MethodPost, "/bans", strings.NewReader(`{"type":"ip","value":"127.0.0.0/8"}`)))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	connect(mqtt.NotAuthorized)
+
+	w = httptest.NewRecorder()
+	b.ServeBans(w, httptest.NewRequest(http.MethodPost, "/bans", strings.NewReader(`{"type":"ip","value":"127.0.0.x"}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	b.ServeBans(w, httptest.NewRequest(http.MethodGet, "/bans", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `[{"type":"ip","value":"127.0.0.0/8"}]`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	b.ServeBans(w, httptest.NewRequest(http.MethodDelete, "/bans?type=ip&value=127.0.0.0/8", nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	connect(mqtt.ConnectionAccepted)
+
+	w = httptest.NewRecorder()
+	b.ServeBans(w, httptest.NewRequest(http.MethodDelete, "/bans?type=ip&value=127.0.0.0/8", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	b.ServeBans(w, httptest.NewRequest(http.MethodPut, "/bans", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	// the admin api is served on its own listener bound to localhost, not on the default mux
+	resp, err := http.Get("http://" + b.cfg.Admin.Address + "/bans")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "127.0.0.1:8006", b.cfg.Admin.Address)
+	w = httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/bans", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
 func initBroker(t *testing.T, confPath string) *Broker {
 	os.RemoveAll("./var")
 
@@ -0,0 +1,51 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+
+	"github.com/256dpi/gomqtt/transport"
+	"github.com/baetyl/baetyl-go/v2/mqtt"
+)
+
+// ConnInfo the information of the connection got from the listener
+type ConnInfo struct {
+	Anonymous      bool
+	Address        string    // the address of the listener accepting the connection
+	Token          string    // the token got from the websocket request, used as the password if the connect packet does not carry one
+	RateLimit      RateLimit // the publishing limit shared by the clients connected to the listener
+	MaxConnections int       // the max connections of the listener, 0 means no limit
+}
+
+// CertificateConn is implemented by the connection not based on a net connection, such as the grpc stream,
+// which provides the peer certificates itself
+type CertificateConn interface {
+	PeerCertificates() []*x509.Certificate
+}
+
+// GetPeerCertificates gets the peer certificates of the tls connection, the first one is the leaf
+func GetPeerCertificates(conn mqtt.Connection) []*x509.Certificate {
+	if cc, ok := conn.(CertificateConn); ok {
+		return cc.PeerCertificates()
+	}
+	tlsconn, ok := underlyingConn(conn).(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := tlsconn.ConnectionState()
+	if !state.HandshakeComplete {
+		return nil
+	}
+	return state.PeerCertificates
+}
+
+// underlyingConn gets the underlying connection of the mqtt connection
+func underlyingConn(conn mqtt.Connection) net.Conn {
+	if nc, ok := conn.(*transport.NetConn); ok {
+		return nc.UnderlyingConn()
+	} else if wss, ok := conn.(*transport.WebSocketConn); ok {
+		return wss.UnderlyingConn().UnderlyingConn()
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+//go:build linux
+// +build linux
+
+package common
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/baetyl/baetyl-go/v2/mqtt"
+)
+
+// GetPeerCredentials gets the uid and gid of the peer process connected to the unix socket by SO_PEERCRED
+func GetPeerCredentials(conn mqtt.Connection) (uid, gid uint32, ok bool) {
+	uc, ok := underlyingConn(conn).(*net.UnixConn)
+	if !ok {
+		return 0, 0, false
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return 0, 0, false
+	}
+	var cred *syscall.Ucred
+	err = raw.Control(func(fd uintptr) {
+		cred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || cred == nil {
+		return 0, 0, false
+	}
+	return cred.Uid, cred.Gid, true
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package common
+
+import (
+	"github.com/baetyl/baetyl-go/v2/mqtt"
+)
+
+// GetPeerCredentials is not supported on this platform
+func GetPeerCredentials(conn mqtt.Connection) (uid, gid uint32, ok bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,12 @@
+package common
+
+import "github.com/baetyl/baetyl-go/v2/utils"
+
+// RateLimit the token-bucket limit of messages and payload bytes published per second
+type RateLimit struct {
+	Messages     float64    `yaml:"messages" json:"messages" validate:"min=0"`         // 0 means no limit
+	MessageBurst int        `yaml:"messageBurst" json:"messageBurst" validate:"min=0"` // the max messages published at once, defaults to messages
+	Bytes        utils.Size `yaml:"bytes" json:"bytes"`                                // 0 means no limit
+	ByteBurst    utils.Size `yaml:"byteBurst" json:"byteBurst"`                        // the max bytes published at once, defaults to bytes
+	Action       string     `yaml:"action" json:"action" default:"delay" validate:"regexp=^(delay|drop|disconnect)$"`
+}
@@ -0,0 +1,21 @@
+package common
+
+import (
+	"net"
+)
+
+// ParseIPNet parses the IP or CIDR, the IP is parsed as the network containing itself only
+func ParseIPNet(v string) (*net.IPNet, error) {
+	if ip := net.ParseIP(v); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, n, err := net.ParseCIDR(v)
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
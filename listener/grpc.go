@@ -0,0 +1,68 @@
+package listener
+
+import (
+	"crypto/tls"
+	"net"
+	"net/url"
+
+	"github.com/baetyl/baetyl-go/v2/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/baetyl/baetyl-broker/v2/common"
+)
+
+// GRPCHandler is implemented by the handler which serves the grpc listeners
+type GRPCHandler interface {
+	RegisterGRPC(svr *grpc.Server, info common.ConnInfo)
+}
+
+// grpcServer the grpc server of a grpc or grpcs listener
+type grpcServer struct {
+	server   *grpc.Server
+	listener net.Listener
+}
+
+// Addr returns the address of the server
+func (s *grpcServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Close stops the server and closes the streams
+func (s *grpcServer) Close() error {
+	s.server.Stop()
+	return nil
+}
+
+// launchGRPC launches the grpc server of the listener, the services are registered by the handler
+func launchGRPC(c Listener, addr *url.URL, tlsconfig *tls.Config, handler Handler) (*grpcServer, error) {
+	h, ok := handler.(GRPCHandler)
+	if !ok {
+		return nil, errors.Errorf("grpc is not supported by the handler of the listener (%s)", c.Address)
+	}
+	var opts []grpc.ServerOption
+	if addr.Scheme == "grpcs" {
+		if tlsconfig == nil {
+			return nil, errors.Errorf("tls config of the listener (%s) is not set", c.Address)
+		}
+		// the tls handshake is done by grpc, which provides the peer certificates of the streams
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsconfig)))
+	}
+	if c.MaxConcurrentStreams > 0 {
+		opts = append(opts, grpc.MaxConcurrentStreams(c.MaxConcurrentStreams))
+	}
+	if c.MaxMessageSize > 0 {
+		opts = append(opts, grpc.MaxRecvMsgSize(int(c.MaxMessageSize)))
+	}
+	l, err := listen(c, addr, nil)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	s := &grpcServer{
+		server:   grpc.NewServer(opts...),
+		listener: l,
+	}
+	h.RegisterGRPC(s.server, c.connInfo())
+	go s.server.Serve(l)
+	return s, nil
+}
@@ -0,0 +1,62 @@
+package listener
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/baetyl/baetyl-go/v2/errors"
+
+	"github.com/baetyl/baetyl-broker/v2/common"
+)
+
+// HTTPHandler is implemented by the handler which serves the http listeners
+type HTTPHandler interface {
+	NewHTTPHandler(info common.ConnInfo) http.Handler
+}
+
+// httpServer the http server of a http or https listener
+type httpServer struct {
+	server   *http.Server
+	listener net.Listener
+}
+
+// Addr returns the address of the server
+func (s *httpServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Close closes the server and the requests in progress
+func (s *httpServer) Close() error {
+	return s.server.Close()
+}
+
+// launchHTTP launches the http server of the listener, the requests are served by the handler
+func launchHTTP(c Listener, addr *url.URL, tlsconfig *tls.Config, handler Handler) (*httpServer, error) {
+	h, ok := handler.(HTTPHandler)
+	if !ok {
+		return nil, errors.Errorf("http is not supported by the handler of the listener (%s)", c.Address)
+	}
+	if addr.Scheme == "https" && tlsconfig == nil {
+		return nil, errors.Errorf("tls config of the listener (%s) is not set", c.Address)
+	}
+	l, err := listen(c, addr, tlsconfig)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	hh := h.NewHTTPHandler(c.connInfo())
+	if max := int64(c.MaxMessageSize); max > 0 {
+		next := hh
+		hh = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Body = http.MaxBytesReader(w, r.Body, max)
+			next.ServeHTTP(w, r)
+		})
+	}
+	s := &httpServer{
+		server:   &http.Server{Handler: hh},
+		listener: l,
+	}
+	go s.server.Serve(l)
+	return s, nil
+}
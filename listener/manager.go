@@ -2,13 +2,18 @@ package listener
 
 import (
 	"crypto/tls"
-	"fmt"
 	"io"
+	"net"
+	"net/url"
+	"time"
 
+	"github.com/256dpi/gomqtt/transport"
 	"github.com/baetyl/baetyl-go/v2/errors"
 	"github.com/baetyl/baetyl-go/v2/log"
 	"github.com/baetyl/baetyl-go/v2/mqtt"
 	"github.com/baetyl/baetyl-go/v2/utils"
+
+	"github.com/baetyl/baetyl-broker/v2/common"
 )
 
 // Config listener config
@@ -18,51 +23,107 @@ type Config struct {
 
 // Listener listener config
 type Listener struct {
-	Address              string     `yaml:"address" json:"address"`
-	MaxMessageSize       utils.Size `yaml:"maxMessageSize" json:"maxMessageSize"`
-	MaxConcurrentStreams uint32     `yaml:"maxConcurrentStreams" json:"maxConcurrentStreams"`
-	Anonymous            bool       `yaml:"anonymous" json:"anonymous"`
+	Address              string              `yaml:"address" json:"address"`
+	MaxMessageSize       utils.Size          `yaml:"maxMessageSize" json:"maxMessageSize"`
+	MaxConcurrentStreams uint32              `yaml:"maxConcurrentStreams" json:"maxConcurrentStreams"`
+	Anonymous            bool                `yaml:"anonymous" json:"anonymous"`
+	ClientAuth           string              `yaml:"clientAuth" json:"clientAuth"`                      // none, request, require-any, verify-if-given (default) or require-and-verify
+	MinVersion           string              `yaml:"minVersion" json:"minVersion"`                      // the minimum tls version, 1.0, 1.1, 1.2 or 1.3
+	CipherSuites         []string            `yaml:"cipherSuites" json:"cipherSuites"`                  // the names of cipher suites, such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+	ALPN                 []string            `yaml:"alpn" json:"alpn"`                                  // the supported application level protocols
+	CRL                  string              `yaml:"crl" json:"crl"`                                    // the path of certificate revocation list file
+	ReloadInterval       time.Duration       `yaml:"reloadInterval" json:"reloadInterval" default:"1m"` // the interval to check and reload the modified certificates and CRL, 0 means not to reload
+	Certificates         []ServerCertificate `yaml:"certificates" json:"certificates"`                  // the certificates selected by SNI server name, the inline certificate is the default one
+	ProxyProtocol        bool                `yaml:"proxyProtocol" json:"proxyProtocol"`                // parses the PROXY protocol v1/v2 header before the MQTT handshake to get the real client address
+	ProxyTrusted         []string            `yaml:"proxyTrusted" json:"proxyTrusted"`                  // the IPs or CIDRs of the upstreams permitted to send the header, empty means all, the others are served as direct connections
+	ProxyHeaderTimeout   time.Duration       `yaml:"proxyHeaderTimeout" json:"proxyHeaderTimeout" default:"5s"`
+	SocketMode           string              `yaml:"socketMode" json:"socketMode"`   // the octal file mode of the unix socket, such as 0660
+	SocketOwner          string              `yaml:"socketOwner" json:"socketOwner"` // the owner of the unix socket like user:group, the user and group are names or ids
+	WebSocket            WebSocket           `yaml:"websocket" json:"websocket"`
+	RateLimit            common.RateLimit    `yaml:"rateLimit" json:"rateLimit"`                            // the publishing limit shared by the clients connected to the listener
+	MaxConnections       int                 `yaml:"maxConnections" json:"maxConnections" validate:"min=0"` // the max connections of the listener, 0 means no limit
 	utils.Certificate    `yaml:",inline" json:",inline"`
 }
 
+// connInfo returns the information of the connections accepted by the listener
+func (c Listener) connInfo() common.ConnInfo {
+	return common.ConnInfo{Anonymous: c.Anonymous, Address: c.Address, RateLimit: c.RateLimit, MaxConnections: c.MaxConnections}
+}
+
+// ServerCertificate the server certificate for the server names
+type ServerCertificate struct {
+	ServerNames []string `yaml:"serverNames" json:"serverNames" validate:"nonzero"` // supports the wildcard server name, such as *.example.com
+	Key         string   `yaml:"key" json:"key" validate:"nonzero"`
+	Cert        string   `yaml:"cert" json:"cert" validate:"nonzero"`
+}
+
 // Handler listener handler
 type Handler interface {
 	Handle(conn mqtt.Connection, anonymous bool)
 }
 
+// ListenerHandler is implemented by the handler which distinguishes the listeners accepting the connections
+type ListenerHandler interface {
+	HandleListener(conn mqtt.Connection, info common.ConnInfo)
+}
+
+// Disconnector is implemented by the handler which can disconnect the connections it handles
+type Disconnector interface {
+	Disconnect(match func(conn mqtt.Connection) bool)
+}
+
 // Manager listener manager
 type Manager struct {
-	mqtts []mqtt.Server
-	log   *log.Logger
+	mqtts      []mqtt.Server
+	gateways   []gateway            // the grpc and http servers
+	websockets map[string]*wsServer // the websocket servers shared by the listeners on the same port
+	tomb       utils.Tomb
+	log        *log.Logger
 }
 
 // NewManager creates a new listener manager
 func NewManager(cfg []Listener, handler Handler) (*Manager, error) {
 	m := &Manager{
-		mqtts: make([]mqtt.Server, 0),
-		log:   log.With(log.Any("listener", "manager")),
+		mqtts:      make([]mqtt.Server, 0),
+		websockets: map[string]*wsServer{},
+		log:        log.With(log.Any("listener", "manager")),
 	}
 	var err error
-	tlsconfigs := map[string]*tls.Config{}
 	for _, c := range cfg {
 		var tlsconfig *tls.Config
-		if c.Key != "" || c.Cert != "" {
-			tlsconfig = tlsconfigs[fmt.Sprintf(c.CA, "`", c.Key, "`", c.Cert)]
-			if tlsconfig == nil {
-				// TODO: support more ClientAuthType type
-				c.Certificate.ClientAuthType = tls.VerifyClientCertIfGiven
-				tlsconfig, err = utils.NewTLSConfigServer(c.Certificate)
-				if err != nil {
-					_err := m.Close()
-					if _err != nil {
-						m.log.Error("failed to close manager", log.Any("address", c.Address), log.Error(err))
-					}
-					return nil, errors.Trace(err)
+		if c.Key != "" || c.Cert != "" || len(c.Certificates) > 0 {
+			var r *tlsReloader
+			r, err = newTLSReloader(c)
+			if err != nil {
+				_err := m.Close()
+				if _err != nil {
+					m.log.Error("failed to close manager", log.Any("address", c.Address), log.Error(err))
+				}
+				return nil, errors.Trace(err)
+			}
+			tlsconfig = r.tlsConfig()
+			if c.ReloadInterval > 0 {
+				m.tomb.Go(func() error {
+					return m.reloading(r, handler)
+				})
+			}
+		}
+
+		if isGateway(c.Address) {
+			svr, err := m.launchGateway(c, tlsconfig, handler)
+			if err != nil {
+				_err := m.Close()
+				if _err != nil {
+					m.log.Error("failed to launch gateway server", log.Any("address", c.Address), log.Error(err))
 				}
+				return nil, errors.Trace(err)
 			}
+			m.gateways = append(m.gateways, svr)
+			m.log.Info("listener has initialized", log.Any("listener", svr.Addr()))
+			continue
 		}
 
-		svr, err := m.launchMQTTServer(c.Address, tlsconfig, c.Anonymous, handler)
+		svr, err := m.launchMQTTServer(c, tlsconfig, handler)
 		if err != nil {
 			_err := m.Close()
 			if _err != nil {
@@ -76,14 +137,15 @@ func NewManager(cfg []Listener, handler Handler) (*Manager, error) {
 	return m, nil
 }
 
-func (m *Manager) launchMQTTServer(address string, tlsconfig *tls.Config, anonymous bool, handler Handler) (mqtt.Server, error) {
-	svr, err := mqtt.NewLauncher(tlsconfig).Launch(address)
+func (m *Manager) launchMQTTServer(c Listener, tlsconfig *tls.Config, handler Handler) (mqtt.Server, error) {
+	svr, err := m.launch(c, tlsconfig)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
+	info := c.connInfo()
 	go func() {
 		for {
-			conn, err := svr.Accept()
+			conn, token, err := accept(svr)
 			if err != nil {
 				if err == io.EOF {
 					m.log.Debug("failed to accept connection", log.Error(err))
@@ -92,17 +154,192 @@ func (m *Manager) launchMQTTServer(address string, tlsconfig *tls.Config, anonym
 				}
 				return
 			}
-			handler.Handle(conn, anonymous)
+			if h, ok := handler.(ListenerHandler); ok {
+				info := info
+				info.Token = token
+				h.HandleListener(conn, info)
+			} else {
+				handler.Handle(conn, info.Anonymous)
+			}
 		}
 	}()
 	return svr, nil
 }
 
+// gateway the server of the grpc or http listener, which serves the requests by the handler instead of MQTT connections
+type gateway interface {
+	Addr() net.Addr
+	Close() error
+}
+
+// isGateway checks whether the listener is a gateway, such as grpc://0.0.0.0:8273 or http://0.0.0.0:8280
+func isGateway(address string) bool {
+	addr, err := url.ParseRequestURI(address)
+	if err != nil {
+		return false
+	}
+	switch addr.Scheme {
+	case "grpc", "grpcs", "http", "https":
+		return true
+	}
+	return false
+}
+
+// launchGateway launches the grpc or http server of the listener
+func (m *Manager) launchGateway(c Listener, tlsconfig *tls.Config, handler Handler) (gateway, error) {
+	addr, err := url.ParseRequestURI(c.Address)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if addr.Scheme == "http" || addr.Scheme == "https" {
+		return launchHTTP(c, addr, tlsconfig, handler)
+	}
+	return launchGRPC(c, addr, tlsconfig, handler)
+}
+
+// accept accepts the connection, and the token got from the websocket request if any
+func accept(svr mqtt.Server) (mqtt.Connection, string, error) {
+	if r, ok := svr.(*wsRoute); ok {
+		return r.accept()
+	}
+	conn, err := svr.Accept()
+	return conn, "", err
+}
+
+// launch launches the server of the listener
+func (m *Manager) launch(c Listener, tlsconfig *tls.Config) (mqtt.Server, error) {
+	addr, err := url.ParseRequestURI(c.Address)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	switch addr.Scheme {
+	case "unix":
+		if c.ProxyProtocol {
+			return nil, errors.Errorf("proxy protocol is not supported by the listener (%s)", c.Address)
+		}
+		// such as unix:///run/baetyl/broker.sock, or unix://broker.sock relative to the working directory
+		return launchUnix(c, addr.Host+addr.Path)
+	case "ws", "wss":
+		return m.launchWebSocket(c, addr, tlsconfig)
+	}
+	if !c.ProxyProtocol {
+		return mqtt.NewLauncher(tlsconfig).Launch(c.Address)
+	}
+	l, err := listen(c, addr, tlsconfig)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return transport.NewNetServer(l), nil
+}
+
+// launchWebSocket launches the websocket server of the listener, the listeners with paths on the same port
+// share the server launched by the first one, whose tls and proxy protocol settings are used
+func (m *Manager) launchWebSocket(c Listener, addr *url.URL, tlsconfig *tls.Config) (mqtt.Server, error) {
+	// the cookie is sent by the browser with the cross-site request, the origins must be restricted
+	if c.WebSocket.Token.Cookie != "" && !restrictsOrigin(c.WebSocket.Origins) {
+		return nil, errors.Errorf("origins of the listener (%s) must be restricted if the token is got from cookie", c.Address)
+	}
+	_, port, err := net.SplitHostPort(addr.Host)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// the listener without paths serves all paths, and the random port is not shared
+	shared := len(c.WebSocket.Paths) > 0 && port != "0"
+	key := addr.Scheme + "://" + addr.Host
+	s, ok := m.websockets[key]
+	launched := !ok || !shared
+	if launched {
+		l, err := listen(c, addr, tlsconfig)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		s = newWSServer(l)
+		if shared {
+			m.websockets[key] = s
+		}
+	}
+	r, err := s.route(c)
+	if err != nil {
+		if launched {
+			s.server.Close()
+			if shared {
+				delete(m.websockets, key)
+			}
+		}
+		return nil, errors.Trace(err)
+	}
+	return r, nil
+}
+
+// listen listens on the tcp address of the listener, parses the PROXY protocol header if enabled,
+// the header is sent before the tls handshake
+func listen(c Listener, addr *url.URL, tlsconfig *tls.Config) (net.Listener, error) {
+	secure := false
+	switch addr.Scheme {
+	case "tcp", "mqtt", "ws", "http", "grpc", "grpcs":
+		// the tls handshake of grpcs is done by grpc
+	case "tls", "ssl", "mqtts", "wss", "https":
+		secure = true
+	default:
+		return nil, errors.Errorf("proxy protocol is not supported by the listener (%s)", c.Address)
+	}
+	if !c.ProxyProtocol {
+		if secure {
+			return tls.Listen("tcp", addr.Host, tlsconfig)
+		}
+		return net.Listen("tcp", addr.Host)
+	}
+	if secure && tlsconfig == nil {
+		return nil, errors.Errorf("tls config of the listener (%s) is not set", c.Address)
+	}
+	l, err := net.Listen("tcp", addr.Host)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	pl, err := newProxyListener(l, c)
+	if err != nil {
+		l.Close()
+		return nil, errors.Trace(err)
+	}
+	if secure {
+		return tls.NewListener(pl, tlsconfig), nil
+	}
+	return pl, nil
+}
+
+// reloading reloads the modified certificates and CRL periodically,
+// and disconnects the connections whose certificates are revoked
+func (m *Manager) reloading(r *tlsReloader, handler Handler) error {
+	t := time.NewTicker(r.cfg.ReloadInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			crl, err := r.reload()
+			if err != nil {
+				r.log.Error("failed to reload tls config", log.Error(err))
+				continue
+			}
+			if d, ok := handler.(Disconnector); ok && crl {
+				d.Disconnect(r.isConnRevoked)
+			}
+		case <-m.tomb.Dying():
+			return nil
+		}
+	}
+}
+
 // Close closes listener
 func (m *Manager) Close() error {
 	m.log.Info("listener manager is closing")
 	defer m.log.Info("listener manager has closed")
 
+	m.tomb.Kill(nil)
+	err := m.tomb.Wait()
+	if err != nil {
+		m.log.Error("failed to stop reloading", log.Error(err))
+	}
+
 	for _, svr := range m.mqtts {
 		err := svr.Close()
 		if err != nil {
@@ -110,5 +347,12 @@ func (m *Manager) Close() error {
 		}
 		m.log.Info("listener has stopped", log.Any("listener", svr.Addr()))
 	}
+	for _, svr := range m.gateways {
+		err := svr.Close()
+		if err != nil {
+			m.log.Error("failed to close gateway server", log.Any("address", svr.Addr()), log.Error(err))
+		}
+		m.log.Info("listener has stopped", log.Any("listener", svr.Addr()))
+	}
 	return nil
 }
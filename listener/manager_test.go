@@ -1,15 +1,38 @@
 package listener
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/256dpi/gomqtt/transport"
 	"github.com/baetyl/baetyl-go/v2/mqtt"
 	"github.com/baetyl/baetyl-go/v2/utils"
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	"github.com/baetyl/baetyl-broker/v2/common"
 )
 
 type mockHandler struct {
@@ -117,7 +140,8 @@ func TestMqttTcpTls(t *testing.T) {
 	dailer := mqtt.NewDialer(nil, time.Duration(0))
 	conn, err := dailer.Dial(url)
 	assert.Nil(t, conn)
-	switch err.Error() {
+	// newer versions of golang wrap the x509 error
+	switch strings.TrimPrefix(err.Error(), "tls: failed to verify certificate: ") {
 	case "x509: certificate signed by unknown authority":
 	case "x509: cannot validate certificate for 127.0.0.1 because it doesn't contain any IP SANs":
 	default:
@@ -253,7 +277,8 @@ func TestMqttWebSocketTls(t *testing.T) {
 	dailer := mqtt.NewDialer(nil, time.Duration(0))
 	conn, err := dailer.Dial(url)
 	assert.Nil(t, conn)
-	switch err.Error() {
+	// newer versions of golang wrap the x509 error
+	switch strings.TrimPrefix(err.Error(), "tls: failed to verify certificate: ") {
 	case "x509: certificate signed by unknown authority":
 	case "x509: cannot validate certificate for 127.0.0.1 because it doesn't contain any IP SANs":
 	default:
@@ -279,6 +304,317 @@ func TestMqttWebSocketTls(t *testing.T) {
 	conn.Close()
 }
 
+func TestMqttTlsOptions(t *testing.T) {
+	cert := utils.Certificate{
+		CA:   "../example/var/lib/baetyl/testcert/ca.crt",
+		Key:  "../example/var/lib/baetyl/testcert/server.key",
+		Cert: "../example/var/lib/baetyl/testcert/server.crt",
+	}
+	cfg := []Listener{
+		{
+			Address:     "ssl://localhost:0",
+			ClientAuth:  "require-and-verify",
+			Certificate: cert,
+		},
+		{
+			Address:      "ssl://localhost:0",
+			ClientAuth:   "none",
+			MinVersion:   "1.2",
+			CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+			ALPN:         []string{"mqtt"},
+			Certificate:  cert,
+		},
+	}
+	handler := newMockHandler(t)
+	handler.handle = func(conn mqtt.Connection) {
+		// the connections failed to handshake are ignored
+		p, err := conn.Receive()
+		if err != nil {
+			return
+		}
+		conn.Send(p, false)
+	}
+	m, err := NewManager(cfg, handler)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(m.mqtts))
+	defer m.Close()
+
+	pkt := mqtt.NewConnect()
+	pkt.ClientID = t.Name()
+
+	// the client certificate is required
+	tlscli := &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12}
+	dailer := mqtt.NewDialer(tlscli, time.Duration(0))
+	_, err = dailer.Dial(getURL(m.mqtts[0], "ssl"))
+	assert.Error(t, err)
+
+	tlscli, err = utils.NewTLSConfigClient(utils.Certificate{
+		CA:                 "../example/var/lib/baetyl/testcert/ca.crt",
+		Key:                "../example/var/lib/baetyl/testcert/client.key",
+		Cert:               "../example/var/lib/baetyl/testcert/client.crt",
+		InsecureSkipVerify: true,
+	})
+	assert.NoError(t, err)
+	dailer = mqtt.NewDialer(tlscli, time.Duration(0))
+	conn, err := dailer.Dial(getURL(m.mqtts[0], "ssl"))
+	assert.NoError(t, err)
+	err = conn.Send(pkt, false)
+	assert.NoError(t, err)
+	res, err := conn.Receive()
+	assert.NoError(t, err)
+	assert.Equal(t, pkt.String(), res.String())
+	conn.Close()
+
+	// the client certificate is not required, the tls version is too low
+	tlscli = &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS11}
+	dailer = mqtt.NewDialer(tlscli, time.Duration(0))
+	_, err = dailer.Dial(getURL(m.mqtts[1], "ssl"))
+	assert.Error(t, err)
+
+	// the cipher suite is not supported
+	tlscli = &tls.Config{
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS12,
+		CipherSuites:       []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384},
+	}
+	dailer = mqtt.NewDialer(tlscli, time.Duration(0))
+	_, err = dailer.Dial(getURL(m.mqtts[1], "ssl"))
+	assert.Error(t, err)
+
+	tlscli = &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12, NextProtos: []string{"mqtt"}}
+	nc, err := tls.Dial("tcp", m.mqtts[1].Addr().String(), tlscli)
+	assert.NoError(t, err)
+	assert.Equal(t, "mqtt", nc.ConnectionState().NegotiatedProtocol)
+	nc.Close()
+
+	// invalid options
+	for _, c := range []Listener{
+		{Address: "ssl://localhost:0", ClientAuth: "unknown", Certificate: cert},
+		{Address: "ssl://localhost:0", MinVersion: "1.4", Certificate: cert},
+		{Address: "ssl://localhost:0", CipherSuites: []string{"unknown"}, Certificate: cert},
+	} {
+		_, err = NewManager([]Listener{c}, newMockHandler(t))
+		assert.Error(t, err)
+	}
+}
+
+type mockDisconnector struct {
+	*mockHandler
+	conns chan mqtt.Connection
+}
+
+func (m *mockDisconnector) Disconnect(match func(conn mqtt.Connection) bool) {
+	for {
+		select {
+		case conn := <-m.conns:
+			if match(conn) {
+				conn.Close()
+			}
+		default:
+			return
+		}
+	}
+}
+
+func TestMqttTlsReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca, caKey := genTestCert(t, dir, "ca", 1, nil, nil)
+	genTestCert(t, dir, "server", 2, ca, caKey)
+	genTestCert(t, dir, "client", 3, ca, caKey)
+	genTestCRL(t, dir, ca, caKey)
+
+	handler := &mockDisconnector{mockHandler: newMockHandler(t), conns: make(chan mqtt.Connection, 10)}
+	handler.handle = func(conn mqtt.Connection) {
+		p, err := conn.Receive()
+		if err != nil {
+			return
+		}
+		handler.conns <- conn
+		conn.Send(p, false)
+	}
+	cfg := []Listener{
+		{
+			Address:        "ssl://127.0.0.1:0",
+			ClientAuth:     "require-and-verify",
+			CRL:            path.Join(dir, "crl.pem"),
+			ReloadInterval: 50 * time.Millisecond,
+			Certificate: utils.Certificate{
+				CA:   path.Join(dir, "ca.crt"),
+				Key:  path.Join(dir, "server.key"),
+				Cert: path.Join(dir, "server.crt"),
+			},
+		},
+	}
+	m, err := NewManager(cfg, handler)
+	assert.NoError(t, err)
+	defer m.Close()
+
+	tlscli, err := utils.NewTLSConfigClient(utils.Certificate{
+		CA:   path.Join(dir, "ca.crt"),
+		Key:  path.Join(dir, "client.key"),
+		Cert: path.Join(dir, "client.crt"),
+	})
+	assert.NoError(t, err)
+	tlscli.MaxVersion = tls.VersionTLS12
+	dailer := mqtt.NewDialer(tlscli, time.Duration(0))
+	pkt := mqtt.NewConnect()
+	pkt.ClientID = t.Name()
+	conn, err := dailer.Dial(getURL(m.mqtts[0], "ssl"))
+	assert.NoError(t, err)
+	err = conn.Send(pkt, false)
+	assert.NoError(t, err)
+	res, err := conn.Receive()
+	assert.NoError(t, err)
+	assert.Equal(t, pkt.String(), res.String())
+
+	// the server certificate is reloaded
+	genTestCert(t, dir, "server", 4, ca, caKey)
+	time.Sleep(200 * time.Millisecond)
+	nc, err := tls.Dial("tcp", m.mqtts[0].Addr().String(), tlscli)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), nc.ConnectionState().PeerCertificates[0].SerialNumber.Int64())
+	nc.Close()
+
+	// the CRL not signed by the ca is refused
+	otherDir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(otherDir)
+	other, otherKey := genTestCert(t, otherDir, "ca", 1, nil, nil)
+	genTestCRL(t, dir, other, otherKey, 3)
+	time.Sleep(200 * time.Millisecond)
+	nc, err = tls.Dial("tcp", m.mqtts[0].Addr().String(), tlscli)
+	assert.NoError(t, err)
+	assert.NoError(t, nc.Handshake())
+	nc.Close()
+	_, err = NewManager(cfg, handler)
+	assert.Error(t, err)
+
+	// the client certificate is revoked, the live connection is disconnected
+	genTestCRL(t, dir, ca, caKey, 3)
+	_, err = conn.Receive()
+	assert.Error(t, err)
+	_, err = dailer.Dial(getURL(m.mqtts[0], "ssl"))
+	assert.Error(t, err)
+}
+
+func TestMqttTlsSNI(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ca, caKey := genTestCert(t, dir, "ca", 1, nil, nil)
+	genTestCert(t, dir, "server", 2, ca, caKey)
+	genTestCert(t, dir, "a", 3, ca, caKey, "a.example.com")
+	genTestCert(t, dir, "b", 4, ca, caKey, "*.b.example.com")
+
+	cfg := []Listener{
+		{
+			Address: "ssl://127.0.0.1:0",
+			Certificates: []ServerCertificate{
+				{ServerNames: []string{"a.example.com"}, Key: path.Join(dir, "a.key"), Cert: path.Join(dir, "a.crt")},
+				{ServerNames: []string{"*.b.example.com"}, Key: path.Join(dir, "b.key"), Cert: path.Join(dir, "b.crt")},
+			},
+			Certificate: utils.Certificate{
+				CA:   path.Join(dir, "ca.crt"),
+				Key:  path.Join(dir, "server.key"),
+				Cert: path.Join(dir, "server.crt"),
+			},
+		},
+		{
+			Address: "ssl://127.0.0.1:0",
+			Certificates: []ServerCertificate{
+				{ServerNames: []string{"a.example.com"}, Key: path.Join(dir, "a.key"), Cert: path.Join(dir, "a.crt")},
+				{ServerNames: []string{"*.b.example.com"}, Key: path.Join(dir, "b.key"), Cert: path.Join(dir, "b.crt")},
+			},
+		},
+	}
+	handler := newMockHandler(t)
+	handler.handle = func(conn mqtt.Connection) {
+		// to complete the handshake
+		go conn.Receive()
+	}
+	m, err := NewManager(cfg, handler)
+	assert.NoError(t, err)
+	defer m.Close()
+
+	serial := func(svr mqtt.Server, name string) int64 {
+		nc, err := tls.Dial("tcp", svr.Addr().String(), &tls.Config{ServerName: name, InsecureSkipVerify: true})
+		assert.NoError(t, err)
+		defer nc.Close()
+		return nc.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+	assert.Equal(t, int64(3), serial(m.mqtts[0], "a.example.com"))
+	assert.Equal(t, int64(3), serial(m.mqtts[0], "A.example.com"))
+	assert.Equal(t, int64(4), serial(m.mqtts[0], "x.b.example.com"))
+	assert.Equal(t, int64(2), serial(m.mqtts[0], "b.example.com"))
+	assert.Equal(t, int64(2), serial(m.mqtts[0], ""))
+
+	// the first certificate is the default one
+	assert.Equal(t, int64(4), serial(m.mqtts[1], "x.b.example.com"))
+	assert.Equal(t, int64(3), serial(m.mqtts[1], "c.example.com"))
+
+	// the certificate file is not found
+	cfg[1].Certificates[1].Cert = path.Join(dir, "c.crt")
+	_, err = NewManager(cfg[1:], handler)
+	assert.Error(t, err)
+}
+
+func genTestCert(t *testing.T, dir, name string, serial int64, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, dnsNames ...string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:     dnsNames,
+	}
+	if parent == nil {
+		tpl.IsCA = true
+		tpl.BasicConstraintsValid = true
+		parent, parentKey = tpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, parent, &key.PublicKey, parentKey)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	writeTestFile(t, path.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}))
+	writeTestFile(t, path.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	return cert, key
+}
+
+func genTestCRL(t *testing.T, dir string, ca *x509.Certificate, caKey *ecdsa.PrivateKey, serials ...int64) {
+	var revoked []pkix.RevokedCertificate
+	for _, s := range serials {
+		revoked = append(revoked, pkix.RevokedCertificate{SerialNumber: big.NewInt(s), RevocationTime: time.Now()})
+	}
+	der, err := ca.CreateCRL(rand.Reader, caKey, revoked, time.Now(), time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	writeTestFile(t, path.Join(dir, "crl.pem"), pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}))
+}
+
+// writeTestFile writes the file and changes its modification time to make sure it is reloaded
+func writeTestFile(t *testing.T, file string, data []byte) {
+	var mod time.Time
+	if fi, err := os.Stat(file); err == nil {
+		mod = fi.ModTime()
+	}
+	err := ioutil.WriteFile(file, data, 0644)
+	assert.NoError(t, err)
+	if !mod.IsZero() {
+		err = os.Chtimes(file, time.Now(), mod.Add(time.Second))
+		assert.NoError(t, err)
+	}
+}
+
 func TestServerException(t *testing.T) {
 	cfg := []Listener{
 		{Address: "tcp://:28767"},
@@ -328,6 +664,330 @@ func TestServerException(t *testing.T) {
 // 	return port
 // }
 
+func TestMqttProxyProtocol(t *testing.T) {
+	remotes := make(chan string, 10)
+	handler := newMockHandler(t)
+	handler.handle = func(conn mqtt.Connection) {
+		remotes <- conn.RemoteAddr().String()
+		p, err := conn.Receive()
+		if err != nil {
+			return
+		}
+		assert.NoError(t, conn.Send(p, false))
+	}
+	cfg := []Listener{
+		{Address: "tcp://127.0.0.1:0", ProxyProtocol: true, ProxyHeaderTimeout: time.Second},
+		{Address: "tcp://127.0.0.1:0", ProxyProtocol: true, ProxyTrusted: []string{"10.0.0.0/8"}},
+	}
+	m, err := NewManager(cfg, handler)
+	assert.NoError(t, err)
+	defer m.Close()
+
+	pkt := mqtt.NewConnect()
+	pkt.ClientID = t.Name()
+	connect := func(svr mqtt.Server, header []byte) error {
+		raw, err := net.Dial("tcp", svr.Addr().String())
+		assert.NoError(t, err)
+		defer raw.Close()
+		_, err = raw.Write(header)
+		assert.NoError(t, err)
+		conn := transport.NewNetConn(raw)
+		err = conn.Send(pkt, false)
+		assert.NoError(t, err)
+		res, err := conn.Receive()
+		if err != nil {
+			return err
+		}
+		assert.Equal(t, pkt.String(), res.String())
+		return nil
+	}
+
+	// v1
+	assert.NoError(t, connect(m.mqtts[0], []byte("PROXY TCP4 192.0.2.1 127.0.0.1 5555 1883\r\n")))
+	assert.Equal(t, "192.0.2.1:5555", <-remotes)
+	assert.NoError(t, connect(m.mqtts[0], []byte("PROXY UNKNOWN\r\n")))
+	assert.True(t, strings.HasPrefix(<-remotes, "127.0.0.1:"))
+
+	// v2
+	header := append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x21, 0x21, 0, 36)
+	header = append(header, net.ParseIP("2001:db8::1").To16()...)
+	header = append(header, net.ParseIP("::1").To16()...)
+	header = append(header, 0x15, 0xb3, 0x07, 0x5b)
+	assert.NoError(t, connect(m.mqtts[0], header))
+	assert.Equal(t, "[2001:db8::1]:5555", <-remotes)
+	header = append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x21, 0x11, 0, 12, 192, 0, 2, 2, 127, 0, 0, 1, 0x15, 0xb3, 0x07, 0x5b)
+	assert.NoError(t, connect(m.mqtts[0], header))
+	assert.Equal(t, "192.0.2.2:5555", <-remotes)
+
+	// the header is missing or invalid
+	assert.Error(t, connect(m.mqtts[0], nil))
+	assert.Error(t, connect(m.mqtts[0], []byte("PROXY TCP4 192.0.2.1\r\n")))
+
+	// the upstream is not trusted, the connection is served as a direct one
+	assert.NoError(t, connect(m.mqtts[1], nil))
+	assert.True(t, strings.HasPrefix(<-remotes, "127.0.0.1:"))
+	assert.Len(t, remotes, 0)
+
+	_, err = NewManager([]Listener{{Address: "tcp://127.0.0.1:0", ProxyProtocol: true, ProxyTrusted: []string{"10.0.0.0/33"}}}, handler)
+	assert.EqualError(t, err, "proxy trusted address (10.0.0.0/33) is invalid")
+	_, err = NewManager([]Listener{{Address: "ssl://127.0.0.1:0", ProxyProtocol: true}}, handler)
+	assert.EqualError(t, err, "tls config of the listener (ssl://127.0.0.1:0) is not set")
+}
+
+func TestMqttUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	sock := path.Join(dir, "run", "broker.sock")
+	// the stale socket file is removed
+	assert.NoError(t, os.MkdirAll(path.Dir(sock), 0755))
+	stale, err := net.Listen("unix", sock)
+	assert.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	assert.NoError(t, stale.Close())
+
+	cfg := []Listener{{Address: "unix://" + sock, SocketMode: "0600", SocketOwner: fmt.Sprintf("%d:%d", os.Getuid(), os.Getgid())}}
+	m, err := NewManager(cfg, newMockHandler(t))
+	assert.NoError(t, err)
+	fi, err := os.Stat(sock)
+	assert.NoError(t, err)
+	assert.Equal(t, os.ModeSocket|0600, fi.Mode())
+	// the private directory creating the socket file is removed
+	files, err := ioutil.ReadDir(path.Dir(sock))
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+
+	raw, err := net.Dial("unix", sock)
+	assert.NoError(t, err)
+	conn := transport.NewNetConn(raw)
+	pkt := mqtt.NewConnect()
+	pkt.ClientID = t.Name()
+	assert.NoError(t, conn.Send(pkt, false))
+	res, err := conn.Receive()
+	assert.NoError(t, err)
+	assert.Equal(t, pkt.String(), res.String())
+	conn.Close()
+
+	// the socket file is removed after closed
+	m.Close()
+	_, err = os.Stat(sock)
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = NewManager([]Listener{{Address: "unix://" + sock, SocketMode: "0800"}}, newMockHandler(t))
+	assert.EqualError(t, err, fmt.Sprintf("socket mode (0800) of the listener (unix://%s) is invalid", sock))
+	file := path.Join(dir, "file")
+	assert.NoError(t, ioutil.WriteFile(file, nil, 0644))
+	_, err = NewManager([]Listener{{Address: "unix://" + file}}, newMockHandler(t))
+	assert.EqualError(t, err, fmt.Sprintf("socket path (%s) of the listener (unix://%s) is not a socket", file, file))
+}
+
+type mockListenerHandler struct {
+	infos chan common.ConnInfo
+}
+
+func (m *mockListenerHandler) Handle(conn mqtt.Connection, anonymous bool) {
+	m.HandleListener(conn, common.ConnInfo{Anonymous: anonymous})
+}
+
+func (m *mockListenerHandler) HandleListener(conn mqtt.Connection, info common.ConnInfo) {
+	m.infos <- info
+	p, err := conn.Receive()
+	if err != nil {
+		return
+	}
+	conn.Send(p, false)
+}
+
+func TestMqttWebSocketOptions(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	assert.NoError(t, l.Close())
+
+	handler := &mockListenerHandler{infos: make(chan common.ConnInfo, 10)}
+	cfg := []Listener{{
+		Address: fmt.Sprintf("ws://127.0.0.1:%d/mqtt", port),
+		WebSocket: WebSocket{
+			Paths:               []string{"/mqtt", "/mqtt2"},
+			Origins:             []string{"https://*.example.com", "http://localhost:8080"},
+			SubprotocolRequired: true,
+			Compression:         true,
+			Token:               WebSocketToken{Header: "Authorization", Query: "token", Cookie: "token"},
+		},
+		RateLimit:      common.RateLimit{Messages: 10, Action: "drop"},
+		MaxConnections: 100,
+	}, {
+		Address:   fmt.Sprintf("ws://127.0.0.1:%d/dashboard", port),
+		Anonymous: true,
+		WebSocket: WebSocket{Paths: []string{"/dashboard"}},
+	}}
+	m, err := NewManager(cfg, handler)
+	assert.NoError(t, err)
+	defer m.Close()
+
+	pkt := mqtt.NewConnect()
+	pkt.ClientID = t.Name()
+	connect := func(path string, subprotocols []string, header http.Header) (*http.Response, error) {
+		dialer := websocket.Dialer{Subprotocols: subprotocols, EnableCompression: true}
+		c, resp, err := dialer.Dial(fmt.Sprintf("ws://127.0.0.1:%d%s", port, path), header)
+		if err != nil {
+			return resp, err
+		}
+		conn := transport.NewWebSocketConn(c)
+		defer conn.Close()
+		assert.NoError(t, conn.Send(pkt, false))
+		res, err := conn.Receive()
+		assert.NoError(t, err)
+		assert.Equal(t, pkt.String(), res.String())
+		return resp, nil
+	}
+
+	// the token is got from the header, query parameter or cookie
+	resp, err := connect("/mqtt", []string{"mqtt"}, http.Header{"Origin": {"https://a.example.com"}, "Authorization": {"Bearer t1"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "mqtt", resp.Header.Get("Sec-Websocket-Protocol"))
+	assert.Contains(t, resp.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate")
+	assert.Equal(t, common.ConnInfo{Address: cfg[0].Address, Token: "t1", RateLimit: cfg[0].RateLimit, MaxConnections: 100}, <-handler.infos)
+	_, err = connect("/mqtt2?token=t2", []string{"mqttv3.1"}, http.Header{"Origin": {"http://localhost:8080"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "t2", (<-handler.infos).Token)
+	_, err = connect("/mqtt", []string{"mqtt"}, http.Header{"Cookie": {"token=t3"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "t3", (<-handler.infos).Token)
+
+	// the subprotocol is required and the origin is not allowed
+	resp, err = connect("/mqtt", nil, nil)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, err = connect("/mqtt", []string{"mqtt"}, http.Header{"Origin": {"https://example.org"}})
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// the requests are routed by path
+	resp, err = connect("/dashboard", nil, http.Header{"Authorization": {"t4"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "", resp.Header.Get("Sec-Websocket-Extensions"))
+	assert.Equal(t, common.ConnInfo{Anonymous: true, Address: cfg[1].Address}, <-handler.infos)
+	resp, err = connect("/notexist", []string{"mqtt"}, nil)
+	assert.Error(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Len(t, handler.infos, 0)
+
+	_, err = NewManager([]Listener{
+		{Address: "ws://127.0.0.1:28768/a", WebSocket: WebSocket{Paths: []string{"/a"}}},
+		{Address: "ws://127.0.0.1:28768/b", WebSocket: WebSocket{Paths: []string{"/b", "/a"}}},
+	}, handler)
+	assert.EqualError(t, err, "path (/a) of the listener (ws://127.0.0.1:28768/b) is already served on the same port")
+	// the cookie token is refused if the origins are not restricted
+	_, err = NewManager([]Listener{
+		{Address: "ws://127.0.0.1:28768/a", WebSocket: WebSocket{Token: WebSocketToken{Cookie: "token"}}},
+	}, handler)
+	assert.EqualError(t, err, "origins of the listener (ws://127.0.0.1:28768/a) must be restricted if the token is got from cookie")
+	_, err = NewManager([]Listener{
+		{Address: "ws://127.0.0.1:28768/a", WebSocket: WebSocket{Origins: []string{"*"}, Token: WebSocketToken{Cookie: "token"}}},
+	}, handler)
+	assert.EqualError(t, err, "origins of the listener (ws://127.0.0.1:28768/a) must be restricted if the token is got from cookie")
+}
+
 func getURL(s mqtt.Server, protocol string) string {
 	return fmt.Sprintf("%s://%s", protocol, s.Addr().String())
 }
+
+type mockGatewayHandler struct {
+	mockHandler
+	infos chan common.ConnInfo
+}
+
+func (m *mockGatewayHandler) RegisterGRPC(svr *grpc.Server, info common.ConnInfo) {
+	healthpb.RegisterHealthServer(svr, health.NewServer())
+	m.infos <- info
+}
+
+func TestGRPC(t *testing.T) {
+	handler := &mockGatewayHandler{infos: make(chan common.ConnInfo, 10)}
+	cfg := []Listener{{
+		Address:              "grpc://127.0.0.1:0",
+		Anonymous:            true,
+		MaxConcurrentStreams: 10,
+		MaxMessageSize:       1024,
+	}}
+	m, err := NewManager(cfg, handler)
+	assert.NoError(t, err)
+	assert.Len(t, m.gateways, 1)
+	assert.Len(t, m.mqtts, 0)
+	assert.Equal(t, common.ConnInfo{Anonymous: true, Address: "grpc://127.0.0.1:0"}, <-handler.infos)
+
+	conn, err := grpc.Dial(m.gateways[0].Addr().String(), grpc.WithInsecure())
+	assert.NoError(t, err)
+	defer conn.Close()
+	res, err := healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, res.Status)
+
+	// the message exceeds the max size
+	_, err = healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{Service: strings.Repeat("a", 2048)})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	m.Close()
+	_, err = healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	// the handler does not support grpc
+	_, err = NewManager(cfg, newMockHandler(t))
+	assert.EqualError(t, err, "grpc is not supported by the handler of the listener (grpc://127.0.0.1:0)")
+
+	// the tls config is not set
+	_, err = NewManager([]Listener{{Address: "grpcs://127.0.0.1:0"}}, handler)
+	assert.EqualError(t, err, "tls config of the listener (grpcs://127.0.0.1:0) is not set")
+}
+
+func (m *mockGatewayHandler) NewHTTPHandler(info common.ConnInfo) http.Handler {
+	m.infos <- info
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		w.Write(data)
+	})
+}
+
+func TestHTTP(t *testing.T) {
+	handler := &mockGatewayHandler{infos: make(chan common.ConnInfo, 10)}
+	cfg := []Listener{{
+		Address:        "http://127.0.0.1:0",
+		MaxMessageSize: 4,
+	}}
+	m, err := NewManager(cfg, handler)
+	assert.NoError(t, err)
+	assert.Len(t, m.gateways, 1)
+	assert.Equal(t, common.ConnInfo{Address: "http://127.0.0.1:0"}, <-handler.infos)
+
+	url := fmt.Sprintf("http://%s/publish", m.gateways[0].Addr())
+	res, err := http.Post(url, "text/plain", strings.NewReader("hi"))
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, "hi", string(data))
+
+	// the body exceeds the max size
+	res, err = http.Post(url, "text/plain", strings.NewReader("hello"))
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode)
+
+	m.Close()
+	_, err = http.Post(url, "text/plain", strings.NewReader("hi"))
+	assert.Error(t, err)
+
+	// the handler does not support http
+	_, err = NewManager(cfg, newMockHandler(t))
+	assert.EqualError(t, err, "http is not supported by the handler of the listener (http://127.0.0.1:0)")
+
+	// the tls config is not set
+	_, err = NewManager([]Listener{{Address: "https://127.0.0.1:0"}}, handler)
+	assert.EqualError(t, err, "tls config of the listener (https://127.0.0.1:0) is not set")
+}
@@ -0,0 +1,241 @@
+package listener
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/baetyl/baetyl-go/v2/errors"
+	"github.com/baetyl/baetyl-go/v2/log"
+
+	"github.com/baetyl/baetyl-broker/v2/common"
+)
+
+// the signature of PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// the max length of PROXY protocol v1 header, including the CRLF
+const proxyV1MaxLength = 107
+
+// proxyListener accepts the connections from proxies, and parses the PROXY protocol v1/v2 headers
+// to get the real client addresses. The headers are parsed concurrently not to block accepting
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet // the upstreams permitted to send the header, empty means all
+	timeout time.Duration
+	conns   chan net.Conn
+	err     chan error
+	done    chan struct{}
+	once    sync.Once
+	log     *log.Logger
+}
+
+func newProxyListener(l net.Listener, cfg Listener) (*proxyListener, error) {
+	pl := &proxyListener{
+		Listener: l,
+		timeout:  cfg.ProxyHeaderTimeout,
+		conns:    make(chan net.Conn),
+		err:      make(chan error, 1),
+		done:     make(chan struct{}),
+		log:      log.With(log.Any("listener", cfg.Address)),
+	}
+	for _, v := range cfg.ProxyTrusted {
+		n, err := common.ParseIPNet(v)
+		if err != nil {
+			return nil, errors.Errorf("proxy trusted address (%s) is invalid", v)
+		}
+		pl.trusted = append(pl.trusted, n)
+	}
+	go pl.accepting()
+	return pl, nil
+}
+
+func (l *proxyListener) accepting() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.err <- err
+			return
+		}
+		go l.handshake(conn)
+	}
+}
+
+func (l *proxyListener) handshake(conn net.Conn) {
+	var c net.Conn = conn
+	if l.isTrusted(conn.RemoteAddr()) {
+		pc, err := readProxyHeader(conn, l.timeout)
+		if err != nil {
+			l.log.Warn("failed to read proxy protocol header", log.Any("remote", conn.RemoteAddr()), log.Error(err))
+			conn.Close()
+			return
+		}
+		c = pc
+	}
+	select {
+	case l.conns <- c:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+// isTrusted checks whether the upstream is permitted to send the header
+func (l *proxyListener) isTrusted(addr net.Addr) bool {
+	if len(l.trusted) == 0 {
+		return true
+	}
+	a, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range l.trusted {
+		if n.Contains(a.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Accept accepts the connection whose header is parsed
+func (l *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case err := <-l.err:
+		// keeps the error for the subsequent calls
+		l.err <- err
+		return nil, err
+	}
+}
+
+// Close closes the listener
+func (l *proxyListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+	return l.Listener.Close()
+}
+
+// proxyConn the connection whose remote address is got from the PROXY protocol header
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the address of the real client
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// readProxyHeader reads the PROXY protocol v1 or v2 header from the connection
+func readProxyHeader(conn net.Conn, timeout time.Duration) (*proxyConn, error) {
+	if timeout > 0 {
+		if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	c := &proxyConn{Conn: conn, r: bufio.NewReader(conn), remote: conn.RemoteAddr()}
+	sig, err := c.r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var remote net.Addr
+	if bytes.Equal(sig, proxyV2Signature) {
+		remote, err = readProxyHeaderV2(c.r)
+	} else if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		remote, err = readProxyHeaderV1(c.r)
+	} else {
+		err = errors.Errorf("proxy protocol header is missing")
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if remote != nil {
+		c.remote = remote
+	}
+	if timeout > 0 {
+		if err := conn.SetReadDeadline(time.Time{}); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	return c, nil
+}
+
+// readProxyHeaderV1 reads the header like "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n",
+// returns nil if the address is unknown
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.Errorf("proxy protocol v1 header is invalid")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.Errorf("proxy protocol v1 header is invalid")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, errors.Errorf("proxy protocol v1 header is invalid")
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyHeaderV2 reads the binary header, returns nil if the address is not carried
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, errors.Errorf("proxy protocol v2 header version (%d) is not supported", hdr[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, errors.Trace(err)
+	}
+	switch hdr[12] & 0x0F {
+	case 0x0: // LOCAL, the connection is established by the proxy itself
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, errors.Errorf("proxy protocol v2 header command (%d) is not supported", hdr[12]&0x0F)
+	}
+	switch hdr[13] >> 4 {
+	case 0x1: // AF_INET
+		if len(payload) < 12 {
+			return nil, errors.Errorf("proxy protocol v2 header is invalid")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x2: // AF_INET6
+		if len(payload) < 36 {
+			return nil, errors.Errorf("proxy protocol v2 header is invalid")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	default: // AF_UNSPEC or AF_UNIX
+		return nil, nil
+	}
+}
@@ -0,0 +1,311 @@
+package listener
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/baetyl/baetyl-go/v2/errors"
+	"github.com/baetyl/baetyl-go/v2/log"
+	"github.com/baetyl/baetyl-go/v2/mqtt"
+	"github.com/baetyl/baetyl-go/v2/utils"
+
+	"github.com/baetyl/baetyl-broker/v2/common"
+)
+
+// all client auth types of listener
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"none":               tls.NoClientCert,
+	"request":            tls.RequestClientCert,
+	"require-any":        tls.RequireAnyClientCert,
+	"verify-if-given":    tls.VerifyClientCertIfGiven,
+	"require-and-verify": tls.RequireAndVerifyClientCert,
+}
+
+// all tls versions of listener
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newTLSConfig creates the tls config of listener
+func newTLSConfig(c Listener) (*tls.Config, error) {
+	cert := c.Certificate
+	if cert.Key == "" && cert.Cert == "" && len(c.Certificates) > 0 {
+		// the first certificate of list is the default one if not set
+		cert.Key, cert.Cert = c.Certificates[0].Key, c.Certificates[0].Cert
+	}
+	cert.ClientAuthType = tls.VerifyClientCertIfGiven
+	if c.ClientAuth != "" {
+		t, ok := clientAuthTypes[c.ClientAuth]
+		if !ok {
+			return nil, errors.Errorf("client auth type (%s) is not supported", c.ClientAuth)
+		}
+		cert.ClientAuthType = t
+	}
+	tlsconfig, err := utils.NewTLSConfigServer(cert)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if c.MinVersion != "" {
+		v, ok := tlsVersions[c.MinVersion]
+		if !ok {
+			return nil, errors.Errorf("tls version (%s) is not supported", c.MinVersion)
+		}
+		tlsconfig.MinVersion = v
+	}
+	if len(c.CipherSuites) > 0 {
+		tlsconfig.CipherSuites, err = parseCipherSuites(c.CipherSuites)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	tlsconfig.NextProtos = c.ALPN
+	if len(c.Certificates) > 0 {
+		tlsconfig.GetCertificate, err = newSNICertificates(c.Certificates)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	return tlsconfig, nil
+}
+
+// newSNICertificates loads the certificates and returns the function to select certificate by server name,
+// the default certificate is used if no certificate is selected
+func newSNICertificates(cs []ServerCertificate) (func(*tls.ClientHelloInfo) (*tls.Certificate, error), error) {
+	certs := map[string]*tls.Certificate{}
+	for _, c := range cs {
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		for _, name := range c.ServerNames {
+			certs[strings.ToLower(name)] = &cert
+		}
+	}
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+		if cert, ok := certs[name]; ok {
+			return cert, nil
+		}
+		// try the wildcard server name, such as *.example.com
+		if i := strings.Index(name, "."); i > 0 {
+			if cert, ok := certs["*"+name[i:]]; ok {
+				return cert, nil
+			}
+		}
+		return nil, nil
+	}, nil
+}
+
+func parseCipherSuites(names []string) ([]uint16, error) {
+	suites := map[string]uint16{}
+	for _, s := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		suites[s.Name] = s.ID
+	}
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := suites[name]
+		if !ok {
+			return nil, errors.Errorf("cipher suite (%s) is not supported", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// tlsReloader reloads the tls config and CRL of listener when their files are modified
+type tlsReloader struct {
+	cfg     Listener
+	config  atomic.Value // *tls.Config
+	revoked atomic.Value // map[string]struct{}, the issuers and serial numbers of revoked certificates
+	mods    map[string]time.Time
+	log     *log.Logger
+}
+
+func newTLSReloader(c Listener) (*tlsReloader, error) {
+	r := &tlsReloader{
+		cfg:  c,
+		mods: map[string]time.Time{},
+		log:  log.With(log.Any("listener", c.Address)),
+	}
+	certMods, crlMods := r.modified(r.certFiles()...), r.modified(c.CRL)
+	err := r.reloadConfig()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	r.loaded(certMods)
+	err = r.reloadCRL()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	r.loaded(crlMods)
+	return r, nil
+}
+
+// tlsConfig returns the tls config of server which always uses the latest loaded config
+func (r *tlsReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.config.Load().(*tls.Config), nil
+		},
+	}
+}
+
+func (r *tlsReloader) certFiles() []string {
+	files := []string{r.cfg.CA, r.cfg.Key, r.cfg.Cert}
+	for _, c := range r.cfg.Certificates {
+		files = append(files, c.Key, c.Cert)
+	}
+	return files
+}
+
+// reload reloads the modified files, returns true if the CRL is reloaded,
+// the files failed to be reloaded are retried by the next reload
+func (r *tlsReloader) reload() (bool, error) {
+	if mods := r.modified(r.certFiles()...); len(mods) > 0 {
+		err := r.reloadConfig()
+		if err != nil {
+			return false, errors.Trace(err)
+		}
+		r.loaded(mods)
+		r.log.Info("certificates are reloaded")
+	}
+	if mods := r.modified(r.cfg.CRL); len(mods) > 0 {
+		err := r.reloadCRL()
+		if err != nil {
+			return false, errors.Trace(err)
+		}
+		r.loaded(mods)
+		r.log.Info("certificate revocation list is reloaded")
+		return true, nil
+	}
+	return false, nil
+}
+
+// modified returns the modification times of the files modified since they are loaded last
+func (r *tlsReloader) modified(files ...string) map[string]time.Time {
+	mods := map[string]time.Time{}
+	for _, file := range files {
+		if file == "" {
+			continue
+		}
+		fi, err := os.Stat(file)
+		if err != nil {
+			r.log.Warn("failed to stat file", log.Any("file", file), log.Error(err))
+			continue
+		}
+		if !fi.ModTime().Equal(r.mods[file]) {
+			mods[file] = fi.ModTime()
+		}
+	}
+	return mods
+}
+
+// loaded records the modification times of the files after they are loaded
+func (r *tlsReloader) loaded(mods map[string]time.Time) {
+	for file, mod := range mods {
+		r.mods[file] = mod
+	}
+}
+
+func (r *tlsReloader) reloadConfig() error {
+	tlsconfig, err := newTLSConfig(r.cfg)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	tlsconfig.VerifyPeerCertificate = r.verifyPeerCertificate
+	r.config.Store(tlsconfig)
+	return nil
+}
+
+func (r *tlsReloader) reloadCRL() error {
+	revoked := map[string]struct{}{}
+	if r.cfg.CRL != "" {
+		data, err := ioutil.ReadFile(r.cfg.CRL)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		crl, err := x509.ParseCRL(data)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		err = r.checkCRLSignature(crl)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		var issuer pkix.Name
+		issuer.FillFromRDNSequence(&crl.TBSCertList.Issuer)
+		for _, rc := range crl.TBSCertList.RevokedCertificates {
+			revoked[revokedKey(issuer, rc.SerialNumber)] = struct{}{}
+		}
+	}
+	r.revoked.Store(revoked)
+	return nil
+}
+
+// checkCRLSignature checks whether the CRL is signed by one of the CA certificates
+func (r *tlsReloader) checkCRLSignature(crl *pkix.CertificateList) error {
+	if r.cfg.CA == "" {
+		return errors.Errorf("ca is not set to verify the certificate revocation list")
+	}
+	data, err := ioutil.ReadFile(r.cfg.CA)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if ca.CheckCRLSignature(crl) == nil {
+			return nil
+		}
+	}
+	return errors.Errorf("certificate revocation list is not signed by the ca")
+}
+
+func (r *tlsReloader) verifyPeerCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if r.isRevoked(cert) {
+			return errors.Errorf("certificate (%s) is revoked", cert.Subject.CommonName)
+		}
+	}
+	return nil
+}
+
+func (r *tlsReloader) isRevoked(cert *x509.Certificate) bool {
+	revoked := r.revoked.Load().(map[string]struct{})
+	_, ok := revoked[revokedKey(cert.Issuer, cert.SerialNumber)]
+	return ok
+}
+
+// isConnRevoked checks whether the peer certificates of the connection are revoked
+func (r *tlsReloader) isConnRevoked(conn mqtt.Connection) bool {
+	for _, cert := range common.GetPeerCertificates(conn) {
+		if r.isRevoked(cert) {
+			return true
+		}
+	}
+	return false
+}
+
+func revokedKey(issuer pkix.Name, serial *big.Int) string {
+	return issuer.String() + "/" + serial.String()
+}
@@ -0,0 +1,131 @@
+package listener
+
+import (
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/256dpi/gomqtt/transport"
+	"github.com/baetyl/baetyl-go/v2/errors"
+	"github.com/baetyl/baetyl-go/v2/mqtt"
+)
+
+// launchUnix launches the server of the unix socket listener, the stale socket file is removed,
+// the socket file is created in a private directory, and renamed into place after its mode and owner are set,
+// so that it is never accessible with the permissions derived from umask
+func launchUnix(c Listener, path string) (mqtt.Server, error) {
+	if path == "" {
+		return nil, errors.Errorf("socket path of the listener (%s) is not set", c.Address)
+	}
+	uid, gid, err := lookupOwner(c.SocketOwner)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var mode os.FileMode
+	if c.SocketMode != "" {
+		v, err := strconv.ParseUint(c.SocketMode, 8, 32)
+		if err != nil || v > 0777 {
+			return nil, errors.Errorf("socket mode (%s) of the listener (%s) is invalid", c.SocketMode, c.Address)
+		}
+		mode = os.FileMode(v)
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		// only the socket file left by the previous process is removed
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, errors.Errorf("socket path (%s) of the listener (%s) is not a socket", path, c.Address)
+		}
+		if err = os.Remove(path); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, errors.Trace(err)
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(path), ".sock")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer os.RemoveAll(tmp)
+	tmpPath := filepath.Join(tmp, "s")
+	l, err := net.Listen("unix", tmpPath)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// the socket file is removed by unixListener after renamed
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	if c.SocketMode != "" {
+		if err = os.Chmod(tmpPath, mode); err != nil {
+			l.Close()
+			return nil, errors.Trace(err)
+		}
+	}
+	if uid != -1 || gid != -1 {
+		if err = os.Chown(tmpPath, uid, gid); err != nil {
+			l.Close()
+			return nil, errors.Trace(err)
+		}
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		l.Close()
+		return nil, errors.Trace(err)
+	}
+	return transport.NewNetServer(&unixListener{Listener: l, path: path}), nil
+}
+
+// unixListener removes the socket file when it is closed
+type unixListener struct {
+	net.Listener
+	path string
+}
+
+func (l *unixListener) Close() error {
+	err := l.Listener.Close()
+	if rerr := os.Remove(l.path); rerr != nil && !os.IsNotExist(rerr) && err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// lookupOwner looks up the uid and gid of the owner like "user:group", the user and group are names or ids,
+// returns -1 if not set
+func lookupOwner(owner string) (int, int, error) {
+	uid, gid := -1, -1
+	if owner == "" {
+		return uid, gid, nil
+	}
+	parts := strings.SplitN(owner, ":", 2)
+	if parts[0] != "" {
+		id := parts[0]
+		if _, err := strconv.Atoi(id); err != nil {
+			u, err := user.Lookup(id)
+			if err != nil {
+				return uid, gid, errors.Trace(err)
+			}
+			id = u.Uid
+		}
+		v, err := strconv.Atoi(id)
+		if err != nil {
+			return uid, gid, errors.Errorf("socket owner (%s) is invalid", owner)
+		}
+		uid = v
+	}
+	if len(parts) == 2 && parts[1] != "" {
+		id := parts[1]
+		if _, err := strconv.Atoi(id); err != nil {
+			g, err := user.LookupGroup(id)
+			if err != nil {
+				return uid, gid, errors.Trace(err)
+			}
+			id = g.Gid
+		}
+		v, err := strconv.Atoi(id)
+		if err != nil {
+			return uid, gid, errors.Errorf("socket owner (%s) is invalid", owner)
+		}
+		gid = v
+	}
+	return uid, gid, nil
+}
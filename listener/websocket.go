@@ -0,0 +1,262 @@
+package listener
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/256dpi/gomqtt/transport"
+	"github.com/baetyl/baetyl-go/v2/errors"
+	"github.com/baetyl/baetyl-go/v2/log"
+	"github.com/baetyl/baetyl-go/v2/mqtt"
+	"github.com/gorilla/websocket"
+)
+
+// the subprotocols of MQTT over websocket
+var wsSubprotocols = []string{"mqtt", "mqttv3.1"}
+
+// WebSocket the options of ws and wss listeners
+type WebSocket struct {
+	// the paths served by the listener, all paths are served if not set;
+	// the listeners with the same address except path share the port and the requests are routed by path
+	Paths               []string       `yaml:"paths" json:"paths"`
+	Origins             []string       `yaml:"origins" json:"origins"`                         // the allowed origins of browser requests, such as https://*.example.com, empty means all
+	SubprotocolRequired bool           `yaml:"subprotocolRequired" json:"subprotocolRequired"` // the request without subprotocol mqtt or mqttv3.1 is rejected
+	Compression         bool           `yaml:"compression" json:"compression"`                 // negotiates permessage-deflate compression
+	Token               WebSocketToken `yaml:"token" json:"token"`
+}
+
+// WebSocketToken the names of the header, query parameter and cookie to get the token from the websocket request in order,
+// the token is used as the password if the connect packet does not carry one
+type WebSocketToken struct {
+	Header string `yaml:"header" json:"header"` // the prefix "Bearer " is trimmed, such as Authorization
+	Query  string `yaml:"query" json:"query"`
+	Cookie string `yaml:"cookie" json:"cookie"` // the origins of the listener must be restricted if set
+}
+
+// wsServer the websocket server shared by the listeners on the same port, routes the requests by path
+type wsServer struct {
+	listener net.Listener
+	server   *http.Server
+	mux      *http.ServeMux
+	paths    map[string]struct{}
+	routes   int // the open routes, the server is closed when all routes are closed
+	mut      sync.Mutex
+}
+
+func newWSServer(l net.Listener) *wsServer {
+	s := &wsServer{
+		listener: l,
+		mux:      http.NewServeMux(),
+		paths:    map[string]struct{}{},
+	}
+	s.server = &http.Server{Handler: s.mux}
+	go s.server.Serve(l)
+	return s
+}
+
+// route adds the route of the listener
+func (s *wsServer) route(c Listener) (*wsRoute, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	paths := c.WebSocket.Paths
+	if len(paths) == 0 {
+		// serves all paths not routed to the other listeners
+		paths = []string{"/"}
+	}
+	for _, p := range paths {
+		if !strings.HasPrefix(p, "/") {
+			return nil, errors.Errorf("path (%s) of the listener (%s) is invalid", p, c.Address)
+		}
+		if _, ok := s.paths[p]; ok {
+			return nil, errors.Errorf("path (%s) of the listener (%s) is already served on the same port", p, c.Address)
+		}
+	}
+	r := &wsRoute{
+		cfg:      c,
+		server:   s,
+		incoming: make(chan wsConn),
+		done:     make(chan struct{}),
+		log:      log.With(log.Any("listener", c.Address)),
+	}
+	r.upgrader = &websocket.Upgrader{
+		HandshakeTimeout:  60 * time.Second,
+		Subprotocols:      wsSubprotocols,
+		CheckOrigin:       r.checkOrigin,
+		EnableCompression: c.WebSocket.Compression,
+	}
+	for _, p := range paths {
+		s.paths[p] = struct{}{}
+		s.mux.Handle(p, r)
+	}
+	s.routes++
+	return r, nil
+}
+
+func (s *wsServer) release() error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	s.routes--
+	if s.routes > 0 {
+		return nil
+	}
+	return s.server.Close()
+}
+
+type wsConn struct {
+	conn  *transport.WebSocketConn
+	token string
+}
+
+// wsRoute the server of a websocket listener, accepts the connections of the paths routed to it
+type wsRoute struct {
+	cfg      Listener
+	server   *wsServer
+	upgrader *websocket.Upgrader
+	incoming chan wsConn
+	done     chan struct{}
+	once     sync.Once
+	log      *log.Logger
+}
+
+func (r *wsRoute) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	select {
+	case <-r.done:
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	default:
+	}
+	if r.cfg.WebSocket.SubprotocolRequired && !hasSubprotocol(req) {
+		http.Error(w, "websocket subprotocol mqtt or mqttv3.1 is required", http.StatusBadRequest)
+		return
+	}
+	token := r.token(req)
+	c, err := r.upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		// the upgrader has responded to the request
+		r.log.Debug("failed to upgrade websocket", log.Any("remote", req.RemoteAddr), log.Error(err))
+		return
+	}
+	conn := transport.NewWebSocketConn(c)
+	select {
+	case r.incoming <- wsConn{conn: conn, token: token}:
+	case <-r.done:
+		conn.Close()
+	}
+}
+
+// checkOrigin checks the origin of browser request, the request without origin is not from browser
+func (r *wsRoute) checkOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" || len(r.cfg.WebSocket.Origins) == 0 {
+		return true
+	}
+	for _, o := range r.cfg.WebSocket.Origins {
+		if matchOrigin(o, origin) {
+			return true
+		}
+	}
+	r.log.Warn("websocket origin is not allowed", log.Any("origin", origin), log.Any("remote", req.RemoteAddr))
+	return false
+}
+
+// token gets the token from the header, query parameter or cookie of the request
+func (r *wsRoute) token(req *http.Request) string {
+	cfg := r.cfg.WebSocket.Token
+	if cfg.Header != "" {
+		if v := req.Header.Get(cfg.Header); v != "" {
+			if len(v) > 7 && strings.EqualFold(v[:7], "Bearer ") {
+				return v[7:]
+			}
+			return v
+		}
+	}
+	if cfg.Query != "" {
+		if v := req.URL.Query().Get(cfg.Query); v != "" {
+			return v
+		}
+	}
+	if cfg.Cookie != "" {
+		if c, err := req.Cookie(cfg.Cookie); err == nil && c.Value != "" {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+// accept accepts the connection and the token got from the request
+func (r *wsRoute) accept() (mqtt.Connection, string, error) {
+	select {
+	case c := <-r.incoming:
+		return c.conn, c.token, nil
+	case <-r.done:
+		return nil, "", io.EOF
+	}
+}
+
+// Accept accepts the connection
+func (r *wsRoute) Accept() (transport.Conn, error) {
+	conn, _, err := r.accept()
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Close closes the route, and the shared server if all routes are closed
+func (r *wsRoute) Close() error {
+	var err error
+	r.once.Do(func() {
+		close(r.done)
+		err = r.server.release()
+	})
+	return err
+}
+
+// Addr returns the address of the shared server
+func (r *wsRoute) Addr() net.Addr {
+	return r.server.listener.Addr()
+}
+
+func hasSubprotocol(req *http.Request) bool {
+	for _, p := range websocket.Subprotocols(req) {
+		for _, s := range wsSubprotocols {
+			if p == s {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// restrictsOrigin checks whether the origins don't allow all
+func restrictsOrigin(origins []string) bool {
+	if len(origins) == 0 {
+		return false
+	}
+	for _, o := range origins {
+		if o == "*" {
+			return false
+		}
+	}
+	return true
+}
+
+// matchOrigin matches the origin with the pattern, which supports the wildcard like https://*.example.com, or * for all
+func matchOrigin(pattern, origin string) bool {
+	if pattern == "*" {
+		return true
+	}
+	pattern, origin = strings.ToLower(pattern), strings.ToLower(origin)
+	if !strings.Contains(pattern, "*") {
+		return pattern == origin
+	}
+	ok, err := path.Match(pattern, origin)
+	return err == nil && ok
+}
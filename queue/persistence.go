@@ -2,6 +2,7 @@ package queue
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/baetyl/baetyl-go/v2/errors"
@@ -32,9 +33,11 @@ type Persistence struct {
 	counter         *counter
 	events          chan *common.Event
 	edel            chan uint64 // del events with message id
+	wakeup          chan struct{}
 	bucket          store.BatchBucket
+	acked           uint64 // the max acknowledged message id
 	recovering      bool
-	recoveredOffset uint64
+	recoveredOffset uint64 // messages whose id is less than it have been passed to out channel
 	disable         bool
 	log             *log.Logger
 	utils.Tomb
@@ -61,20 +64,32 @@ func NewPersistence(cfg Config, bucket store.BatchBucket) (Queue, error) {
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
+	minOffset, err := bucket.MinOffset()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
 	c := &counter{
 		offset: offset,
 	}
+	acked := offset
+	if minOffset > 0 {
+		acked = minOffset - 1
+	}
 
 	q := &Persistence{
 		id:         cfg.Name,
 		bucket:     bucket,
 		counter:    c,
+		acked:      acked,
 		recovering: true,
 		cfg:        cfg,
 		events:     make(chan *common.Event, cfg.BatchSize),
 		edel:       make(chan uint64, cfg.BatchSize),
+		wakeup:     make(chan struct{}, 1),
 		log:        log.With(log.Any("queue", "persistence"), log.Any("id", cfg.Name)),
 	}
+	// recovery from db at the beginning
+	q.wakeup <- struct{}{}
 
 	q.Go(q.deleting, q.recovery)
 	return q, nil
@@ -103,6 +118,19 @@ func (q *Persistence) Pop() (*common.Event, error) {
 	}
 }
 
+// Backlog returns the number of messages which are not acknowledged yet
+func (q *Persistence) Backlog() int {
+	q.counter.Lock()
+	offset := q.counter.offset
+	q.counter.Unlock()
+
+	acked := atomic.LoadUint64(&q.acked)
+	if offset < acked {
+		return 0
+	}
+	return int(offset - acked)
+}
+
 // Disable disable
 func (q *Persistence) Disable() {
 	q.Lock()
@@ -111,7 +139,21 @@ func (q *Persistence) Disable() {
 }
 
 // Push pushes a message into queue
-func (q *Persistence) Push(e *common.Event) (err error) {
+func (q *Persistence) Push(e *common.Event) error {
+	err := q.push(e)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	e.Done()
+	return nil
+}
+
+// push allocates the id and adds the message under the lock, so that the recovery
+// never starts above the id of a message which is added but not passed to out channel yet
+func (q *Persistence) push(e *common.Event) error {
+	q.Lock()
+	defer q.Unlock()
+
 	// need to reset msg context id
 	ee := common.NewEvent(&mqtt.Message{
 		Context: mqtt.Context{
@@ -124,55 +166,81 @@ func (q *Persistence) Push(e *common.Event) (err error) {
 		Content: e.Content,
 	}, 1, q.acknowledge)
 
-	err = q.add(ee)
+	err := q.add(ee)
 	if err != nil {
 		return errors.Trace(err)
 	}
-	e.Done()
 
-	q.Lock()
 	if q.recovering || q.disable || ee.Context.ID < q.recoveredOffset {
 		// if in recovery mode, send the msg to db, and do not pass to out channel
 		// otherwise send to the db and pass to out channel
-		q.Unlock()
 		return nil
 	}
-	q.Unlock()
 
+	// never block the publisher if the out channel is full, the message is already in db
 	select {
 	case q.events <- ee:
 		if ent := q.log.Check(log.DebugLevel, "queue pushed a message"); ent != nil {
 			ent.Write(log.Any("message", ee.String()))
 		}
-		return nil
-	case <-q.Dying():
-		return ErrQueueClosed
+	default:
+		q.log.Debug("queue is full, switches to recovery mode", log.Any("offset", ee.Context.ID))
+		q.recovering = true
+		q.recoveredOffset = ee.Context.ID
+		select {
+		case q.wakeup <- struct{}{}:
+		default:
+		}
 	}
+	return nil
 }
 
-// recovery from db
+// recovery reads messages from db when woken up
 func (q *Persistence) recovery() error {
-	q.log.Info("queue starts to recovery msgs from db in batch mode")
-	defer utils.Trace(q.log.Info, "queue has finished reading messages from db in batch mode")()
+	for {
+		select {
+		case <-q.wakeup:
+			if err := q.recover(); err != nil {
+				q.log.Error("failed to recover messages from db", log.Error(err))
+				return errors.Trace(err)
+			}
+		case <-q.Dying():
+			return nil
+		}
+	}
+}
+
+// recover reads messages from db in batch mode until all messages are passed to out channel
+func (q *Persistence) recover() error {
+	q.log.Debug("queue starts to recovery msgs from db in batch mode")
+	defer utils.Trace(q.log.Debug, "queue has finished reading messages from db in batch mode")()
 
-	var err error
-	var buf []*common.Event
-	length, offset, max := 0, uint64(1), cap(q.events)
+	q.Lock()
+	offset := q.recoveredOffset
+	q.Unlock()
 
+	max := cap(q.events)
 	for {
-		q.Lock()
-		buf, err = q.get(offset, max)
+		buf, err := q.get(offset, max)
 		if err != nil {
 			return errors.Trace(err)
 		}
-		length = len(buf)
-		if length == 0 {
-			q.recovering = false
-			q.recoveredOffset = offset
+		if len(buf) == 0 {
+			// check again with lock, the message may be added after the last reading
+			q.Lock()
+			buf, err = q.get(offset, max)
+			if err != nil {
+				q.Unlock()
+				return errors.Trace(err)
+			}
+			if len(buf) == 0 {
+				q.recovering = false
+				q.recoveredOffset = offset
+				q.Unlock()
+				return nil
+			}
 			q.Unlock()
-			return nil
 		}
-		q.Unlock()
 		for _, e := range buf {
 			select {
 			case q.events <- e:
@@ -184,7 +252,7 @@ func (q *Persistence) recovery() error {
 			}
 		}
 		// set next message id
-		offset = buf[length-1].Context.ID + 1
+		offset = buf[len(buf)-1].Context.ID + 1
 	}
 }
 
@@ -298,11 +366,36 @@ func (q *Persistence) clean() {
 	err := q.bucket.DelBeforeTS(uint64(time.Now().Add(-q.cfg.ExpireTime).Unix()))
 	if err != nil {
 		q.log.Error("failed to clean expired messages from db", log.Error(err))
+		return
+	}
+	// expired messages are treated as acknowledged
+	q.counter.Lock()
+	offset := q.counter.offset
+	q.counter.Unlock()
+	min, err := q.bucket.MinOffset()
+	if err != nil {
+		q.log.Error("failed to get min offset from db", log.Error(err))
+		return
+	}
+	if min > 0 {
+		q.setAcked(min - 1)
+	} else {
+		q.setAcked(offset)
+	}
+}
+
+func (q *Persistence) setAcked(id uint64) {
+	for {
+		acked := atomic.LoadUint64(&q.acked)
+		if id <= acked || atomic.CompareAndSwapUint64(&q.acked, acked, id) {
+			return
+		}
 	}
 }
 
 // acknowledge all acknowledged message from db in batch mode
 func (q *Persistence) acknowledge(id uint64) {
+	q.setAcked(id)
 	select {
 	case q.edel <- id:
 	case <-q.Dying():
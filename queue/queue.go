@@ -15,6 +15,7 @@ type Queue interface {
 	Push(*common.Event) error
 	Pop() (*common.Event, error)
 	Chan() <-chan *common.Event
+	Backlog() int
 	Disable()
 	Close(bool) error
 }
@@ -181,6 +181,88 @@ func TestPersistentQueue(t *testing.T) {
 	//assert.NoError(t, err)
 }
 
+func TestPersistentQueueNonBlocking(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := store.New(store.Conf{Driver: "pebble", Path: path.Join(dir, t.Name())})
+	assert.NoError(t, err)
+	assert.NotNil(t, db)
+
+	bucket, err := db.NewBatchBucket(t.Name())
+	assert.NoError(t, err)
+	assert.NotNil(t, bucket)
+
+	var cfg Config
+	utils.SetDefaults(&cfg)
+	cfg.Name = t.Name()
+	cfg.BatchSize = 2
+
+	b, err := NewPersistence(cfg, bucket)
+	assert.NoError(t, err)
+	assert.NotNil(t, b)
+	defer b.Close(true)
+
+	// the out channel is full, but pushing is never blocked
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			assert.NoError(t, b.Push(newMockEvent(uint64(i))))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		assert.FailNow(t, "push is blocked")
+	}
+	assert.Equal(t, 10, b.Backlog())
+
+	var es []*common.Event
+	for i := 1; i <= 10; i++ {
+		e, err := b.Pop()
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(i), e.Context.ID)
+		es = append(es, e)
+	}
+	for _, e := range es {
+		e.Done()
+	}
+	assert.Equal(t, 0, b.Backlog())
+
+	// messages are passed to out channel directly after recovery
+	assert.NoError(t, b.Push(newMockEvent(11)))
+	e, err := b.Pop()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(11), e.Context.ID)
+	e.Done()
+
+	// no message pushed concurrently is left in db when the out channel is full
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				assert.NoError(t, b.Push(newMockEvent(uint64(j))))
+			}
+		}()
+	}
+	ids := map[uint64]bool{}
+	for len(ids) < 500 {
+		select {
+		case e := <-b.Chan():
+			ids[e.Context.ID] = true
+			e.Done()
+		case <-time.After(time.Second * 5):
+			assert.FailNow(t, "messages are lost", "%d messages are received", len(ids))
+		}
+	}
+	wg.Wait()
+	assert.Equal(t, 0, b.Backlog())
+}
+
 func BenchmarkPersistentQueue(b *testing.B) {
 	dir, err := ioutil.TempDir("", b.Name())
 	assert.NoError(b, err)
@@ -53,6 +53,11 @@ func (q *Temporary) Pop() (*common.Event, error) {
 	}
 }
 
+// Backlog returns the number of messages in queue
+func (q *Temporary) Backlog() int {
+	return len(q.events)
+}
+
 // Disable disable
 func (q *Temporary) Disable() {}
 
@@ -0,0 +1,108 @@
+package session
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/baetyl/baetyl-broker/v2/common"
+)
+
+// admission limits the connections per listener, IP and username, and the rate of accepting connections
+type admission struct {
+	cfg    Admission
+	accept *bucket
+	counts map[string]int // the connections of listeners, IPs and usernames
+	mut    sync.Mutex
+}
+
+func newAdmission(cfg Admission) *admission {
+	a := &admission{
+		cfg:    cfg,
+		counts: map[string]int{},
+	}
+	if cfg.AcceptRate > 0 {
+		a.accept = newBucket(cfg.AcceptRate, float64(cfg.AcceptBurst))
+	}
+	return a
+}
+
+// admit admits the connection accepted by the listener from the IP,
+// returns the keys of the slots taken, which are released when the connection is closed
+func (a *admission) admit(ip net.IP, listener common.ConnInfo) ([]string, error) {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+
+	if a.accept != nil {
+		a.accept.refill(time.Now())
+		if a.accept.wait(1) > 0 {
+			return nil, ErrSessionConnectionRateExceedsLimit
+		}
+	}
+	var keys []string
+	if max := listener.MaxConnections; max > 0 {
+		key := "listener/" + listener.Address
+		if a.counts[key] >= max {
+			return nil, ErrSessionListenerConnectionsExceedLimit
+		}
+		keys = append(keys, key)
+	}
+	if max := a.cfg.MaxConnectionsPerIP; max > 0 && ip != nil {
+		key := BanIP + "/" + ip.String()
+		if a.counts[key] >= max {
+			return nil, ErrSessionIPConnectionsExceedLimit
+		}
+		keys = append(keys, key)
+	}
+	if a.accept != nil {
+		a.accept.take(1)
+	}
+	a.take(keys)
+	return keys, nil
+}
+
+// admitUsername admits the connection of the authenticated username,
+// the replacing connection does not count if it replaces a connection of the same username
+func (a *admission) admitUsername(username string, replacing bool) (string, error) {
+	max := a.cfg.MaxConnectionsPerUsername
+	if max <= 0 || username == "" {
+		return "", nil
+	}
+
+	a.mut.Lock()
+	defer a.mut.Unlock()
+
+	key := BanUsername + "/" + username
+	if replacing {
+		max++
+	}
+	if a.counts[key] >= max {
+		return "", ErrSessionUsernameConnectionsExceedLimit
+	}
+	a.take([]string{key})
+	return key, nil
+}
+
+func (a *admission) take(keys []string) {
+	for _, key := range keys {
+		a.counts[key]++
+	}
+}
+
+// release releases the slots taken by the connection
+func (a *admission) release(keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+
+	a.mut.Lock()
+	defer a.mut.Unlock()
+
+	for _, key := range keys {
+		if a.counts[key] <= 1 {
+			delete(a.counts, key)
+		} else {
+			a.counts[key]--
+		}
+	}
+}
@@ -1,23 +1,46 @@
 package session
 
 import (
-	"reflect"
+	"regexp"
 	"strings"
 
 	"github.com/baetyl/baetyl-go/v2/errors"
 	"github.com/baetyl/baetyl-go/v2/mqtt"
+	"github.com/baetyl/baetyl-go/v2/utils"
 	"gopkg.in/validator.v2"
 )
 
 // all permit actions
 const (
-	Publish   = "pub"
-	Subscribe = "sub"
+	Publish          = "pub"
+	Subscribe        = "sub"
+	PublishSubscribe = "pubsub" // the shorthand of pub and sub
 )
 
+// all effects of permission
+const (
+	Allow = "allow"
+	Deny  = "deny"
+)
+
+// all precedences of permissions
+const (
+	MostSpecific = "most-specific" // the permission with the most specific topic wins, deny wins if equally specific
+	FirstMatch   = "first-match"   // the first matched permission in order wins
+)
+
+// all variables of permit, resolved per connection
+const (
+	VariableClientID = "${clientid}"
+	VariableUsername = "${username}"
+)
+
+var permitVariable = regexp.MustCompile(`\$\{[^}]*\}`)
+
 // Permission Permission
 type Permission struct {
-	Action  string   `yaml:"action" json:"action" validate:"regexp=^(p|s)ub$"`
+	Action  string   `yaml:"action" json:"action" validate:"regexp=^(pub|sub|pubsub)$"`
+	Effect  string   `yaml:"effect" json:"effect" validate:"regexp=^(allow|deny)?$"` // allow (default) or deny
 	Permits []string `yaml:"permit,flow" json:"permit,flow"`
 }
 
@@ -25,7 +48,97 @@ type Permission struct {
 type Principal struct {
 	Username    string       `yaml:"username" json:"username"`
 	Password    string       `yaml:"password" json:"password"`
+	Precedence  string       `yaml:"precedence" json:"precedence" validate:"regexp=^(most-specific|first-match)?$"` // most-specific (default) or first-match
 	Permissions []Permission `yaml:"permissions" json:"permissions"`
+	Limits      *Limits      `yaml:"limits,omitempty" json:"limits,omitempty"` // overrides the global limits of messages
+	Admin       bool         `yaml:"admin" json:"admin"`                       // the admin can manage the sessions of others and without owner by the grpc service
+	// the peer credentials of the clients connected to unix socket listeners without password,
+	// the principal matches if both the set uid and gid match
+	UID *uint32 `yaml:"uid,omitempty" json:"uid,omitempty"`
+	GID *uint32 `yaml:"gid,omitempty" json:"gid,omitempty"`
+}
+
+// Limits the limits of messages published by the principal
+type Limits struct {
+	MessageLimits `yaml:",inline" json:",inline"`
+	Topics        []TopicLimits `yaml:"topics,omitempty" json:"topics,omitempty"` // the first matched topic filter overrides the limits
+}
+
+// TopicLimits the limits of messages published to the topic filter
+type TopicLimits struct {
+	Topic         string `yaml:"topic" json:"topic"`
+	MessageLimits `yaml:",inline" json:",inline"`
+}
+
+// MessageLimits the limits of messages, the unset ones are not overridden
+type MessageLimits struct {
+	MaxMessagePayloadSize utils.Size `yaml:"maxMessagePayloadSize,omitempty" json:"maxMessagePayloadSize,omitempty"`
+	MaxQOS                *int       `yaml:"maxQOS,omitempty" json:"maxQOS,omitempty"`
+	Retain                *bool      `yaml:"retain,omitempty" json:"retain,omitempty"` // whether retained messages are permitted
+	Will                  *bool      `yaml:"will,omitempty" json:"will,omitempty"`     // whether will message is permitted
+}
+
+// messageLimits the limits resolved for the message
+type messageLimits struct {
+	maxPayloadSize int
+	maxQOS         mqtt.QOS
+	retain         bool
+	will           bool
+}
+
+func (l MessageLimits) apply(res *messageLimits) {
+	if l.MaxMessagePayloadSize > 0 {
+		res.maxPayloadSize = int(l.MaxMessagePayloadSize)
+	}
+	if l.MaxQOS != nil {
+		res.maxQOS = mqtt.QOS(*l.MaxQOS)
+	}
+	if l.Retain != nil {
+		res.retain = *l.Retain
+	}
+	if l.Will != nil {
+		res.will = *l.Will
+	}
+}
+
+// resolve resolves the limits of the message published to the topic based on the global limits
+func (l *Limits) resolve(global messageLimits, topic string) messageLimits {
+	res := global
+	if l == nil {
+		return res
+	}
+	l.MessageLimits.apply(&res)
+	for _, t := range l.Topics {
+		if matchTopic(t.Topic, topic) {
+			t.MessageLimits.apply(&res)
+			break
+		}
+	}
+	return res
+}
+
+// matchTopic checks whether the topic matches the topic filter
+func matchTopic(filter, topic string) bool {
+	fs := strings.Split(filter, "/")
+	ts := strings.Split(topic, "/")
+	for i, f := range fs {
+		if f == "#" {
+			return true
+		}
+		if i >= len(ts) || (f != "+" && f != ts[i]) {
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
+
+// NewAnonymousAuthorizer creates the authorizer of the clients connected to anonymous listeners,
+// returns nil to permit all topics if the anonymous principal is not set
+func NewAnonymousAuthorizer(principal *Principal) *Authorizer {
+	if principal == nil {
+		return nil
+	}
+	return newAuthorizer(principal.Permissions, principal.Precedence)
 }
 
 // Authenticator authenticator
@@ -34,6 +147,8 @@ type Authenticator struct {
 	accounts map[string]account
 	// for client certificates
 	certificates map[string]certificate
+	// for peer credentials of unix socket, in order
+	peers []peer
 }
 
 // NewAuthenticator creates a new Authenticator
@@ -43,11 +158,18 @@ func NewAuthenticator(principals []Principal) *Authenticator {
 	}
 	_accounts := make(map[string]account)
 	_certificates := make(map[string]certificate)
+	var _peers []peer
 	for _, principal := range principals {
-		authorizer := NewAuthorizer()
-		for _, p := range duplicatePubSubPermitRemove(principal.Permissions) {
-			for _, topic := range p.Permits {
-				authorizer.Add(topic, p.Action)
+		authorizer := newAuthorizer(principal.Permissions, principal.Precedence)
+		if principal.UID != nil || principal.GID != nil {
+			_peers = append(_peers, peer{
+				uid:        principal.UID,
+				gid:        principal.GID,
+				username:   principal.Username,
+				Authorizer: authorizer,
+			})
+			if principal.Password == "" {
+				continue
 			}
 		}
 		if principal.Password == "" {
@@ -61,28 +183,7 @@ func NewAuthenticator(principals []Principal) *Authenticator {
 			}
 		}
 	}
-	return &Authenticator{certificates: _certificates, accounts: _accounts}
-}
-
-func duplicatePubSubPermitRemove(permission []Permission) []Permission {
-	PubPermitList := make(map[string]struct{})
-	SubPermitList := make(map[string]struct{})
-	for _, _permission := range permission {
-		switch _permission.Action {
-		case Publish:
-			for _, v := range _permission.Permits {
-				PubPermitList[v] = struct{}{}
-			}
-		case Subscribe:
-			for _, v := range _permission.Permits {
-				SubPermitList[v] = struct{}{}
-			}
-		}
-	}
-	return []Permission{
-		{Action: Publish, Permits: getKeys(PubPermitList)},
-		{Action: Subscribe, Permits: getKeys(SubPermitList)},
-	}
+	return &Authenticator{certificates: _certificates, accounts: _accounts, peers: _peers}
 }
 
 // AuthenticateAccount authenticates client account, then return authorizer if pass
@@ -109,6 +210,17 @@ func (a *Authenticator) AuthenticateCertificate(commonName string) *Authorizer {
 	return nil
 }
 
+// AuthenticatePeer authenticates the peer credentials of unix socket, then return the username and authorizer
+// of the first matched principal if pass
+func (a *Authenticator) AuthenticatePeer(uid, gid uint32) (string, *Authorizer) {
+	for _, p := range a.peers {
+		if (p.uid == nil || *p.uid == uid) && (p.gid == nil || *p.gid == gid) {
+			return p.username, p.Authorizer
+		}
+	}
+	return "", nil
+}
+
 type account struct {
 	Password   string
 	Authorizer *Authorizer
@@ -118,9 +230,50 @@ type certificate struct {
 	Authorizer *Authorizer
 }
 
+type peer struct {
+	uid        *uint32
+	gid        *uint32
+	username   string
+	Authorizer *Authorizer
+}
+
+// rule is a permit of permission with single action
+type rule struct {
+	action string
+	topic  string
+	deny   bool
+	index  int // the order of rule in permissions
+}
+
+// newRules expands the permissions to rules in order, the duplicate rules are removed
+func newRules(permissions []Permission) []*rule {
+	var rules []*rule
+	added := map[rule]struct{}{}
+	for _, p := range permissions {
+		actions := []string{p.Action}
+		if p.Action == PublishSubscribe {
+			actions = []string{Publish, Subscribe}
+		}
+		for _, topic := range p.Permits {
+			for _, action := range actions {
+				r := rule{action: action, topic: topic, deny: p.Effect == Deny}
+				if _, ok := added[r]; ok {
+					continue
+				}
+				added[r] = struct{}{}
+				r.index = len(rules)
+				rules = append(rules, &r)
+			}
+		}
+	}
+	return rules
+}
+
 // Authorizer checks topic permission
 type Authorizer struct {
 	*mqtt.Trie
+	firstMatch bool
+	templates  []*rule // all rules if any permit has variables
 }
 
 // NewAuthorizer create a new authorizer
@@ -128,29 +281,125 @@ func NewAuthorizer() *Authorizer {
 	return &Authorizer{Trie: mqtt.NewTrie()}
 }
 
-// Authorize auth action
+// newAuthorizer creates the authorizer of permissions with the precedence
+func newAuthorizer(permissions []Permission, precedence string) *Authorizer {
+	authorizer := NewAuthorizer()
+	authorizer.firstMatch = precedence == FirstMatch
+	rules := newRules(permissions)
+	for _, r := range rules {
+		if permitVariable.MatchString(r.topic) {
+			// the permit with variables is added when authorizer is resolved for a connection
+			authorizer.templates = rules
+			continue
+		}
+		authorizer.add(r)
+	}
+	return authorizer
+}
+
+func (p *Authorizer) add(r *rule) {
+	p.Add(r.topic, r)
+}
+
+// Resolve creates the authorizer for the connection by substituting the variables of permits,
+// the allowed permit is ignored if the value of its variable is empty or contains '+', '#' or '/',
+// and the variable of denied permit is replaced by '+' in this case to still take effect
+func (p *Authorizer) Resolve(clientID, username string) *Authorizer {
+	if len(p.templates) == 0 {
+		return p
+	}
+	values := map[string]string{
+		VariableClientID: clientID,
+		VariableUsername: username,
+	}
+	res := NewAuthorizer()
+	res.firstMatch = p.firstMatch
+	for _, r := range p.templates {
+		topic, ok := resolvePermit(r.topic, values)
+		if !ok {
+			if !r.deny {
+				continue
+			}
+			topic = permitVariable.ReplaceAllString(r.topic, "+")
+		}
+		_r := *r
+		_r.topic = topic
+		res.add(&_r)
+	}
+	return res
+}
+
+// Authorize auth action, the subscription with wildcards is allowed even if it covers any denied topic,
+// since the message of the denied topic is checked and dropped when it is sent to the subscriber
 func (p *Authorizer) Authorize(action, topic string) bool {
-	_actions := p.Match(topic)
-	for _, _action := range _actions {
-		if action == _action.(string) {
-			return true
+	var res *rule
+	for _, v := range p.Match(topic) {
+		r := v.(*rule)
+		if r.action != action {
+			continue
+		}
+		if res == nil || p.precedes(r, res) {
+			res = r
+		}
+	}
+	return res != nil && !res.deny
+}
+
+// precedes checks whether rule a takes precedence over rule b
+func (p *Authorizer) precedes(a, b *rule) bool {
+	if p.firstMatch {
+		return a.index < b.index
+	}
+	if moreSpecific(a.topic, b.topic) {
+		return true
+	}
+	if moreSpecific(b.topic, a.topic) {
+		return false
+	}
+	return a.deny && !b.deny
+}
+
+// moreSpecific checks whether the topic a is more specific than the topic b if both match the same topic,
+// the levels are compared from left to right, a name is more specific than '+', and '+' is more specific than '#'
+func moreSpecific(a, b string) bool {
+	as, bs := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if x, y := levelRank(as[i]), levelRank(bs[i]); x != y {
+			return x > y
 		}
 	}
-	return false
+	// the longer one ends with '#' matching zero level
+	return len(as) < len(bs)
 }
 
-// getKeys gets all keys of map
-func getKeys(m map[string]struct{}) []string {
-	keys := reflect.ValueOf(m).MapKeys()
-	result := make([]string, 0)
-	for _, key := range keys {
-		result = append(result, key.Interface().(string))
+func levelRank(level string) int {
+	switch level {
+	case "#":
+		return 0
+	case "+":
+		return 1
+	default:
+		return 2
 	}
-	return result
+}
+
+// resolvePermit substitutes the variables of permit, returns false if any value is invalid
+func resolvePermit(permit string, values map[string]string) (string, bool) {
+	ok := true
+	topic := permitVariable.ReplaceAllStringFunc(permit, func(v string) string {
+		value := values[v]
+		// prevents the value from injecting wildcards or topic levels
+		if value == "" || strings.ContainsAny(value, "+#/") {
+			ok = false
+		}
+		return value
+	})
+	return topic, ok
 }
 
 func init() {
 	validator.SetValidationFunc("principals", principalsValidate)
+	validator.SetValidationFunc("anonymous", anonymousValidate)
 }
 
 // principalsValidate validate principals config is valid or not
@@ -167,12 +416,71 @@ func principalsValidate(v interface{}, param string) error {
 		return err
 	}
 	for _, principal := range principals {
-		for _, permission := range principal.Permissions {
-			for _, permit := range permission.Permits {
-				if !mqtt.CheckTopic(permit, true) {
-					return errors.Errorf("%s topic(%s) invalid", permission.Action, permit)
+		err = principalValidate(principal)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// anonymousValidate validate anonymous principal config is valid or not
+func anonymousValidate(v interface{}, param string) error {
+	principal, ok := v.(*Principal)
+	if !ok || principal == nil {
+		return nil
+	}
+	return principalValidate(*principal)
+}
+
+// principalValidate validate the precedence and permissions of principal
+func principalValidate(principal Principal) error {
+	if principal.Precedence != "" && principal.Precedence != MostSpecific && principal.Precedence != FirstMatch {
+		return errors.Errorf("username (%s) precedence (%s) is not supported", principal.Username, principal.Precedence)
+	}
+	if err := limitsValidate(principal); err != nil {
+		return err
+	}
+	for _, permission := range principal.Permissions {
+		switch permission.Action {
+		case Publish, Subscribe, PublishSubscribe:
+		default:
+			return errors.Errorf("username (%s) action (%s) is not supported", principal.Username, permission.Action)
+		}
+		if permission.Effect != "" && permission.Effect != Allow && permission.Effect != Deny {
+			return errors.Errorf("username (%s) effect (%s) is not supported", principal.Username, permission.Effect)
+		}
+		for _, permit := range permission.Permits {
+			for _, v := range permitVariable.FindAllString(permit, -1) {
+				if v != VariableClientID && v != VariableUsername {
+					return errors.Errorf("%s topic(%s) variable (%s) is not supported", permission.Action, permit, v)
 				}
 			}
+			if !mqtt.CheckTopic(permitVariable.ReplaceAllString(permit, "x"), true) {
+				return errors.Errorf("%s topic(%s) invalid", permission.Action, permit)
+			}
+		}
+	}
+	return nil
+}
+
+func limitsValidate(principal Principal) error {
+	if principal.Limits == nil {
+		return nil
+	}
+	limits := []MessageLimits{principal.Limits.MessageLimits}
+	for _, t := range principal.Limits.Topics {
+		if !mqtt.CheckTopic(t.Topic, true) {
+			return errors.Errorf("username (%s) limits topic (%s) invalid", principal.Username, t.Topic)
+		}
+		limits = append(limits, t.MessageLimits)
+	}
+	for _, l := range limits {
+		if l.MaxQOS != nil && *l.MaxQOS != 0 && *l.MaxQOS != 1 {
+			return errors.Errorf("username (%s) limits max QoS (%d) is not supported", principal.Username, *l.MaxQOS)
+		}
+		if l.MaxMessagePayloadSize < 0 || l.MaxMessagePayloadSize > 268435455 {
+			return errors.Errorf("username (%s) limits max message payload size (%d) invalid", principal.Username, l.MaxMessagePayloadSize)
 		}
 	}
 	return nil
@@ -1,7 +1,11 @@
 package session
 
 import (
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"fmt"
+	"math/big"
+	"net/url"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -382,15 +386,14 @@ func TestAuth(t *testing.T) {
 }
 
 func getPubSubPermits(permissions []Permission) ([]string, []string) {
-	permissions = duplicatePubSubPermitRemove(permissions)
 	pubPermits := make([]string, 0)
 	subPermits := make([]string, 0)
-	for _, permission := range permissions {
-		switch permission.Action {
+	for _, r := range newRules(permissions) {
+		switch r.action {
 		case Publish:
-			pubPermits = permission.Permits
+			pubPermits = append(pubPermits, r.topic)
 		case Subscribe:
-			subPermits = permission.Permits
+			subPermits = append(subPermits, r.topic)
 		}
 	}
 	return pubPermits, subPermits
@@ -461,4 +464,233 @@ func TestPrincipalsValidate(t *testing.T) {
 	err = principalsValidate(principals, "")
 	assert.NotNil(t, err)
 	assert.Equal(t, fmt.Sprintf("sub topic(test/#/temp) invalid"), err.Error())
+
+	// round 5: invalid limits validate
+	qos := 2
+	principals = principals[:len(principals)-1]
+	principals = append(principals, Principal{
+		Username: "hello",
+		Password: "hello",
+		Limits:   &Limits{Topics: []TopicLimits{{Topic: "test", MessageLimits: MessageLimits{MaxQOS: &qos}}}},
+	})
+	err = principalsValidate(principals, "")
+	assert.NotNil(t, err)
+	assert.Equal(t, "username (hello) limits max QoS (2) is not supported", err.Error())
+	principals[len(principals)-1].Limits = &Limits{Topics: []TopicLimits{{Topic: "test/#/temp"}}}
+	err = principalsValidate(principals, "")
+	assert.NotNil(t, err)
+	assert.Equal(t, "username (hello) limits topic (test/#/temp) invalid", err.Error())
+}
+
+func TestCertIdentity(t *testing.T) {
+	uri, err := url.Parse("spiffe://example.org/device/d1")
+	assert.NoError(t, err)
+	cert := &x509.Certificate{
+		Raw:          []byte("raw"),
+		SerialNumber: big.NewInt(10),
+		Subject: pkix.Name{
+			CommonName:         "client",
+			Organization:       []string{"baetyl"},
+			OrganizationalUnit: []string{"device"},
+		},
+		DNSNames:       []string{"d1.example.org"},
+		EmailAddresses: []string{"d1@example.org"},
+		URIs:           []*url.URL{uri},
+	}
+
+	tests := []struct {
+		tpl      string
+		identity string
+		ok       bool
+	}{
+		{"", "client", true},
+		{"${cn}", "client", true},
+		{"${san.dns}", "d1.example.org", true},
+		{"${san.uri}", "spiffe://example.org/device/d1", true},
+		{"${san.email}", "d1@example.org", true},
+		{"${subject.o}-${subject.ou}-${cn}", "baetyl-device-client", true},
+		{"${serial}", "10", true},
+		{"${fingerprint}", "d7439bee24773bcbfa2d0a97947ee36227b10d1022b1a55847e928965bb6bfde", true},
+		{"${subject.c}", "", false},
+		{"${unknown}", "", false},
+	}
+	for _, tt := range tests {
+		identity, ok := getCertIdentity(tt.tpl, cert)
+		assert.Equal(t, tt.ok, ok, tt.tpl)
+		if tt.ok {
+			assert.Equal(t, tt.identity, identity, tt.tpl)
+		}
+	}
+
+	assert.NoError(t, checkCertIdentityTemplate("device-${subject.ou}/${cn}"))
+	assert.EqualError(t, checkCertIdentityTemplate("${cn}${unknown}"), "certificate identity variable (${unknown}) is not supported")
+}
+
+func TestAuthVariables(t *testing.T) {
+	principals := []Principal{{
+		Username: "test",
+		Password: "hahaha",
+		Permissions: []Permission{
+			{Action: "pub", Permits: []string{"public", "devices/${clientid}/#", "users/${username}/+/cmd"}},
+			{Action: "sub", Permits: []string{"devices/${clientid}-${username}/+"}},
+		}},
+	}
+	assert.NoError(t, principalsValidate(principals, ""))
+	au := NewAuthenticator(principals)
+
+	authorizer := au.AuthenticateAccount("test", "hahaha")
+	assert.NotNil(t, authorizer)
+	// the permits with variables are not added before resolved
+	assert.True(t, authorizer.Authorize(Publish, "public"))
+	assert.False(t, authorizer.Authorize(Publish, "devices/${clientid}/a"))
+
+	resolved := authorizer.Resolve("d1", "test")
+	assert.True(t, resolved.Authorize(Publish, "public"))
+	assert.True(t, resolved.Authorize(Publish, "devices/d1/a"))
+	assert.True(t, resolved.Authorize(Publish, "devices/d1/a/b"))
+	assert.False(t, resolved.Authorize(Publish, "devices/d2/a"))
+	assert.True(t, resolved.Authorize(Publish, "users/test/x/cmd"))
+	assert.False(t, resolved.Authorize(Publish, "users/other/x/cmd"))
+	assert.True(t, resolved.Authorize(Subscribe, "devices/d1-test/a"))
+	assert.False(t, resolved.Authorize(Subscribe, "devices/d1/a"))
+	// the authorizer of principal is not changed
+	assert.False(t, authorizer.Authorize(Publish, "devices/d1/a"))
+
+	// the values with wildcards or levels are not substituted
+	for _, username := range []string{"#", "+", "a/b", ""} {
+		resolved = authorizer.Resolve("d1", username)
+		assert.True(t, resolved.Authorize(Publish, "devices/d1/a"))
+		assert.False(t, resolved.Authorize(Publish, "users/a/b/x/cmd"))
+		assert.False(t, resolved.Authorize(Publish, "users/x/cmd"))
+		assert.False(t, resolved.Authorize(Subscribe, "devices/d1-/a"))
+	}
+
+	// the authorizer without variables is shared
+	au = NewAuthenticator([]Principal{{Username: "1", Permissions: []Permission{{Action: "pub", Permits: []string{"a"}}}}})
+	authorizer = au.AuthenticateCertificate("1")
+	assert.True(t, authorizer == authorizer.Resolve("d1", "1"))
+
+	// unsupported variable
+	principals[0].Permissions[0].Permits = []string{"devices/${unknown}/#"}
+	assert.EqualError(t, principalsValidate(principals, ""), "pub topic(devices/${unknown}/#) variable (${unknown}) is not supported")
+	principals[0].Permissions[0].Permits = []string{"devices/${clientid}#"}
+	assert.EqualError(t, principalsValidate(principals, ""), "pub topic(devices/${clientid}#) invalid")
+}
+
+func TestAuthPeer(t *testing.T) {
+	uid, gid, other := uint32(1000), uint32(100), uint32(0)
+	principals := []Principal{{
+		Username:    "service",
+		UID:         &uid,
+		Permissions: []Permission{{Action: "pub", Permits: []string{"service/#"}}},
+	}, {
+		Username:    "group",
+		Password:    "hahaha",
+		GID:         &gid,
+		Permissions: []Permission{{Action: "pub", Permits: []string{"group/#"}}},
+	}, {
+		Username:    "root",
+		UID:         &other,
+		GID:         &other,
+		Permissions: []Permission{{Action: "pub", Permits: []string{"#"}}},
+	}}
+	assert.NoError(t, principalsValidate(principals, ""))
+	au := NewAuthenticator(principals)
+
+	// the first matched principal wins
+	username, authorizer := au.AuthenticatePeer(1000, 100)
+	assert.Equal(t, "service", username)
+	assert.True(t, authorizer.Authorize(Publish, "service/a"))
+	assert.False(t, authorizer.Authorize(Publish, "group/a"))
+	username, authorizer = au.AuthenticatePeer(1001, 100)
+	assert.Equal(t, "group", username)
+	assert.True(t, authorizer.Authorize(Publish, "group/a"))
+	username, _ = au.AuthenticatePeer(0, 0)
+	assert.Equal(t, "root", username)
+	username, authorizer = au.AuthenticatePeer(0, 1)
+	assert.Equal(t, "", username)
+	assert.Nil(t, authorizer)
+
+	// the principal with password is also an account, the one without is not a certificate
+	assert.NotNil(t, au.AuthenticateAccount("group", "hahaha"))
+	assert.Nil(t, au.AuthenticateCertificate("service"))
+}
+
+func TestAuthDeny(t *testing.T) {
+	permissions := []Permission{
+		{Action: "pubsub", Permits: []string{"plant/#"}},
+		{Action: "pubsub", Effect: "deny", Permits: []string{"plant/secret/#"}},
+		{Action: "pub", Effect: "deny", Permits: []string{"plant/+/cmd"}},
+		{Action: "pub", Permits: []string{"plant/a/cmd"}},
+	}
+
+	// most specific wins
+	au := NewAuthenticator([]Principal{{Username: "u1", Password: "p1", Permissions: permissions}})
+	authorizer := au.AuthenticateAccount("u1", "p1")
+	assert.True(t, authorizer.Authorize(Publish, "plant/a"))
+	assert.True(t, authorizer.Authorize(Subscribe, "plant/a"))
+	assert.False(t, authorizer.Authorize(Publish, "plant/secret"))
+	assert.False(t, authorizer.Authorize(Publish, "plant/secret/a"))
+	assert.False(t, authorizer.Authorize(Subscribe, "plant/secret/a"))
+	assert.False(t, authorizer.Authorize(Publish, "plant/b/cmd"))
+	assert.True(t, authorizer.Authorize(Publish, "plant/a/cmd"))
+	assert.True(t, authorizer.Authorize(Subscribe, "plant/b/cmd"))
+	assert.False(t, authorizer.Authorize(Publish, "other"))
+	// the subscription covers the denied topics, whose messages are dropped when sending
+	assert.True(t, authorizer.Authorize(Subscribe, "plant/#"))
+	assert.True(t, authorizer.Authorize(Subscribe, "plant/+/a"))
+	assert.True(t, authorizer.Authorize(Subscribe, "plant/a/#"))
+	assert.False(t, authorizer.Authorize(Subscribe, "plant/secret/#"))
+
+	// first match wins
+	permissions = []Permission{
+		{Action: "pub", Permits: []string{"plant/a/cmd"}},
+		{Action: "pubsub", Effect: "deny", Permits: []string{"plant/+/cmd"}},
+		{Action: "pubsub", Permits: []string{"plant/#"}},
+		{Action: "pubsub", Effect: "deny", Permits: []string{"plant/secret"}},
+	}
+	au = NewAuthenticator([]Principal{{Username: "u1", Password: "p1", Precedence: "first-match", Permissions: permissions}})
+	authorizer = au.AuthenticateAccount("u1", "p1")
+	assert.True(t, authorizer.Authorize(Publish, "plant/a/cmd"))
+	assert.False(t, authorizer.Authorize(Publish, "plant/b/cmd"))
+	assert.False(t, authorizer.Authorize(Subscribe, "plant/a/cmd"))
+	assert.True(t, authorizer.Authorize(Publish, "plant/secret"))
+	assert.True(t, authorizer.Authorize(Subscribe, "plant/secret"))
+	assert.True(t, authorizer.Authorize(Subscribe, "plant/#"))
+	assert.True(t, authorizer.Authorize(Subscribe, "plant/b"))
+
+	// the denied permit with invalid variable value still takes effect
+	permissions = []Permission{
+		{Action: "pub", Permits: []string{"users/#"}},
+		{Action: "pub", Effect: "deny", Permits: []string{"users/${username}/secret"}},
+	}
+	au = NewAuthenticator([]Principal{{Username: "u1", Password: "p1", Permissions: permissions}})
+	authorizer = au.AuthenticateAccount("u1", "p1").Resolve("c1", "a+b")
+	assert.True(t, authorizer.Authorize(Publish, "users/a/public"))
+	assert.False(t, authorizer.Authorize(Publish, "users/a/secret"))
+
+	assert.True(t, moreSpecific("a", "a/#"))
+	assert.True(t, moreSpecific("a/b", "a/+"))
+	assert.True(t, moreSpecific("a/+", "+/b"))
+	assert.True(t, moreSpecific("a/+/#", "a/#"))
+	assert.False(t, moreSpecific("a/#", "a/#"))
+
+	// validate
+	err := principalsValidate([]Principal{{Username: "u1", Permissions: []Permission{{Action: "pubsub", Effect: "deny", Permits: []string{"a/#"}}}}}, "")
+	assert.NoError(t, err)
+	err = principalsValidate([]Principal{{Username: "u1", Permissions: []Permission{{Action: "all", Permits: []string{"a"}}}}}, "")
+	assert.EqualError(t, err, "username (u1) action (all) is not supported")
+	err = principalsValidate([]Principal{{Username: "u1", Permissions: []Permission{{Action: "pub", Effect: "reject", Permits: []string{"a"}}}}}, "")
+	assert.EqualError(t, err, "username (u1) effect (reject) is not supported")
+	err = principalsValidate([]Principal{{Username: "u1", Precedence: "last-match"}}, "")
+	assert.EqualError(t, err, "username (u1) precedence (last-match) is not supported")
+
+	// anonymous
+	assert.Nil(t, NewAnonymousAuthorizer(nil))
+	authorizer = NewAnonymousAuthorizer(&Principal{Permissions: []Permission{{Action: "sub", Permits: []string{"a/#"}}}})
+	assert.True(t, authorizer.Authorize(Subscribe, "a/b"))
+	assert.False(t, authorizer.Authorize(Publish, "a/b"))
+	assert.NoError(t, anonymousValidate((*Principal)(nil), ""))
+	err = anonymousValidate(&Principal{Permissions: []Permission{{Action: "sub", Permits: []string{"a/#/b"}}}}, "")
+	assert.EqualError(t, err, "sub topic(a/#/b) invalid")
 }
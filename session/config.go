@@ -5,6 +5,7 @@ import (
 
 	"github.com/baetyl/baetyl-go/v2/utils"
 
+	"github.com/baetyl/baetyl-broker/v2/common"
 	"github.com/baetyl/baetyl-broker/v2/queue"
 	"github.com/baetyl/baetyl-broker/v2/store"
 )
@@ -13,17 +14,137 @@ import (
 type Config struct {
 	SessionConfig `yaml:"session,omitempty" json:"session,omitempty"`
 	Principals    []Principal `yaml:"principals,omitempty" json:"principals,omitempty" validate:"principals"`
+	// the principal of the clients connected to anonymous listeners, only its precedence, permissions and limits are used,
+	// all topics are permitted if not set
+	Anonymous *Principal `yaml:"anonymous,omitempty" json:"anonymous,omitempty" validate:"anonymous"`
+	// the JWT passed as the password is verified if set, the username and permissions are got from its claims
+	JWT *JWT `yaml:"jwt,omitempty" json:"jwt,omitempty"`
+}
+
+// JWT the config to authenticate clients by JSON web token
+type JWT struct {
+	Secret           string `yaml:"secret,omitempty" json:"secret,omitempty"` // the secret of HMAC signing methods
+	JWKS             string `yaml:"jwks,omitempty" json:"jwks,omitempty"`     // the JWKS file of RSA, ECDSA and HMAC keys
+	Audience         string `yaml:"audience,omitempty" json:"audience,omitempty"`
+	Issuer           string `yaml:"issuer,omitempty" json:"issuer,omitempty"`
+	UsernameClaim    string `yaml:"usernameClaim" json:"usernameClaim" default:"sub"`
+	PermissionsClaim string `yaml:"permissionsClaim" json:"permissionsClaim" default:"permissions"` // the claim of permissions in the same format as principals
 }
 
 // SessionConfig session config without principals
 type SessionConfig struct {
 	MaxClients              int           `yaml:"maxClients,omitempty" json:"maxClients,omitempty"`
 	MaxMessagePayloadSize   utils.Size    `yaml:"maxMessagePayloadSize,omitempty" json:"maxMessagePayloadSize,omitempty" default:"32768" validate:"min=1,max=268435455"` // max size of message payload is (256MB - 1)
+	MaxSubscriptions        int           `yaml:"maxSubscriptions,omitempty" json:"maxSubscriptions,omitempty" validate:"min=0"`                                         // the max subscriptions of a session, 0 means no limit
+	MaxTopicLength          int           `yaml:"maxTopicLength,omitempty" json:"maxTopicLength,omitempty" validate:"min=0"`                                             // the max length of topic and topic filter, 0 means no limit
+	MaxTopicLevels          int           `yaml:"maxTopicLevels,omitempty" json:"maxTopicLevels,omitempty" validate:"min=0"`                                             // the max levels of topic and topic filter, 0 means no limit
+	DenyLeadingWildcard     bool          `yaml:"denyLeadingWildcard,omitempty" json:"denyLeadingWildcard,omitempty"`                                                    // the topic filter starting with # is not permitted to subscribe
 	MaxInflightQOS0Messages int           `yaml:"maxInflightQOS0Messages" json:"maxInflightQOS0Messages" default:"100" validate:"min=1"`
 	MaxInflightQOS1Messages int           `yaml:"maxInflightQOS1Messages" json:"maxInflightQOS1Messages" default:"20" validate:"min=1"`
 	ResendInterval          time.Duration `yaml:"resendInterval" json:"resendInterval" default:"20s"`
 	Persistence             Persistence   `yaml:"persistence,omitempty" json:"persistence,omitempty"`
 	SysTopics               []string      `yaml:"sysTopics,omitempty" json:"sysTopics,omitempty" default:"[\"$link\"]"`
+	SlowConsumer            SlowConsumer  `yaml:"slowConsumer,omitempty" json:"slowConsumer,omitempty"`
+	Delayed                 Delayed       `yaml:"delayed,omitempty" json:"delayed,omitempty"`
+	History                 []History     `yaml:"history,omitempty" json:"history,omitempty"`
+	Retain                  Retain        `yaml:"retain,omitempty" json:"retain,omitempty"`
+	CertIdentity            CertIdentity  `yaml:"certIdentity,omitempty" json:"certIdentity,omitempty"`
+	Ownership               string        `yaml:"ownership,omitempty" json:"ownership,omitempty" default:"refuse" validate:"regexp=^(none|refuse|reset)$"` // the policy when the session is taken over by another identity
+	Takeover                Takeover      `yaml:"takeover,omitempty" json:"takeover,omitempty"`
+	Guard                   Guard         `yaml:"guard,omitempty" json:"guard,omitempty"`
+	RateLimits              RateLimits    `yaml:"rateLimits,omitempty" json:"rateLimits,omitempty"`
+	Admission               Admission     `yaml:"admission,omitempty" json:"admission,omitempty"`
+}
+
+// Admission the limits of connections, the client exceeding the limits is rejected with ServerUnavailable
+type Admission struct {
+	MaxConnectionsPerIP       int           `yaml:"maxConnectionsPerIP" json:"maxConnectionsPerIP" validate:"min=0"`             // 0 means no limit
+	MaxConnectionsPerUsername int           `yaml:"maxConnectionsPerUsername" json:"maxConnectionsPerUsername" validate:"min=0"` // the limit of authenticated username, 0 means no limit
+	AcceptRate                float64       `yaml:"acceptRate" json:"acceptRate" validate:"min=0"`                               // the connections accepted per second, 0 means no limit
+	AcceptBurst               int           `yaml:"acceptBurst" json:"acceptBurst" validate:"min=0"`                             // the max connections accepted at once, defaults to acceptRate
+	ConnectTimeout            time.Duration `yaml:"connectTimeout" json:"connectTimeout" default:"5s"`                           // the max time to wait for the connect packet of the connection exceeding the limits, which is closed if timeout, 0 means no limit
+}
+
+// RateLimits the limits of publishing rate, the limit shared by the clients connected to a listener is set in the listener config
+type RateLimits struct {
+	Client   common.RateLimit `yaml:"client" json:"client"`     // the limit of each client
+	Username common.RateLimit `yaml:"username" json:"username"` // the limit shared by the clients of the same authenticated username
+}
+
+// Guard the config to protect against brute-force authentication and ban clients
+type Guard struct {
+	MaxFailures int           `yaml:"maxFailures" json:"maxFailures" validate:"min=0"` // the max authentication failures of an IP or username in the window, 0 means not to protect
+	Window      time.Duration `yaml:"window" json:"window" default:"5m"`
+	Delay       time.Duration `yaml:"delay" json:"delay" default:"1s"`              // the delay before responding the first failure, doubled for each subsequent failure
+	MaxDelay    time.Duration `yaml:"maxDelay" json:"maxDelay" default:"10s"`       // the max delay before responding a failure
+	BanDuration time.Duration `yaml:"banDuration" json:"banDuration" default:"10m"` // the IP and username are banned temporarily when failures exceed the limit
+	Bans        []Ban         `yaml:"bans,omitempty" json:"bans,omitempty"`         // the static bans, more bans can be added at runtime
+}
+
+// all ownership policies of session
+const (
+	OwnershipNone   = "none"   // the session is taken over
+	OwnershipRefuse = "refuse" // the client is refused with NotAuthorized
+	OwnershipReset  = "reset"  // the session is discarded and a new one is started if its owner is offline, otherwise the client is refused
+)
+
+// all takeover policies of client ID
+const (
+	TakeoverKick   = "kick"   // the old client is kicked off
+	TakeoverReject = "reject" // the new client is rejected with IdentifierRejected
+	TakeoverAllow  = "allow"  // both are kept, the new client uses a temporary session like clean session
+)
+
+// Takeover the config when a new client connects with the client ID of an active client
+type Takeover struct {
+	Policy   string   `yaml:"policy" json:"policy" default:"kick" validate:"regexp=^(kick|reject|allow)$"`
+	Flapping Flapping `yaml:"flapping" json:"flapping"`
+}
+
+// Flapping the config to detect the client ID taken over repeatedly
+type Flapping struct {
+	MaxTakeovers int           `yaml:"maxTakeovers" json:"maxTakeovers" validate:"min=0"` // the max takeovers in the window, 0 means not to detect
+	Window       time.Duration `yaml:"window" json:"window" default:"1m"`
+	BanDuration  time.Duration `yaml:"banDuration" json:"banDuration" default:"5m"` // the new clients with the client ID are refused with ServerUnavailable during the ban
+}
+
+// CertIdentity the config to get the identity of client certificate
+type CertIdentity struct {
+	// the template of identity, supports the variables ${cn}, ${san.dns}, ${san.uri}, ${san.email},
+	// ${subject.c}, ${subject.st}, ${subject.l}, ${subject.o}, ${subject.ou}, ${subject.serialnumber},
+	// ${serial} and ${fingerprint} (the hex encoded SHA-256 of certificate)
+	Template      string `yaml:"template" json:"template" default:"${cn}"`
+	ForceClientID bool   `yaml:"forceClientID" json:"forceClientID"` // the client ID must equal to the certificate identity
+}
+
+// Retain retained message config
+type Retain struct {
+	TTL           time.Duration `yaml:"ttl" json:"ttl"`                            // 0 means never expire
+	MaxCount      int           `yaml:"maxCount" json:"maxCount" validate:"min=0"` // 0 means no limit
+	MaxSize       utils.Size    `yaml:"maxSize" json:"maxSize"`                    // the max total payload size, 0 means no limit
+	SweepInterval time.Duration `yaml:"sweepInterval" json:"sweepInterval" default:"1m"`
+	Allow         []string      `yaml:"allow,omitempty" json:"allow,omitempty"` // topic filters allowed to retain, empty means all
+	Deny          []string      `yaml:"deny,omitempty" json:"deny,omitempty"`   // topic filters denied to retain, take precedence over allow
+}
+
+// SlowConsumer slow consumer detection config
+type SlowConsumer struct {
+	MaxBacklog    int           `yaml:"maxBacklog" json:"maxBacklog" validate:"min=0"` // 0 means no limit
+	CheckInterval time.Duration `yaml:"checkInterval" json:"checkInterval" default:"10s"`
+	Disconnect    bool          `yaml:"disconnect" json:"disconnect"`
+}
+
+// History message history config of a topic filter
+type History struct {
+	Topic    string        `yaml:"topic" json:"topic" validate:"nonzero"`
+	MaxCount int           `yaml:"maxCount" json:"maxCount" default:"1000" validate:"min=1"`
+	MaxAge   time.Duration `yaml:"maxAge" json:"maxAge" default:"24h"`
+}
+
+// Delayed delayed message config
+type Delayed struct {
+	MaxDelay   time.Duration `yaml:"maxDelay" json:"maxDelay" default:"24h"`
+	MaxPending int           `yaml:"maxPending" json:"maxPending" default:"10000" validate:"min=1"`
 }
 
 type Persistence struct {
@@ -0,0 +1,300 @@
+package session
+
+import (
+	"container/heap"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/baetyl/baetyl-go/v2/errors"
+	"github.com/baetyl/baetyl-go/v2/mqtt"
+	"github.com/gogo/protobuf/proto"
+
+	"github.com/baetyl/baetyl-broker/v2/store"
+)
+
+// the topic prefix of delayed message, the format is $delayed/<seconds>/<topic>
+const delayedTopicPrefix = "$delayed/"
+
+// DelayedMessage the pending delayed message
+type DelayedMessage struct {
+	ID       uint64    `json:"id"`
+	Topic    string    `json:"topic"`
+	QOS      uint32    `json:"qos"`
+	Due      time.Time `json:"due"`
+	ClientID string    `json:"clientid,omitempty"` // the client who published the delayed message
+	Username string    `json:"username,omitempty"` // the username of the client who published the delayed message
+}
+
+// delayedPublisher the publisher of a delayed message, kept for the audit of the retained message
+type delayedPublisher struct {
+	ClientID string `json:"clientid,omitempty"`
+	Username string `json:"username,omitempty"`
+}
+
+type delayedEntry struct {
+	id       uint64
+	due      uint64 // unix seconds
+	topic    string
+	qos      uint32
+	clientID string
+	username string
+}
+
+// dueMessage the due message with its publisher
+type dueMessage struct {
+	msg      *mqtt.Message
+	clientID string
+	username string
+}
+
+func (e *delayedEntry) key() []byte {
+	return store.U64U64ToByte(e.due, e.id)
+}
+
+// delayedHeap the entries ordered by due time
+type delayedHeap []*delayedEntry
+
+func (h delayedHeap) Len() int { return len(h) }
+func (h delayedHeap) Less(i, j int) bool {
+	if h[i].due == h[j].due {
+		return h[i].id < h[j].id
+	}
+	return h[i].due < h[j].due
+}
+func (h delayedHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *delayedHeap) Push(x interface{}) { *h = append(*h, x.(*delayedEntry)) }
+func (h *delayedHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// delayer keeps delayed messages in store and releases them when due
+type delayer struct {
+	cfg     Delayed
+	bucket  store.KVBucket // due and id -> delayed message
+	audits  store.KVBucket // due and id -> publisher of delayed message
+	entries map[uint64]*delayedEntry
+	queue   delayedHeap
+	offset  uint64
+	wakeup  chan struct{}
+	mut     sync.Mutex
+}
+
+func newDelayer(cfg Delayed, bucket, audits store.KVBucket) (*delayer, error) {
+	d := &delayer{
+		cfg:     cfg,
+		bucket:  bucket,
+		audits:  audits,
+		entries: make(map[uint64]*delayedEntry),
+		wakeup:  make(chan struct{}, 1),
+	}
+	// load stored delayed messages from backend database
+	err := bucket.ListKV(func(data []byte) error {
+		if len(data) == 0 {
+			return store.ErrDataNotFound
+		}
+		v := new(mqtt.Message)
+		if err := proto.Unmarshal(data, v); err != nil {
+			return errors.Trace(err)
+		}
+		d.add(&delayedEntry{id: v.Context.ID, due: v.Context.TS, topic: v.Context.Topic, qos: v.Context.QOS})
+		if v.Context.ID > d.offset {
+			d.offset = v.Context.ID
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// the message stored without publisher, such as the one stored before upgrade, is published by nobody
+	for _, e := range d.entries {
+		_ = audits.GetKV(e.key(), func(data []byte) error {
+			var p delayedPublisher
+			if err := json.Unmarshal(data, &p); err != nil {
+				return errors.Trace(err)
+			}
+			e.clientID, e.username = p.ClientID, p.Username
+			return nil
+		})
+	}
+	return d, nil
+}
+
+func (d *delayer) add(e *delayedEntry) {
+	d.entries[e.id] = e
+	heap.Push(&d.queue, e)
+}
+
+// delay stores the message with its publisher and returns its id
+func (d *delayer) delay(msg *mqtt.Message, delay time.Duration, clientID, username string) (uint64, error) {
+	if delay > d.cfg.MaxDelay {
+		return 0, ErrSessionDelayedMessageDelayExceedsLimit
+	}
+
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	if len(d.entries) >= d.cfg.MaxPending {
+		return 0, ErrSessionDelayedMessagePendingExceedsLimit
+	}
+
+	d.offset++
+	// the due time is rounded up to seconds, the message is never routed before the delay
+	due := time.Now().Add(delay + time.Second - 1).Unix()
+	e := &delayedEntry{
+		id:       d.offset,
+		due:      uint64(due),
+		topic:    msg.Context.Topic,
+		qos:      msg.Context.QOS,
+		clientID: clientID,
+		username: username,
+	}
+	v := *msg
+	v.Context.ID = e.id
+	v.Context.TS = e.due
+	data, err := proto.Marshal(&v)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	audit, err := json.Marshal(&delayedPublisher{ClientID: clientID, Username: username})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	err = d.audits.SetKV(e.key(), audit)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	err = d.bucket.SetKV(e.key(), data)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	d.add(e)
+	select {
+	case d.wakeup <- struct{}{}:
+	default:
+	}
+	return e.id, nil
+}
+
+// next returns the duration until the earliest message is due
+func (d *delayer) next() (time.Duration, bool) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	for d.queue.Len() > 0 {
+		e := d.queue[0]
+		if _, ok := d.entries[e.id]; !ok {
+			// already canceled
+			heap.Pop(&d.queue)
+			continue
+		}
+		return time.Until(time.Unix(int64(e.due), 0)), true
+	}
+	return 0, false
+}
+
+// due pops all due messages, the messages are removed from store by done after routed,
+// the message which fails to be read from store is dropped
+func (d *delayer) due() (msgs []dueMessage, err error) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	now := uint64(time.Now().Unix())
+	for d.queue.Len() > 0 && d.queue[0].due <= now {
+		e := heap.Pop(&d.queue).(*delayedEntry)
+		if _, ok := d.entries[e.id]; !ok {
+			continue
+		}
+		msg := new(mqtt.Message)
+		_err := d.bucket.GetKV(e.key(), func(data []byte) error {
+			return errors.Trace(proto.Unmarshal(data, msg))
+		})
+		if _err != nil {
+			d.remove(e)
+			err = errors.Trace(_err)
+			continue
+		}
+		msgs = append(msgs, dueMessage{msg: msg, clientID: e.clientID, username: e.username})
+	}
+	return msgs, err
+}
+
+// done removes the routed message from store
+func (d *delayer) done(id uint64) error {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	e, ok := d.entries[id]
+	if !ok {
+		return nil
+	}
+	return d.remove(e)
+}
+
+// remove removes the entry and its publisher from store
+func (d *delayer) remove(e *delayedEntry) error {
+	delete(d.entries, e.id)
+	err := d.audits.DelKV(e.key())
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(d.bucket.DelKV(e.key()))
+}
+
+func (d *delayer) list() []DelayedMessage {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	res := make([]DelayedMessage, 0, len(d.entries))
+	for _, e := range d.entries {
+		res = append(res, DelayedMessage{
+			ID:       e.id,
+			Topic:    e.topic,
+			QOS:      e.qos,
+			Due:      time.Unix(int64(e.due), 0),
+			ClientID: e.clientID,
+			Username: e.username,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Due.Equal(res[j].Due) {
+			return res[i].ID < res[j].ID
+		}
+		return res[i].Due.Before(res[j].Due)
+	})
+	return res
+}
+
+func (d *delayer) cancel(id uint64) error {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	e, ok := d.entries[id]
+	if !ok {
+		return ErrSessionDelayedMessageNotFound
+	}
+	return d.remove(e)
+}
+
+// parseDelayedTopic parses the topic like $delayed/<seconds>/<topic>, returns the real topic and the delay
+func parseDelayedTopic(topic string) (string, time.Duration, bool) {
+	if !strings.HasPrefix(topic, delayedTopicPrefix) {
+		return topic, 0, false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(topic, delayedTopicPrefix), "/", 2)
+	if len(parts) != 2 {
+		return topic, 0, false
+	}
+	seconds, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return topic, 0, false
+	}
+	return parts[1], time.Duration(seconds) * time.Second, true
+}
@@ -0,0 +1,457 @@
+package session
+
+import (
+	"context"
+	"crypto/x509"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/baetyl/baetyl-go/v2/mqtt"
+	"github.com/gogo/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	grpcpeer "google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/baetyl/baetyl-broker/v2/common"
+)
+
+// the flags of the messages exchanged by the grpc service, see broker.proto
+const (
+	GRPCFlagRetain      = 0x1 // the message is retained
+	GRPCFlagAck         = 0x2 // the acknowledgement of the QoS 1 message with the same ID
+	GRPCFlagSubscribe   = 0x4 // subscribes the topic filter with the QoS, or the reply with the granted QoS
+	GRPCFlagUnsubscribe = 0x8 // unsubscribes the topic filter, or the reply
+)
+
+// the failure return code of the subscription
+const grpcSubscribeFailure = 0x80
+
+// SessionRequest the request of the session rpcs
+type SessionRequest struct {
+	ClientID string `protobuf:"bytes,1,opt,name=ClientID,proto3" json:"ClientID,omitempty"`
+}
+
+func (m *SessionRequest) Reset()         { *m = SessionRequest{} }
+func (m *SessionRequest) String() string { return proto.CompactTextString(m) }
+func (*SessionRequest) ProtoMessage()    {}
+
+// SessionReply the session of the client
+type SessionReply struct {
+	ClientID      string                 `protobuf:"bytes,1,opt,name=ClientID,proto3" json:"ClientID,omitempty"`
+	Owner         string                 `protobuf:"bytes,2,opt,name=Owner,proto3" json:"Owner,omitempty"`
+	Connected     bool                   `protobuf:"varint,3,opt,name=Connected,proto3" json:"Connected,omitempty"`
+	Subscriptions []*SessionSubscription `protobuf:"bytes,4,rep,name=Subscriptions,proto3" json:"Subscriptions,omitempty"`
+}
+
+func (m *SessionReply) Reset()         { *m = SessionReply{} }
+func (m *SessionReply) String() string { return proto.CompactTextString(m) }
+func (*SessionReply) ProtoMessage()    {}
+
+// SessionSubscription the subscription of the session
+type SessionSubscription struct {
+	Topic string `protobuf:"bytes,1,opt,name=Topic,proto3" json:"Topic,omitempty"`
+	QOS   uint32 `protobuf:"varint,2,opt,name=QOS,proto3" json:"QOS,omitempty"`
+}
+
+func (m *SessionSubscription) Reset()         { *m = SessionSubscription{} }
+func (m *SessionSubscription) String() string { return proto.CompactTextString(m) }
+func (*SessionSubscription) ProtoMessage()    {}
+
+// RegisterGRPC registers the broker service to the grpc server of the listener
+func (m *Manager) RegisterGRPC(svr *grpc.Server, info common.ConnInfo) {
+	svr.RegisterService(&grpcServiceDesc, &grpcService{manager: m, info: info})
+}
+
+type grpcBrokerServer interface {
+	Publish(context.Context, *mqtt.Message) (*mqtt.Message, error)
+	Subscribe(grpcSubscribeStream) error
+	GetSession(context.Context, *SessionRequest) (*SessionReply, error)
+	DeleteSession(context.Context, *SessionRequest) (*SessionReply, error)
+}
+
+type grpcSubscribeStream interface {
+	Send(*mqtt.Message) error
+	Recv() (*mqtt.Message, error)
+	grpc.ServerStream
+}
+
+// grpcService the broker service, each rpc is served by a client connected through an in-memory connection,
+// the credentials are got from the metadata: username, password or authorization (Bearer <token>),
+// and clientid and cleansession for Subscribe
+type grpcService struct {
+	manager *Manager
+	info    common.ConnInfo
+}
+
+// Publish publishes the message by a transient client, returns the acknowledgement after the message is routed
+func (s *grpcService) Publish(ctx context.Context, msg *mqtt.Message) (*mqtt.Message, error) {
+	c, conn, err := s.connect(ctx, &mqtt.Connect{CleanSession: true})
+	if err != nil {
+		return nil, err
+	}
+	defer disconnect(c, conn)
+
+	pkt := newPublish(msg)
+	if err = publishPipe(c, conn, pkt); err != nil {
+		return nil, reasonStatus(err)
+	}
+	return &mqtt.Message{
+		Context: mqtt.Context{
+			ID:    msg.Context.ID,
+			QOS:   msg.Context.QOS,
+			Flags: GRPCFlagAck,
+			Topic: msg.Context.Topic,
+		},
+	}, nil
+}
+
+// Subscribe serves the stream of the client, which sends the subscribe, unsubscribe, acknowledgement
+// and publish messages, and receives the messages subscribed and the replies
+func (s *grpcService) Subscribe(stream grpcSubscribeStream) error {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	p := &mqtt.Connect{ClientID: mdValue(md, "clientid"), CleanSession: true}
+	if v := mdValue(md, "cleansession"); v != "" {
+		var err error
+		p.CleanSession, err = strconv.ParseBool(v)
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "cleansession (%s) is invalid", v)
+		}
+	}
+	c, conn, err := s.connect(stream.Context(), p)
+	if err != nil {
+		return err
+	}
+
+	st := &grpcStream{pending: map[mqtt.ID]*mqtt.Message{}}
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			msg, err := stream.Recv()
+			if err != nil {
+				errs <- err
+				return
+			}
+			if err = conn.put(st.packet(msg)); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case pkt := <-conn.s2c:
+			msg := st.message(pkt)
+			if msg == nil {
+				continue
+			}
+			if err = stream.Send(msg); err != nil {
+				conn.Close()
+				<-c.tomb.Dead()
+				return err
+			}
+		case err = <-errs:
+			if err == io.EOF {
+				// the client closes the stream normally
+				disconnect(c, conn)
+				return nil
+			}
+			conn.Close()
+			<-c.tomb.Dead()
+			return err
+		case <-conn.done:
+			return reasonStatus(clientReason(c))
+		}
+	}
+}
+
+// GetSession gets the session owned by the identity of the caller
+func (s *grpcService) GetSession(ctx context.Context, req *SessionRequest) (*SessionReply, error) {
+	sess, err := s.ownedSession(ctx, req.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	_, connected := s.manager.clients.load(req.ClientID)
+	res := &SessionReply{
+		ClientID:  req.ClientID,
+		Owner:     sess.owner(),
+		Connected: connected,
+	}
+	for topic, qos := range sess.subscriptions() {
+		res.Subscriptions = append(res.Subscriptions, &SessionSubscription{Topic: topic, QOS: uint32(qos)})
+	}
+	sort.Slice(res.Subscriptions, func(i, j int) bool {
+		return res.Subscriptions[i].Topic < res.Subscriptions[j].Topic
+	})
+	return res, nil
+}
+
+// DeleteSession disconnects the client and deletes the session owned by the identity of the caller
+func (s *grpcService) DeleteSession(ctx context.Context, req *SessionRequest) (*SessionReply, error) {
+	sess, err := s.ownedSession(ctx, req.ClientID)
+	if err != nil {
+		return nil, err
+	}
+	owner := sess.owner()
+	if err = s.manager.deleteSession(req.ClientID); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &SessionReply{ClientID: req.ClientID, Owner: owner}, nil
+}
+
+// ownedSession authenticates the caller by a transient client, and gets the session owned by its identity,
+// the caller without identity owns no session, the admin owns all sessions including the ones without owner,
+// the caller authenticated by the token is never the admin even if its username is of an admin principal
+func (s *grpcService) ownedSession(ctx context.Context, id string) (*Session, error) {
+	c, conn, err := s.connect(ctx, &mqtt.Connect{CleanSession: true})
+	if err != nil {
+		return nil, err
+	}
+	identity, admin := c.session.owner(), c.admin
+	disconnect(c, conn)
+
+	v, ok := s.manager.sessions.load(id)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "session (%s) is not found", id)
+	}
+	sess := v.(*Session)
+	if admin {
+		return sess, nil
+	}
+	if identity == "" || sess.owner() != identity {
+		return nil, status.Error(codes.PermissionDenied, ErrSessionOwnerNotMatch.Error())
+	}
+	return sess, nil
+}
+
+// connect connects the client with the credentials of the metadata, returns the status if the client is refused
+func (s *grpcService) connect(ctx context.Context, p *mqtt.Connect) (*Client, *pipeConn, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	p.Username = mdValue(md, "username")
+	p.Password = mdValue(md, "password")
+	info := s.info
+	if v := mdValue(md, "authorization"); len(v) > 7 && strings.EqualFold(v[:7], "Bearer ") {
+		// the token is used as the password if the password is not set
+		info.Token = v[7:]
+	}
+
+	var remote net.Addr
+	var certs []*x509.Certificate
+	if pr, ok := grpcpeer.FromContext(ctx); ok {
+		remote = pr.Addr
+		// the tls handshake is done by grpc
+		if ti, ok := pr.AuthInfo.(credentials.TLSInfo); ok {
+			certs = ti.State.PeerCertificates
+		}
+	}
+	conn := newPipeConn(ctx, remote, certs)
+	c, err := s.manager.connectPipe(conn, info, p, "grpc")
+	if err != nil {
+		return nil, nil, reasonStatus(err)
+	}
+	return c, conn, nil
+}
+
+// reasonStatus converts the reason why the client is refused or closed to the grpc status
+func reasonStatus(err error) error {
+	return status.Error(reasonCode(err), err.Error())
+}
+
+// grpcStream converts the messages of the Subscribe stream and the packets of the client
+type grpcStream struct {
+	id      mqtt.ID
+	pending map[mqtt.ID]*mqtt.Message // the subscribe and unsubscribe requests waiting for the replies
+	mut     sync.Mutex
+}
+
+// packet converts the request message to the packet
+func (s *grpcStream) packet(msg *mqtt.Message) mqtt.Packet {
+	switch {
+	case msg.Context.Flags&GRPCFlagAck == GRPCFlagAck:
+		return &mqtt.Puback{ID: mqtt.ID(msg.Context.ID)}
+	case msg.Context.Flags&GRPCFlagSubscribe == GRPCFlagSubscribe:
+		return &mqtt.Subscribe{
+			ID:            s.wait(msg),
+			Subscriptions: []mqtt.Subscription{{Topic: msg.Context.Topic, QOS: mqtt.QOS(msg.Context.QOS)}},
+		}
+	case msg.Context.Flags&GRPCFlagUnsubscribe == GRPCFlagUnsubscribe:
+		return &mqtt.Unsubscribe{ID: s.wait(msg), Topics: []string{msg.Context.Topic}}
+	default:
+		return newPublish(msg)
+	}
+}
+
+// message converts the packet to the message sent to the stream, returns nil if the packet is ignored
+func (s *grpcStream) message(pkt mqtt.Packet) *mqtt.Message {
+	switch p := pkt.(type) {
+	case *mqtt.Publish:
+		return common.NewMessage(p)
+	case *mqtt.Puback:
+		return &mqtt.Message{Context: mqtt.Context{ID: uint64(p.ID), QOS: 1, Flags: GRPCFlagAck}}
+	case *mqtt.Suback:
+		req := s.done(p.ID)
+		if req == nil {
+			return nil
+		}
+		qos := uint32(grpcSubscribeFailure)
+		if len(p.ReturnCodes) > 0 && p.ReturnCodes[0] != mqtt.QOSFailure {
+			qos = uint32(p.ReturnCodes[0])
+		}
+		return &mqtt.Message{Context: mqtt.Context{ID: req.Context.ID, QOS: qos, Flags: GRPCFlagSubscribe, Topic: req.Context.Topic}}
+	case *mqtt.Unsuback:
+		req := s.done(p.ID)
+		if req == nil {
+			return nil
+		}
+		return &mqtt.Message{Context: mqtt.Context{ID: req.Context.ID, Flags: GRPCFlagUnsubscribe, Topic: req.Context.Topic}}
+	default:
+		return nil
+	}
+}
+
+// wait allocates the packet ID of the request waiting for the reply
+func (s *grpcStream) wait(msg *mqtt.Message) mqtt.ID {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.id++
+	if s.id == 0 {
+		s.id = 1
+	}
+	s.pending[s.id] = msg
+	return s.id
+}
+
+func (s *grpcStream) done(id mqtt.ID) *mqtt.Message {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	msg := s.pending[id]
+	delete(s.pending, id)
+	return msg
+}
+
+func newPublish(msg *mqtt.Message) *mqtt.Publish {
+	pkt := mqtt.NewPublish()
+	pkt.ID = mqtt.ID(msg.Context.ID)
+	pkt.Message.QOS = mqtt.QOS(msg.Context.QOS)
+	pkt.Message.Topic = msg.Context.Topic
+	pkt.Message.Payload = msg.Content
+	pkt.Message.Retain = msg.Context.Flags&GRPCFlagRetain == GRPCFlagRetain
+	return pkt
+}
+
+func mdValue(md metadata.MD, key string) string {
+	if vs := md.Get(key); len(vs) > 0 {
+		return vs[0]
+	}
+	return ""
+}
+
+// * the service description, see broker.proto
+
+var grpcServiceDesc = grpc.ServiceDesc{
+	ServiceName: "broker.Broker",
+	HandlerType: (*grpcBrokerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Publish",
+			Handler:    grpcPublishHandler,
+		},
+		{
+			MethodName: "GetSession",
+			Handler:    grpcGetSessionHandler,
+		},
+		{
+			MethodName: "DeleteSession",
+			Handler:    grpcDeleteSessionHandler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Subscribe",
+			Handler:       grpcSubscribeHandler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "broker.proto",
+}
+
+func grpcPublishHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(mqtt.Message)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(grpcBrokerServer).Publish(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/broker.Broker/Publish",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(grpcBrokerServer).Publish(ctx, req.(*mqtt.Message))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func grpcGetSessionHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SessionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(grpcBrokerServer).GetSession(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/broker.Broker/GetSession",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(grpcBrokerServer).GetSession(ctx, req.(*SessionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func grpcDeleteSessionHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SessionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(grpcBrokerServer).DeleteSession(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/broker.Broker/DeleteSession",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(grpcBrokerServer).DeleteSession(ctx, req.(*SessionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func grpcSubscribeHandler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(grpcBrokerServer).Subscribe(&grpcSubscribeServerStream{stream})
+}
+
+type grpcSubscribeServerStream struct {
+	grpc.ServerStream
+}
+
+func (x *grpcSubscribeServerStream) Send(m *mqtt.Message) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *grpcSubscribeServerStream) Recv() (*mqtt.Message, error) {
+	m := new(mqtt.Message)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,140 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/baetyl/baetyl-go/v2/mqtt"
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/baetyl/baetyl-broker/v2/common"
+)
+
+func TestSessionGRPC(t *testing.T) {
+	b := newMockBroker(t, testConfSession)
+	defer b.closeAndClean()
+
+	svc := &grpcService{manager: b.manager, info: common.ConnInfo{Address: "grpc://0.0.0.0:8273"}}
+	ctx := func(kv ...string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs(kv...))
+	}
+	assertCode := func(expect codes.Code, err error) {
+		assert.Error(t, err)
+		assert.Equal(t, expect, status.Code(err), err.Error())
+	}
+
+	// subscribe
+	sub := newMockStream(t, metadata.Pairs("clientid", "grpc-sub", "cleansession", "false", "username", "u3", "password", "p3"))
+	done := make(chan error, 1)
+	go func() {
+		done <- svc.Subscribe(sub)
+	}()
+	sub.sendC2S(&mqtt.Message{Context: mqtt.Context{ID: 1, QOS: 1, Flags: GRPCFlagSubscribe, Topic: "talks"}})
+	sub.assertS2CMessage("Context:<ID:1 QOS:1 Flags:4 Topic:\"talks\" > ")
+	sub.sendC2S(&mqtt.Message{Context: mqtt.Context{ID: 2, QOS: 1, Flags: GRPCFlagSubscribe, Topic: "nope"}})
+	sub.assertS2CMessage("Context:<ID:2 QOS:128 Flags:4 Topic:\"nope\" > ")
+	sub.sendC2S(&mqtt.Message{Context: mqtt.Context{ID: 3, QOS: 0, Flags: GRPCFlagSubscribe, Topic: "test"}})
+	sub.assertS2CMessage("Context:<ID:3 Flags:4 Topic:\"test\" > ")
+	sub.sendC2S(&mqtt.Message{Context: mqtt.Context{ID: 4, Flags: GRPCFlagUnsubscribe, Topic: "test"}})
+	sub.assertS2CMessage("Context:<ID:4 Flags:8 Topic:\"test\" > ")
+
+	// publish qos 1
+	res, err := svc.Publish(ctx("username", "u2", "password", "p2"), &mqtt.Message{Context: mqtt.Context{ID: 7, QOS: 1, Topic: "talks"}, Content: []byte("hi")})
+	assert.NoError(t, err)
+	assert.Equal(t, "Context:<ID:7 QOS:1 Flags:2 Topic:\"talks\" > ", res.String())
+	sub.assertS2CMessage("Context:<ID:1 QOS:1 Topic:\"talks\" > Content:\"hi\" ")
+	sub.sendC2S(&mqtt.Message{Context: mqtt.Context{ID: 1, Flags: GRPCFlagAck}})
+
+	// publish qos 0
+	res, err = svc.Publish(ctx("username", "u2", "password", "p2"), &mqtt.Message{Context: mqtt.Context{Topic: "talks"}, Content: []byte("hello")})
+	assert.NoError(t, err)
+	assert.Equal(t, "Context:<Flags:2 Topic:\"talks\" > ", res.String())
+	sub.assertS2CMessage("Context:<Topic:\"talks\" > Content:\"hello\" ")
+
+	// publish refused
+	_, err = svc.Publish(ctx("username", "u2", "password", "x"), &mqtt.Message{Context: mqtt.Context{Topic: "talks"}})
+	assertCode(codes.Unauthenticated, err)
+	_, err = svc.Publish(ctx(), &mqtt.Message{Context: mqtt.Context{Topic: "talks"}})
+	assertCode(codes.Unauthenticated, err)
+	_, err = svc.Publish(ctx("username", "u2", "password", "p2"), &mqtt.Message{Context: mqtt.Context{Topic: "nope"}})
+	assertCode(codes.PermissionDenied, err)
+	_, err = svc.Publish(ctx("username", "u2", "password", "p2"), &mqtt.Message{Context: mqtt.Context{QOS: 2, Topic: "talks"}})
+	assertCode(codes.InvalidArgument, err)
+	sub.assertS2CMessageTimeout()
+	b.assertClientCount(1)
+
+	// get session
+	ses, err := svc.GetSession(ctx("username", "u3", "password", "p3"), &SessionRequest{ClientID: "grpc-sub"})
+	assert.NoError(t, err)
+	assert.Equal(t, "ClientID:\"grpc-sub\" Owner:\"u3\" Connected:true Subscriptions:<Topic:\"talks\" QOS:1 > ", ses.String())
+	_, err = svc.GetSession(ctx("username", "u2", "password", "p2"), &SessionRequest{ClientID: "grpc-sub"})
+	assertCode(codes.PermissionDenied, err)
+	_, err = svc.GetSession(ctx("username", "u3", "password", "p3"), &SessionRequest{ClientID: "unknown"})
+	assertCode(codes.NotFound, err)
+	// the admin gets the session of others
+	ses, err = svc.GetSession(ctx("username", "u4", "password", "p4"), &SessionRequest{ClientID: "grpc-sub"})
+	assert.NoError(t, err)
+	assert.Equal(t, "u3", ses.Owner)
+	// the token with the username of admin is not the admin
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "u4", "exp": time.Now().Add(time.Hour).Unix()}).SignedString([]byte("s1"))
+	assert.NoError(t, err)
+	_, err = svc.GetSession(ctx("authorization", "Bearer "+token), &SessionRequest{ClientID: "grpc-sub"})
+	assertCode(codes.PermissionDenied, err)
+	_, err = svc.DeleteSession(ctx("authorization", "Bearer "+token), &SessionRequest{ClientID: "grpc-sub"})
+	assertCode(codes.PermissionDenied, err)
+
+	// the session without owner is only got by the admin
+	anon := newMockConn(t)
+	b.manager.Handle(anon, true)
+	anon.sendC2S(&mqtt.Connect{ClientID: "anon", Version: 3})
+	anon.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	anon.sendC2S(&mqtt.Disconnect{})
+	b.waitClientReady("anon", true)
+	_, err = svc.GetSession(ctx("username", "u3", "password", "p3"), &SessionRequest{ClientID: "anon"})
+	assertCode(codes.PermissionDenied, err)
+	anonSvc := &grpcService{manager: b.manager, info: common.ConnInfo{Anonymous: true, Address: "grpc://0.0.0.0:8274"}}
+	_, err = anonSvc.GetSession(ctx(), &SessionRequest{ClientID: "anon"})
+	assertCode(codes.PermissionDenied, err)
+	_, err = anonSvc.DeleteSession(ctx(), &SessionRequest{ClientID: "anon"})
+	assertCode(codes.PermissionDenied, err)
+	ses, err = svc.DeleteSession(ctx("username", "u4", "password", "p4"), &SessionRequest{ClientID: "anon"})
+	assert.NoError(t, err)
+	assert.Equal(t, "ClientID:\"anon\" ", ses.String())
+
+	// the client closes the stream, the session is kept
+	sub.Close()
+	assert.NoError(t, <-done)
+	b.assertClientCount(0)
+	ses, err = svc.GetSession(ctx("username", "u3", "password", "p3"), &SessionRequest{ClientID: "grpc-sub"})
+	assert.NoError(t, err)
+	assert.False(t, ses.Connected)
+
+	// the client publishes a message not permitted on the stream
+	sub = newMockStream(t, metadata.Pairs("clientid", "grpc-sub", "cleansession", "false", "username", "u3", "password", "p3"))
+	go func() {
+		done <- svc.Subscribe(sub)
+	}()
+	b.waitClientReady("grpc-sub", false)
+	sub.sendC2S(&mqtt.Message{Context: mqtt.Context{Topic: "talks"}})
+	assertCode(codes.PermissionDenied, <-done)
+
+	// delete session
+	_, err = svc.DeleteSession(ctx("username", "u2", "password", "p2"), &SessionRequest{ClientID: "grpc-sub"})
+	assertCode(codes.PermissionDenied, err)
+	ses, err = svc.DeleteSession(ctx("username", "u3", "password", "p3"), &SessionRequest{ClientID: "grpc-sub"})
+	assert.NoError(t, err)
+	assert.Equal(t, "ClientID:\"grpc-sub\" Owner:\"u3\" ", ses.String())
+	b.assertSessionCount(0)
+	b.assertExchangeCount(0)
+	b.assertSessionStore("grpc-sub", "", errors.New("pebble: not found"))
+
+	// invalid metadata
+	sub = newMockStream(t, metadata.Pairs("cleansession", "x"))
+	assertCode(codes.InvalidArgument, svc.Subscribe(sub))
+}
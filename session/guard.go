@@ -0,0 +1,314 @@
+package session
+
+import (
+	"encoding/json"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/baetyl/baetyl-go/v2/errors"
+	"github.com/baetyl/baetyl-go/v2/mqtt"
+
+	"github.com/baetyl/baetyl-broker/v2/common"
+	"github.com/baetyl/baetyl-broker/v2/store"
+)
+
+// all types of ban
+const (
+	BanIP       = "ip" // the IP or CIDR, such as 192.168.1.1 or 192.168.0.0/16
+	BanClientID = "clientid"
+	BanUsername = "username"
+)
+
+// Ban the ban of clients by IP, client ID or username
+type Ban struct {
+	Type  string `yaml:"type" json:"type" validate:"regexp=^(ip|clientid|username)$"`
+	Value string `yaml:"value" json:"value" validate:"nonzero"`
+}
+
+func (b Ban) key() []byte {
+	return []byte(b.Type + "/" + b.Value)
+}
+
+// check checks whether the ban is valid
+func (b Ban) check() error {
+	switch b.Type {
+	case BanIP:
+		if _, err := common.ParseIPNet(b.Value); err != nil {
+			return ErrSessionBanInvalid
+		}
+	case BanClientID, BanUsername:
+		if b.Value == "" {
+			return ErrSessionBanInvalid
+		}
+	default:
+		return ErrSessionBanInvalid
+	}
+	return nil
+}
+
+// banRule the ban whose IP or CIDR is parsed once when it is loaded or added
+type banRule struct {
+	Ban
+	ipnet   *net.IPNet
+	runtime bool // true if the ban is added at runtime
+}
+
+func newBanRule(b Ban, runtime bool) (*banRule, error) {
+	if err := b.check(); err != nil {
+		return nil, err
+	}
+	r := &banRule{Ban: b, runtime: runtime}
+	if b.Type == BanIP {
+		r.ipnet, _ = common.ParseIPNet(b.Value)
+	}
+	return r, nil
+}
+
+// match checks whether the client is banned
+func (r *banRule) match(ip net.IP, clientID, username string) bool {
+	switch r.Type {
+	case BanIP:
+		return ip != nil && r.ipnet.Contains(ip)
+	case BanClientID:
+		return r.Value == clientID
+	case BanUsername:
+		return r.Value == username
+	}
+	return false
+}
+
+// failures the authentication failures of an IP, or a username from an IP, in the window
+type failures struct {
+	count  int
+	first  time.Time
+	banned time.Time // banned until this time
+}
+
+// guard protects against brute-force authentication and bans the clients
+type guard struct {
+	cfg      Guard
+	bucket   store.KVBucket // the bans added at runtime
+	bans     map[Ban]*banRule
+	failures map[string]*failures
+	mut      sync.Mutex
+}
+
+func newGuard(cfg Guard, bucket store.KVBucket) (*guard, error) {
+	g := &guard{
+		cfg:      cfg,
+		bucket:   bucket,
+		bans:     map[Ban]*banRule{},
+		failures: map[string]*failures{},
+	}
+	for _, b := range cfg.Bans {
+		r, err := newBanRule(b, false)
+		if err != nil {
+			return nil, errors.Errorf("ban (%s: %s) is invalid", b.Type, b.Value)
+		}
+		g.bans[b] = r
+	}
+	// load the bans added at runtime from backend database
+	err := bucket.ListKV(func(data []byte) error {
+		if len(data) == 0 {
+			return store.ErrDataNotFound
+		}
+		var b Ban
+		if err := json.Unmarshal(data, &b); err != nil {
+			return errors.Trace(err)
+		}
+		if _, ok := g.bans[b]; ok {
+			return nil
+		}
+		r, err := newBanRule(b, true)
+		if err != nil {
+			return errors.Errorf("ban (%s: %s) is invalid", b.Type, b.Value)
+		}
+		g.bans[b] = r
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return g, nil
+}
+
+// banned checks whether the client is banned by the ban list or for too many failures
+func (g *guard) banned(ip net.IP, clientID, username string) bool {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+
+	for _, r := range g.bans {
+		if r.match(ip, clientID, username) {
+			return true
+		}
+	}
+	now := time.Now()
+	for _, key := range failureKeys(ip, username) {
+		if f, ok := g.failures[key]; ok && now.Before(f.banned) {
+			return true
+		}
+	}
+	return false
+}
+
+// fail records an authentication failure of the IP and username,
+// returns the progressive delay before responding and whether they are banned now
+func (g *guard) fail(ip net.IP, username string) (time.Duration, bool) {
+	if g.cfg.MaxFailures <= 0 {
+		return 0, false
+	}
+
+	g.mut.Lock()
+	defer g.mut.Unlock()
+
+	now := time.Now()
+	g.prune(now)
+	var count int
+	var banned bool
+	for _, key := range failureKeys(ip, username) {
+		f, ok := g.failures[key]
+		if !ok {
+			f = &failures{first: now}
+			g.failures[key] = f
+		}
+		f.count++
+		if f.count > count {
+			count = f.count
+		}
+		if f.count >= g.cfg.MaxFailures {
+			f.count = 0
+			f.first = now
+			f.banned = now.Add(g.cfg.BanDuration)
+			banned = true
+		}
+	}
+	// the delay is doubled for each failure
+	delay := g.cfg.Delay
+	for i := 1; i < count && delay < g.cfg.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > g.cfg.MaxDelay {
+		delay = g.cfg.MaxDelay
+	}
+	return delay, banned
+}
+
+// succeed resets the failures of the IP and username
+func (g *guard) succeed(ip net.IP, username string) {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+
+	for _, key := range failureKeys(ip, username) {
+		if f, ok := g.failures[key]; ok && !time.Now().Before(f.banned) {
+			delete(g.failures, key)
+		}
+	}
+}
+
+// prune removes the failures out of the window and the expired bans
+func (g *guard) prune(now time.Time) {
+	for key, f := range g.failures {
+		if now.Sub(f.first) > g.cfg.Window && !now.Before(f.banned) {
+			delete(g.failures, key)
+		}
+	}
+}
+
+// add adds the ban at runtime, returns the rule to match clients
+func (g *guard) add(b Ban) (*banRule, error) {
+	r, err := newBanRule(b, true)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(b)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	g.mut.Lock()
+	defer g.mut.Unlock()
+
+	if old, ok := g.bans[b]; ok {
+		return old, nil
+	}
+	err = g.bucket.SetKV(b.key(), data)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	g.bans[b] = r
+	return r, nil
+}
+
+// del deletes the ban added at runtime
+func (g *guard) del(b Ban) error {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+
+	r, ok := g.bans[b]
+	if !ok {
+		return ErrSessionBanNotFound
+	}
+	if !r.runtime {
+		return ErrSessionBanNotDeletable
+	}
+	err := g.bucket.DelKV(b.key())
+	if err != nil {
+		return errors.Trace(err)
+	}
+	delete(g.bans, b)
+	return nil
+}
+
+// list lists all bans ordered by type and value
+func (g *guard) list() []Ban {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+
+	res := make([]Ban, 0, len(g.bans))
+	for b := range g.bans {
+		res = append(res, b)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Type == res[j].Type {
+			return res[i].Value < res[j].Value
+		}
+		return res[i].Type < res[j].Type
+	})
+	return res
+}
+
+// remoteIP gets the IP of the remote address of connection, returns nil if unknown
+func remoteIP(conn mqtt.Connection) net.IP {
+	addr := conn.RemoteAddr()
+	if addr == nil {
+		return nil
+	}
+	if a, ok := addr.(*net.TCPAddr); ok {
+		if a == nil {
+			return nil
+		}
+		return a.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// failureKeys returns the keys to count the failures, the failures of a username are counted by the IP where they come from,
+// so the user can't be locked out by the failures from other IPs, the IP is unknown for the local connections
+func failureKeys(ip net.IP, username string) []string {
+	var keys []string
+	var prefix string
+	if ip != nil {
+		prefix = BanIP + "/" + ip.String() + "/"
+		keys = append(keys, BanIP+"/"+ip.String())
+	}
+	if username != "" {
+		keys = append(keys, prefix+BanUsername+"/"+username)
+	}
+	return keys
+}
@@ -0,0 +1,244 @@
+package session
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/baetyl/baetyl-go/v2/errors"
+	"github.com/baetyl/baetyl-go/v2/log"
+	"github.com/baetyl/baetyl-go/v2/mqtt"
+	"github.com/gogo/protobuf/proto"
+
+	"github.com/baetyl/baetyl-broker/v2/common"
+	"github.com/baetyl/baetyl-broker/v2/store"
+)
+
+// the topic prefix of subscription with replay request, the format is $replay/<since>/<topic filter>,
+// since is unix timestamp in seconds or a duration before now, such as 10m
+const replayTopicPrefix = "$replay/"
+
+// history the message log of a topic filter, it is bound to exchange as a queue,
+// the messages are logged by the writer in background to keep the disk latency out of routing
+type history struct {
+	cfg    History
+	bucket store.BatchBucket
+	offset uint64
+	events chan *common.Event
+	quit   chan struct{}
+	log    *log.Logger
+	mut    sync.Mutex
+}
+
+func newHistory(cfg History, db store.DB) (*history, error) {
+	// the topic filter is hashed to avoid the bucket name being the prefix of another one
+	sum := sha1.Sum([]byte(cfg.Topic))
+	bucket, err := db.NewBatchBucket("#history/" + hex.EncodeToString(sum[:]))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	offset, err := bucket.MaxOffset()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &history{
+		cfg:    cfg,
+		bucket: bucket,
+		offset: offset,
+		events: make(chan *common.Event, cfg.MaxCount),
+		quit:   make(chan struct{}),
+		log:    log.With(log.Any("history", cfg.Topic)),
+	}, nil
+}
+
+// ID returns the topic filter
+func (h *history) ID() string {
+	return h.cfg.Topic
+}
+
+// Push queues the message to be logged, it never blocks the routing,
+// the message is dropped if the writer falls behind by the max count
+func (h *history) Push(e *common.Event) error {
+	select {
+	case h.events <- e:
+	case <-h.quit:
+		e.Done()
+	default:
+		metrics.Add(metricHistoryDropped, 1)
+		h.log.Debug("history is full, the message is dropped", log.Any("topic", e.Context.Topic))
+		e.Done()
+	}
+	return nil
+}
+
+// writing logs the queued messages until dying, the event is acknowledged after its message is logged
+func (h *history) writing(dying <-chan struct{}) error {
+	defer close(h.quit)
+	for {
+		select {
+		case e := <-h.events:
+			h.write(e)
+		case <-dying:
+			// logs the messages queued before dying
+			for {
+				select {
+				case e := <-h.events:
+					h.write(e)
+				default:
+					return nil
+				}
+			}
+		}
+	}
+}
+
+func (h *history) write(e *common.Event) {
+	defer e.Done()
+
+	err := h.append(e)
+	if err != nil {
+		h.log.Error("failed to log message", log.Any("topic", e.Context.Topic), log.Error(err))
+	}
+}
+
+func (h *history) append(e *common.Event) error {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+
+	h.offset++
+	msg := &mqtt.Message{
+		Context: mqtt.Context{
+			ID:    h.offset,
+			TS:    uint64(time.Now().Unix()),
+			QOS:   e.Context.QOS,
+			Topic: e.Context.Topic,
+		},
+		Content: e.Content,
+	}
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	err = h.bucket.Set(msg.Context.ID, data)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	// trim the log in batch to reduce deletions
+	if batch := uint64(h.cfg.MaxCount/10 + 1); h.offset%batch == 0 {
+		h.trim()
+	}
+	return nil
+}
+
+func (h *history) trim() {
+	if h.offset > uint64(h.cfg.MaxCount) {
+		err := h.bucket.DelBeforeID(h.offset - uint64(h.cfg.MaxCount))
+		if err != nil {
+			h.log.Error("failed to delete messages beyond the max count", log.Error(err))
+		}
+	}
+	err := h.bucket.DelBeforeTS(uint64(time.Now().Add(-h.cfg.MaxAge).Unix()))
+	if err != nil {
+		h.log.Error("failed to delete messages beyond the max age", log.Error(err))
+	}
+}
+
+// read reads the logged messages since the given time whose topic matches the filter, in the order they are logged
+func (h *history) read(since time.Time, filter string) ([]*mqtt.Message, error) {
+	h.mut.Lock()
+	offset := h.offset
+	h.mut.Unlock()
+
+	if min := time.Now().Add(-h.cfg.MaxAge); since.Before(min) {
+		since = min
+	}
+	start := uint64(1)
+	if offset > uint64(h.cfg.MaxCount) {
+		start = offset - uint64(h.cfg.MaxCount) + 1
+	}
+	trie := mqtt.NewTrie()
+	trie.Add(filter, true)
+
+	var msgs []*mqtt.Message
+	err := h.bucket.Get(start, h.cfg.MaxCount, func(data []byte, id uint64) error {
+		if id > offset {
+			return nil
+		}
+		v := new(mqtt.Message)
+		if err := proto.Unmarshal(data, v); err != nil {
+			return errors.Trace(err)
+		}
+		if int64(v.Context.TS) < since.Unix() || len(trie.Match(v.Context.Topic)) == 0 {
+			return nil
+		}
+		v.Context.ID = 0
+		msgs = append(msgs, v)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return msgs, nil
+}
+
+// mergeHistories merges the messages of two histories in time order, the message logged by both histories is kept once,
+// the messages logged in the same second are compared by topic, QoS and payload, since the time is in seconds
+func mergeHistories(a, b []*mqtt.Message) []*mqtt.Message {
+	res := make([]*mqtt.Message, 0, len(a)+len(b))
+	for len(a) > 0 || len(b) > 0 {
+		switch {
+		case len(b) == 0 || len(a) > 0 && a[0].Context.TS < b[0].Context.TS:
+			res, a = append(res, a[0]), a[1:]
+		case len(a) == 0 || b[0].Context.TS < a[0].Context.TS:
+			res, b = append(res, b[0]), b[1:]
+		default:
+			ts := a[0].Context.TS
+			i, j := 0, 0
+			for i < len(a) && a[i].Context.TS == ts {
+				i++
+			}
+			for j < len(b) && b[j].Context.TS == ts {
+				j++
+			}
+			logged := map[string]int{}
+			for _, v := range a[:i] {
+				logged[historyKey(v)]++
+			}
+			res = append(res, a[:i]...)
+			for _, v := range b[:j] {
+				if k := historyKey(v); logged[k] > 0 {
+					logged[k]--
+					continue
+				}
+				res = append(res, v)
+			}
+			a, b = a[i:], b[j:]
+		}
+	}
+	return res
+}
+
+func historyKey(msg *mqtt.Message) string {
+	return strconv.FormatUint(uint64(msg.Context.QOS), 10) + "/" + msg.Context.Topic + "/" + string(msg.Content)
+}
+
+// parseReplayTopic parses the topic like $replay/<since>/<topic filter>, returns the real topic filter and the start time
+func parseReplayTopic(topic string) (string, time.Time, bool) {
+	if !strings.HasPrefix(topic, replayTopicPrefix) {
+		return topic, time.Time{}, false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(topic, replayTopicPrefix), "/", 2)
+	if len(parts) != 2 {
+		return topic, time.Time{}, false
+	}
+	if ts, err := strconv.ParseInt(parts[0], 10, 64); err == nil {
+		return parts[1], time.Unix(ts, 0), true
+	}
+	if d, err := time.ParseDuration(parts[0]); err == nil && d >= 0 {
+		return parts[1], time.Now().Add(-d), true
+	}
+	return topic, time.Time{}, false
+}
@@ -0,0 +1,255 @@
+package session
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/baetyl/baetyl-go/v2/errors"
+	"github.com/baetyl/baetyl-go/v2/mqtt"
+	"google.golang.org/grpc/codes"
+
+	"github.com/baetyl/baetyl-broker/v2/common"
+)
+
+// HTTPMessage the message published by POST /publish, and sent by the events of GET /subscribe
+type HTTPMessage struct {
+	Topic   string `json:"topic"`
+	QOS     uint32 `json:"qos"`
+	Retain  bool   `json:"retain,omitempty"`
+	Payload []byte `json:"payload,omitempty"` // encoded by base64
+}
+
+// NewHTTPHandler creates the handler of the http listener, each request is served by a transient client,
+// the credentials are got from the basic authorization, or the bearer token
+func (m *Manager) NewHTTPHandler(info common.ConnInfo) http.Handler {
+	g := &httpGateway{manager: m, info: info}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/publish", g.publish)
+	mux.HandleFunc("/subscribe", g.subscribe)
+	return mux
+}
+
+type httpGateway struct {
+	manager *Manager
+	info    common.ConnInfo
+}
+
+// publish publishes the message with the query parameters topic, qos (0 by default) and retain, and the body as payload,
+// responds after the message is routed, the QoS 1 message is acknowledged by puback
+func (g *httpGateway) publish(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	qos, err := httpQOS(q.Get("qos"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var retain bool
+	if v := q.Get("retain"); v != "" {
+		retain, err = strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "retain is invalid", http.StatusBadRequest)
+			return
+		}
+	}
+	payload, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	c, conn, err := g.connect(r)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	defer disconnect(c, conn)
+
+	pkt := mqtt.NewPublish()
+	pkt.Message.Topic = q.Get("topic")
+	pkt.Message.QOS = mqtt.QOS(qos)
+	pkt.Message.Retain = retain
+	pkt.Message.Payload = payload
+	if err = publishPipe(c, conn, pkt); err != nil {
+		httpError(w, err)
+		return
+	}
+	httpJSON(w, http.StatusOK, &HTTPMessage{Topic: pkt.Message.Topic, QOS: qos, Retain: retain})
+}
+
+// subscribe subscribes the topic filters of the query parameters topic (repeatable) with qos (0 by default),
+// and sends the messages as the server-sent events until the request is finished,
+// the QoS 1 messages are acknowledged after sent
+func (g *httpGateway) subscribe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	topics := q["topic"]
+	if len(topics) == 0 {
+		http.Error(w, "topic is not set", http.StatusBadRequest)
+		return
+	}
+	qos, err := httpQOS(q.Get("qos"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "server-sent events are not supported", http.StatusInternalServerError)
+		return
+	}
+
+	c, conn, err := g.connect(r)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	defer disconnect(c, conn)
+
+	sub := &mqtt.Subscribe{ID: 1}
+	for _, topic := range topics {
+		sub.Subscriptions = append(sub.Subscriptions, mqtt.Subscription{Topic: topic, QOS: mqtt.QOS(qos)})
+	}
+	if err = conn.put(sub); err != nil {
+		httpError(w, clientReason(c))
+		return
+	}
+	for {
+		pkt, err := conn.get()
+		if err != nil {
+			httpError(w, clientReason(c))
+			return
+		}
+		sa, ok := pkt.(*mqtt.Suback)
+		if !ok {
+			continue
+		}
+		for i, code := range sa.ReturnCodes {
+			if code == mqtt.QOSFailure {
+				http.Error(w, fmt.Sprintf("topic (%s) is not permitted to subscribe", topics[i]), http.StatusForbidden)
+				return
+			}
+		}
+		break
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	send := func(p *mqtt.Publish) error {
+		data, err := json.Marshal(&HTTPMessage{
+			Topic:   p.Message.Topic,
+			QOS:     uint32(p.Message.QOS),
+			Retain:  p.Message.Retain,
+			Payload: p.Message.Payload,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err = fmt.Fprintf(w, "event: message\ndata: %s\n\n", data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		if p.Message.QOS > 0 {
+			return conn.put(&mqtt.Puback{ID: p.ID})
+		}
+		return nil
+	}
+	for {
+		select {
+		case pkt := <-conn.s2c:
+			if p, ok := pkt.(*mqtt.Publish); ok && send(p) != nil {
+				return
+			}
+		case <-conn.done:
+			fmt.Fprintf(w, "event: error\ndata: %s\n\n", clientReason(c).Error())
+			flusher.Flush()
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// connect connects the client with the credentials of the request, returns the reason if the client is refused
+func (g *httpGateway) connect(r *http.Request) (*Client, *pipeConn, error) {
+	p := &mqtt.Connect{CleanSession: true}
+	info := g.info
+	if username, password, ok := r.BasicAuth(); ok {
+		p.Username, p.Password = username, password
+	} else if v := r.Header.Get("Authorization"); len(v) > 7 && strings.EqualFold(v[:7], "Bearer ") {
+		// the token is used as the password
+		info.Token = v[7:]
+	}
+
+	var remote net.Addr
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		remote = addr
+	}
+	var certs []*x509.Certificate
+	if r.TLS != nil {
+		certs = r.TLS.PeerCertificates
+	}
+	conn := newPipeConn(r.Context(), remote, certs)
+	c, err := g.manager.connectPipe(conn, info, p, "http")
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, conn, nil
+}
+
+func httpQOS(v string) (uint32, error) {
+	if v == "" {
+		return 0, nil
+	}
+	qos, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		return 0, errors.New("qos is invalid")
+	}
+	return uint32(qos), nil
+}
+
+// httpError responds the reason why the client is refused or closed
+func httpError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	switch reasonCode(err) {
+	case codes.Unauthenticated:
+		w.Header().Set("WWW-Authenticate", `Basic realm="baetyl-broker"`)
+		code = http.StatusUnauthorized
+	case codes.PermissionDenied:
+		code = http.StatusForbidden
+	case codes.InvalidArgument:
+		code = http.StatusBadRequest
+	case codes.ResourceExhausted:
+		code = http.StatusTooManyRequests
+	case codes.Unavailable, codes.Aborted:
+		code = http.StatusServiceUnavailable
+	}
+	http.Error(w, err.Error(), code)
+}
+
+func httpJSON(w http.ResponseWriter, code int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(data)
+}
@@ -0,0 +1,87 @@
+package session
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/baetyl/baetyl-broker/v2/common"
+)
+
+func TestSessionHTTP(t *testing.T) {
+	b := newMockBroker(t, testConfSession)
+	defer b.closeAndClean()
+
+	svr := httptest.NewServer(b.manager.NewHTTPHandler(common.ConnInfo{Address: "http://0.0.0.0:8280"}))
+	defer svr.Close()
+
+	request := func(method, url, username, password, body string) *http.Response {
+		req, err := http.NewRequest(method, svr.URL+url, strings.NewReader(body))
+		assert.NoError(t, err)
+		if username != "" {
+			req.SetBasicAuth(username, password)
+		}
+		res, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		return res
+	}
+	assertResponse := func(res *http.Response, code int, expect string) {
+		defer res.Body.Close()
+		data, err := ioutil.ReadAll(res.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, code, res.StatusCode)
+		assert.Equal(t, expect, string(data))
+	}
+
+	// subscribe
+	res := request(http.MethodGet, "/subscribe?topic=talks&topic=test&qos=1", "u3", "p3", "")
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+	events := bufio.NewReader(res.Body)
+	assertEvent := func(expect string) {
+		var lines []string
+		for {
+			line, err := events.ReadString('\n')
+			assert.NoError(t, err)
+			if line == "\n" {
+				break
+			}
+			lines = append(lines, line)
+		}
+		assert.Equal(t, expect, strings.Join(lines, ""))
+	}
+
+	// publish
+	assertResponse(request(http.MethodPost, "/publish?topic=talks&qos=1", "u2", "p2", "hi"), http.StatusOK, `{"topic":"talks","qos":1}`)
+	assertEvent("event: message\ndata: {\"topic\":\"talks\",\"qos\":1,\"payload\":\"aGk=\"}\n")
+	assertResponse(request(http.MethodPost, "/publish?topic=test", "u2", "p2", "hello"), http.StatusOK, `{"topic":"test","qos":0}`)
+	assertEvent("event: message\ndata: {\"topic\":\"test\",\"qos\":0,\"payload\":\"aGVsbG8=\"}\n")
+
+	// publish refused
+	assertResponse(request(http.MethodPost, "/publish?topic=talks", "u2", "x", "hi"), http.StatusUnauthorized, "username or password is not permitted\n")
+	assertResponse(request(http.MethodPost, "/publish?topic=talks", "", "", "hi"), http.StatusUnauthorized, "certificate identity is not found\n")
+	assertResponse(request(http.MethodPost, "/publish?topic=nope", "u2", "p2", "hi"), http.StatusForbidden, "message topic is not permitted\n")
+	assertResponse(request(http.MethodPost, "/publish?topic=talks/%23", "u2", "p2", "hi"), http.StatusBadRequest, "message topic is invalid\n")
+	assertResponse(request(http.MethodPost, "/publish?topic=talks&qos=x", "u2", "p2", "hi"), http.StatusBadRequest, "qos is invalid\n")
+	assertResponse(request(http.MethodPost, "/publish?topic=talks&retain=x", "u2", "p2", "hi"), http.StatusBadRequest, "retain is invalid\n")
+	assertResponse(request(http.MethodGet, "/publish?topic=talks", "u2", "p2", ""), http.StatusMethodNotAllowed, "Method Not Allowed\n")
+
+	// subscribe refused
+	assertResponse(request(http.MethodGet, "/subscribe?topic=nope", "u3", "p3", ""), http.StatusForbidden, "topic (nope) is not permitted to subscribe\n")
+	assertResponse(request(http.MethodGet, "/subscribe", "u3", "p3", ""), http.StatusBadRequest, "topic is not set\n")
+	assertResponse(request(http.MethodPost, "/subscribe?topic=talks", "u3", "p3", ""), http.StatusMethodNotAllowed, "Method Not Allowed\n")
+	b.assertClientCount(1)
+
+	// the client is closed when the request is finished
+	res.Body.Close()
+	for b.manager.clients.count() > 0 {
+		time.Sleep(time.Millisecond * 100)
+	}
+}
@@ -0,0 +1,98 @@
+package session
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"regexp"
+
+	"github.com/baetyl/baetyl-go/v2/errors"
+)
+
+// the default template of certificate identity
+const defaultCertIdentityTemplate = "${cn}"
+
+// the variables of certificate identity template, such as ${san.uri}
+var certIdentityVariable = regexp.MustCompile(`\$\{([a-z.]+)\}`)
+
+// all variables of certificate identity template
+var certIdentityValues = map[string]func(cert *x509.Certificate) string{
+	"cn": func(cert *x509.Certificate) string {
+		return cert.Subject.CommonName
+	},
+	"san.dns": func(cert *x509.Certificate) string {
+		return first(cert.DNSNames)
+	},
+	"san.uri": func(cert *x509.Certificate) string {
+		if len(cert.URIs) == 0 {
+			return ""
+		}
+		return cert.URIs[0].String()
+	},
+	"san.email": func(cert *x509.Certificate) string {
+		return first(cert.EmailAddresses)
+	},
+	"subject.c": func(cert *x509.Certificate) string {
+		return first(cert.Subject.Country)
+	},
+	"subject.st": func(cert *x509.Certificate) string {
+		return first(cert.Subject.Province)
+	},
+	"subject.l": func(cert *x509.Certificate) string {
+		return first(cert.Subject.Locality)
+	},
+	"subject.o": func(cert *x509.Certificate) string {
+		return first(cert.Subject.Organization)
+	},
+	"subject.ou": func(cert *x509.Certificate) string {
+		return first(cert.Subject.OrganizationalUnit)
+	},
+	"subject.serialnumber": func(cert *x509.Certificate) string {
+		return cert.Subject.SerialNumber
+	},
+	"serial": func(cert *x509.Certificate) string {
+		return cert.SerialNumber.String()
+	},
+	"fingerprint": func(cert *x509.Certificate) string {
+		sum := sha256.Sum256(cert.Raw)
+		return hex.EncodeToString(sum[:])
+	},
+}
+
+// checkCertIdentityTemplate checks whether all variables of template are supported
+func checkCertIdentityTemplate(tpl string) error {
+	for _, match := range certIdentityVariable.FindAllStringSubmatch(tpl, -1) {
+		if _, ok := certIdentityValues[match[1]]; !ok {
+			return errors.Errorf("certificate identity variable (%s) is not supported", match[0])
+		}
+	}
+	return nil
+}
+
+// getCertIdentity gets the identity of certificate by template, returns false if any variable is empty
+func getCertIdentity(tpl string, cert *x509.Certificate) (string, bool) {
+	if tpl == "" {
+		tpl = defaultCertIdentityTemplate
+	}
+	ok := true
+	identity := certIdentityVariable.ReplaceAllStringFunc(tpl, func(v string) string {
+		get, exists := certIdentityValues[v[2:len(v)-1]]
+		if !exists {
+			ok = false
+			return ""
+		}
+		value := get(cert)
+		if value == "" {
+			ok = false
+		}
+		return value
+	})
+	return identity, ok && identity != ""
+}
+
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
@@ -0,0 +1,244 @@
+package session
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/baetyl/baetyl-go/v2/errors"
+	"github.com/golang-jwt/jwt"
+)
+
+// all key types of JWKS
+const (
+	keyTypeHMAC  = "oct"
+	keyTypeRSA   = "RSA"
+	keyTypeECDSA = "EC"
+)
+
+// all curves of ECDSA keys in JWKS
+var jwkCurves = map[string]elliptic.Curve{
+	"P-256": elliptic.P256(),
+	"P-384": elliptic.P384(),
+	"P-521": elliptic.P521(),
+}
+
+// jwk the JSON web key
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+type verificationKey struct {
+	kty string
+	kid string
+	key interface{} // []byte, *rsa.PublicKey or *ecdsa.PublicKey
+}
+
+// tokenAuthenticator authenticates the client by the JWT passed as the password
+type tokenAuthenticator struct {
+	cfg    JWT
+	keys   []verificationKey
+	parser *jwt.Parser
+}
+
+func newTokenAuthenticator(cfg *JWT) (*tokenAuthenticator, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	a := &tokenAuthenticator{
+		cfg:    *cfg,
+		parser: &jwt.Parser{UseJSONNumber: true},
+	}
+	if cfg.Secret != "" {
+		a.keys = append(a.keys, verificationKey{kty: keyTypeHMAC, key: []byte(cfg.Secret)})
+	}
+	if cfg.JWKS != "" {
+		keys, err := loadJWKS(cfg.JWKS)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		a.keys = append(a.keys, keys...)
+	}
+	if len(a.keys) == 0 {
+		return nil, errors.Errorf("jwt secret or jwks is not set")
+	}
+	return a, nil
+}
+
+// loadJWKS loads the keys from JWKS file
+func loadJWKS(file string) ([]verificationKey, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	err = json.Unmarshal(data, &jwks)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var keys []verificationKey
+	for _, k := range jwks.Keys {
+		key, err := k.parse()
+		if err != nil {
+			return nil, errors.Errorf("jwks key (%s) is invalid: %s", k.Kid, err.Error())
+		}
+		keys = append(keys, verificationKey{kty: k.Kty, kid: k.Kid, key: key})
+	}
+	return keys, nil
+}
+
+func (k jwk) parse() (interface{}, error) {
+	switch k.Kty {
+	case keyTypeHMAC:
+		return decodeBase64URL(k.K)
+	case keyTypeRSA:
+		n, err := decodeBase64URL(k.N)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		e, err := decodeBase64URL(k.E)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case keyTypeECDSA:
+		curve, ok := jwkCurves[k.Crv]
+		if !ok {
+			return nil, errors.Errorf("curve (%s) is not supported", k.Crv)
+		}
+		x, err := decodeBase64URL(k.X)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		y, err := decodeBase64URL(k.Y)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	default:
+		return nil, errors.Errorf("key type (%s) is not supported", k.Kty)
+	}
+}
+
+func decodeBase64URL(v string) ([]byte, error) {
+	if v == "" {
+		return nil, errors.Errorf("value is empty")
+	}
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(v, "="))
+}
+
+// key selects the key to verify the token by the key type of signing method and the key ID
+func (a *tokenAuthenticator) key(token *jwt.Token) (interface{}, error) {
+	var kty string
+	switch token.Method.(type) {
+	case *jwt.SigningMethodHMAC:
+		kty = keyTypeHMAC
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		kty = keyTypeRSA
+	case *jwt.SigningMethodECDSA:
+		kty = keyTypeECDSA
+	default:
+		return nil, errors.Errorf("signing method (%s) is not supported", token.Method.Alg())
+	}
+	kid, _ := token.Header["kid"].(string)
+	for _, k := range a.keys {
+		if k.kty == kty && (kid == "" || k.kid == kid) {
+			return k.key, nil
+		}
+	}
+	return nil, errors.Errorf("key of signing method (%s) is not found", token.Method.Alg())
+}
+
+// isToken checks whether the password looks like a JWT
+func isToken(password string) bool {
+	return strings.Count(password, ".") == 2
+}
+
+// isTokenMalformed checks whether the token failed to be parsed, it may be a password which looks like a JWT
+func isTokenMalformed(err error) bool {
+	e, ok := errors.Cause(err).(*jwt.ValidationError)
+	return ok && e.Errors&jwt.ValidationErrorMalformed != 0
+}
+
+// authenticate verifies the token, returns the authorizer derived from its claims, the username and the expiration time,
+// the token without exp is refused
+func (a *tokenAuthenticator) authenticate(token string) (*Authorizer, string, time.Time, error) {
+	var expires time.Time
+	t, err := a.parser.Parse(token, a.key)
+	if err != nil {
+		return nil, "", expires, errors.Trace(err)
+	}
+	claims := t.Claims.(jwt.MapClaims)
+	now := jwt.TimeFunc().Unix()
+	exp, ok := numericDate(claims, "exp")
+	if !ok || exp < now {
+		return nil, "", expires, errors.Errorf("token exp is not set or expired")
+	}
+	if _, ok := claims["nbf"]; ok {
+		nbf, ok := numericDate(claims, "nbf")
+		if !ok || nbf > now {
+			return nil, "", expires, errors.Errorf("token is not valid yet")
+		}
+	}
+	if a.cfg.Audience != "" && !claims.VerifyAudience(a.cfg.Audience, true) {
+		return nil, "", expires, errors.Errorf("token audience is invalid")
+	}
+	if a.cfg.Issuer != "" && !claims.VerifyIssuer(a.cfg.Issuer, true) {
+		return nil, "", expires, errors.Errorf("token issuer is invalid")
+	}
+	username, _ := claims[a.cfg.UsernameClaim].(string)
+	if username == "" {
+		return nil, "", expires, errors.Errorf("token claim (%s) is not set", a.cfg.UsernameClaim)
+	}
+	var permissions []Permission
+	if v, ok := claims[a.cfg.PermissionsClaim]; ok {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, "", expires, errors.Trace(err)
+		}
+		err = json.Unmarshal(data, &permissions)
+		if err != nil {
+			return nil, "", expires, errors.Errorf("token claim (%s) is invalid", a.cfg.PermissionsClaim)
+		}
+	}
+	err = principalValidate(Principal{Username: username, Permissions: permissions})
+	if err != nil {
+		return nil, "", expires, errors.Trace(err)
+	}
+	expires = time.Unix(exp, 0)
+	return newAuthorizer(permissions, ""), username, expires, nil
+}
+
+// numericDate returns the seconds of the NumericDate claim, which may be a non-integer value such as 1.7e9,
+// the fraction is truncated
+func numericDate(claims jwt.MapClaims, name string) (int64, bool) {
+	var v float64
+	switch t := claims[name].(type) {
+	case json.Number:
+		f, err := t.Float64()
+		if err != nil {
+			return 0, false
+		}
+		v = f
+	case float64:
+		v = t
+	default:
+		return 0, false
+	}
+	return int64(v), true
+}
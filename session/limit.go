@@ -0,0 +1,195 @@
+package session
+
+import (
+	"sync"
+	"time"
+
+	"github.com/baetyl/baetyl-broker/v2/common"
+)
+
+// all actions when the rate limit is exceeded
+const (
+	RateLimitDelay      = "delay"      // delays reading from the connection until tokens are enough
+	RateLimitDrop       = "drop"       // drops the QoS 0 messages, delays the QoS 1 messages
+	RateLimitDisconnect = "disconnect" // disconnects the client
+)
+
+// bucket the token bucket
+type bucket struct {
+	rate   float64 // tokens added per second
+	burst  float64 // the capacity
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate, burst float64) *bucket {
+	if burst <= 0 {
+		burst = rate
+	}
+	return &bucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (b *bucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// wait returns the duration to wait until n tokens are available
+func (b *bucket) wait(n float64) time.Duration {
+	if n > b.burst {
+		n = b.burst
+	}
+	if b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+// take takes n tokens, the tokens may be negative if not enough
+func (b *bucket) take(n float64) {
+	if n > b.burst {
+		n = b.burst
+	}
+	b.tokens -= n
+}
+
+// limiter limits the rate of messages and bytes published
+type limiter struct {
+	action   string
+	messages *bucket
+	bytes    *bucket
+	username string // the username sharing the limiter
+	refs     int    // the clients sharing the limiter, guarded by the mutex of limiters
+	mut      sync.Mutex
+}
+
+func newLimiter(cfg common.RateLimit) *limiter {
+	if cfg.Messages <= 0 && cfg.Bytes <= 0 {
+		return nil
+	}
+	l := &limiter{action: cfg.Action}
+	if l.action == "" {
+		l.action = RateLimitDelay
+	}
+	if cfg.Messages > 0 {
+		l.messages = newBucket(cfg.Messages, float64(cfg.MessageBurst))
+	}
+	if cfg.Bytes > 0 {
+		l.bytes = newBucket(float64(cfg.Bytes), float64(cfg.ByteBurst))
+	}
+	return l
+}
+
+// limit consumes the tokens of a message with the size if available and returns 0,
+// otherwise returns the duration to wait until the tokens are available.
+// The tokens are always consumed if the action is delay, so that the waits of concurrent clients are queued
+func (l *limiter) limit(size int) time.Duration {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	now := time.Now()
+	var wait time.Duration
+	for _, b := range l.buckets() {
+		b.refill(now)
+		if w := b.wait(l.tokens(b, size)); w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 && l.action != RateLimitDelay {
+		return wait
+	}
+	for _, b := range l.buckets() {
+		b.take(l.tokens(b, size))
+	}
+	return wait
+}
+
+func (l *limiter) buckets() []*bucket {
+	var res []*bucket
+	if l.messages != nil {
+		res = append(res, l.messages)
+	}
+	if l.bytes != nil {
+		res = append(res, l.bytes)
+	}
+	return res
+}
+
+func (l *limiter) tokens(b *bucket, size int) float64 {
+	if b == l.bytes {
+		return float64(size)
+	}
+	return 1
+}
+
+// limiters the shared limiters of usernames and listeners, the limiter of username is removed
+// when all its clients are closed, so that the limiters of the usernames no longer connected are not kept
+type limiters struct {
+	cfg       RateLimits
+	usernames map[string]*limiter
+	listeners map[string]*limiter
+	mut       sync.Mutex
+}
+
+func newLimiters(cfg RateLimits) *limiters {
+	return &limiters{
+		cfg:       cfg,
+		usernames: map[string]*limiter{},
+		listeners: map[string]*limiter{},
+	}
+}
+
+// get gets the limiters of the client, the username and the listener,
+// the limiters got are released by the client when it is closed
+func (l *limiters) get(username string, listener common.ConnInfo) []*limiter {
+	var res []*limiter
+	if v := newLimiter(l.cfg.Client); v != nil {
+		res = append(res, v)
+	}
+
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	if username != "" {
+		v, ok := l.usernames[username]
+		if !ok {
+			v = newLimiter(l.cfg.Username)
+		}
+		if v != nil {
+			v.username = username
+			v.refs++
+			l.usernames[username] = v
+			res = append(res, v)
+		}
+	}
+	if listener.Address != "" {
+		v, ok := l.listeners[listener.Address]
+		if !ok {
+			v = newLimiter(listener.RateLimit)
+			l.listeners[listener.Address] = v
+		}
+		if v != nil {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// release releases the limiters got by the client, removes the limiter of username if it's not shared by any client
+func (l *limiters) release(ls []*limiter) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	for _, v := range ls {
+		if v.username == "" {
+			continue
+		}
+		v.refs--
+		if v.refs <= 0 {
+			delete(l.usernames, v.username)
+		}
+	}
+}
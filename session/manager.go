@@ -2,16 +2,18 @@ package session
 
 import (
 	"encoding/json"
+	"expvar"
+	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/baetyl/baetyl-go/v2/errors"
 	"github.com/baetyl/baetyl-go/v2/log"
 	"github.com/baetyl/baetyl-go/v2/mqtt"
+	"github.com/baetyl/baetyl-go/v2/utils"
 
 	"github.com/baetyl/baetyl-broker/v2/exchange"
 	"github.com/baetyl/baetyl-broker/v2/store"
-
-	"github.com/gogo/protobuf/proto"
 )
 
 // all errors
@@ -22,22 +24,60 @@ var (
 	ErrSessionClientPacketUnexpected             = errors.New("session client received unexpected packet")
 	ErrSessionClientPacketIDConflict             = errors.New("packet id conflict, to acknowledge old packet")
 	ErrSessionClientPacketNotFound               = errors.New("packet id is not found")
+	ErrSessionClientsExceedLimit                 = errors.New("number of clients exceeds the limit")
+	ErrSessionListenerConnectionsExceedLimit     = errors.New("connections of listener exceed the limit")
+	ErrSessionIPConnectionsExceedLimit           = errors.New("connections of IP exceed the limit")
+	ErrSessionUsernameConnectionsExceedLimit     = errors.New("connections of username exceed the limit")
+	ErrSessionConnectionRateExceedsLimit         = errors.New("connection rate exceeds the limit")
 	ErrSessionClientIDInvalid                    = errors.New("client ID is invalid")
 	ErrSessionProtocolVersionInvalid             = errors.New("protocol version is invalid")
 	ErrSessionUsernameNotSet                     = errors.New("username is not set")
 	ErrSessionUsernameNotPermitted               = errors.New("username or password is not permitted")
-	ErrSessionCertificateCommonNameNotFound      = errors.New("certificate common name is not found")
-	ErrSessionCertificateCommonNameNotPermitted  = errors.New("certificate common name is not permitted")
+	ErrSessionTokenInvalid                       = errors.New("token is invalid")
+	ErrSessionTokenExpired                       = errors.New("token is expired")
+	ErrSessionCertificateIdentityNotFound        = errors.New("certificate identity is not found")
+	ErrSessionCertificateIdentityNotPermitted    = errors.New("certificate identity is not permitted")
+	ErrSessionPeerCredentialsNotPermitted        = errors.New("peer credentials are not permitted")
+	ErrSessionClientIDNotMatchCertificate        = errors.New("client ID does not match certificate identity")
+	ErrSessionOwnerNotMatch                      = errors.New("session is owned by another identity")
+	ErrSessionClientIDInUse                      = errors.New("client ID is in use by another client")
+	ErrSessionClientIDBanned                     = errors.New("client ID is banned temporarily for flapping")
+	ErrSessionClientBanned                       = errors.New("client is banned")
+	ErrSessionBanInvalid                         = errors.New("ban is invalid")
+	ErrSessionBanNotFound                        = errors.New("ban is not found")
+	ErrSessionBanNotDeletable                    = errors.New("ban is static and not deletable")
 	ErrSessionMessageQosNotSupported             = errors.New("message QOS is not supported")
+	ErrSessionMessageQosNotPermitted             = errors.New("message QOS exceeds the max limit")
 	ErrSessionMessageTopicInvalid                = errors.New("message topic is invalid")
+	ErrSessionTopicLengthExceedsLimit            = errors.New("topic length exceeds the max limit")
+	ErrSessionTopicLevelsExceedLimit             = errors.New("topic levels exceed the max limit")
+	ErrSessionTopicLeadingWildcardNotPermitted   = errors.New("topic filter starting with # is not permitted")
+	ErrSessionSubscriptionsExceedLimit           = errors.New("subscriptions exceed the max limit")
 	ErrSessionMessageTopicNotPermitted           = errors.New("message topic is not permitted")
 	ErrSessionMessagePayloadSizeExceedsLimit     = errors.New("message payload exceeds the max limit")
+	ErrSessionMessageRateExceedsLimit            = errors.New("message rate exceeds the limit")
 	ErrSessionWillMessageQosNotSupported         = errors.New("will QoS is not supported")
 	ErrSessionWillMessageTopicInvalid            = errors.New("will topic is invalid")
+	ErrSessionWillMessageNotPermitted            = errors.New("will message is not permitted")
 	ErrSessionWillMessageTopicNotPermitted       = errors.New("will topic is not permitted")
 	ErrSessionWillMessagePayloadSizeExceedsLimit = errors.New("will message payload exceeds the max limit")
 	ErrSessionSubscribePayloadEmpty              = errors.New("subscribe payload can't be empty")
 	ErrSessionManagerClosed                      = errors.New("manager has closed")
+	ErrSessionDelayedMessageDelayExceedsLimit    = errors.New("delayed message delay exceeds the max limit")
+	ErrSessionDelayedMessagePendingExceedsLimit  = errors.New("delayed messages pending exceed the max limit")
+	ErrSessionDelayedMessageNotFound             = errors.New("delayed message is not found")
+	ErrSessionRetainedMessageNotPermitted        = errors.New("retained message is not permitted")
+	ErrSessionRetainedMessageTopicNotPermitted   = errors.New("retained message topic is not permitted")
+	ErrSessionRetainedMessageCountExceedsLimit   = errors.New("retained messages count exceeds the max limit")
+	ErrSessionRetainedMessageSizeExceedsLimit    = errors.New("retained messages size exceeds the max limit")
+)
+
+// the errors of certificate common name are kept for compatibility, since the identity isn't only got from common name
+var (
+	// Deprecated: use ErrSessionCertificateIdentityNotFound instead
+	ErrSessionCertificateCommonNameNotFound = ErrSessionCertificateIdentityNotFound
+	// Deprecated: use ErrSessionCertificateIdentityNotPermitted instead
+	ErrSessionCertificateCommonNameNotPermitted = ErrSessionCertificateIdentityNotPermitted
 )
 
 // Manager the manager of sessions
@@ -49,22 +89,48 @@ type Manager struct {
 	checker       *mqtt.TopicChecker
 	exch          *exchange.Exchange
 	auth          *Authenticator
+	anonymous     *Authorizer
+	limits        map[string]*Limits // the limits of principals
+	admins        map[string]bool    // the usernames of admin principals
+	jwt           *tokenAuthenticator
 	sessionBucket store.KVBucket
-	retainBucket  store.KVBucket
+	retainer      *retainer
+	delayer       *delayer
+	flapping      *flapping
+	guard         *guard
+	limiters      *limiters
+	admission     *admission
+	histories     []*history
+	backlogs      map[string]int // backlogs of sessions at the last check
 	log           *log.Logger
+	tomb          utils.Tomb
 	quit          int32 // if quit != 0, it means manager is closed
 }
 
 // NewManager create a new session manager
 func NewManager(cfg Config) (m *Manager, err error) {
 	m = &Manager{
-		cfg:      cfg,
-		sessions: newSyncMap(),
-		clients:  newSyncMap(),
-		checker:  mqtt.NewTopicChecker(cfg.SysTopics),
-		exch:     exchange.NewExchange(cfg.SysTopics),
-		auth:     NewAuthenticator(cfg.Principals),
-		log:      log.With(log.Any("session", "manager")),
+		cfg:       cfg,
+		sessions:  newSyncMap(),
+		clients:   newSyncMap(),
+		checker:   mqtt.NewTopicChecker(cfg.SysTopics),
+		exch:      exchange.NewExchange(cfg.SysTopics),
+		auth:      NewAuthenticator(cfg.Principals),
+		anonymous: NewAnonymousAuthorizer(cfg.Anonymous),
+		limits:    map[string]*Limits{},
+		admins:    map[string]bool{},
+		flapping:  newFlapping(cfg.Takeover.Flapping),
+		limiters:  newLimiters(cfg.RateLimits),
+		admission: newAdmission(cfg.Admission),
+		log:       log.With(log.Any("session", "manager")),
+	}
+	for _, p := range cfg.Principals {
+		if p.Limits != nil {
+			m.limits[p.Username] = p.Limits
+		}
+		if p.Admin && p.Username != "" {
+			m.admins[p.Username] = true
+		}
 	}
 	m.store, err = store.New(cfg.Persistence.Store)
 	if err != nil {
@@ -78,7 +144,94 @@ func NewManager(cfg Config) (m *Manager, err error) {
 		}
 		return
 	}
-	m.retainBucket, err = m.store.NewKVBucket("#retain")
+	err = checkCertIdentityTemplate(cfg.CertIdentity.Template)
+	if err != nil {
+		_err := m.Close()
+		if _err != nil {
+			m.log.Error("failed to close manager", log.Error(_err))
+		}
+		return
+	}
+	m.jwt, err = newTokenAuthenticator(cfg.JWT)
+	if err != nil {
+		_err := m.Close()
+		if _err != nil {
+			m.log.Error("failed to close manager", log.Error(_err))
+		}
+		return
+	}
+	for _, f := range append(cfg.Retain.Allow, cfg.Retain.Deny...) {
+		if !m.checker.CheckTopic(f, true) {
+			err = errors.Errorf("retain topic filter (%s) invalid", f)
+			_err := m.Close()
+			if _err != nil {
+				m.log.Error("failed to close manager", log.Error(_err))
+			}
+			return
+		}
+	}
+	var retainBucket, auditBucket store.KVBucket
+	retainBucket, err = m.store.NewKVBucket("#retain")
+	if err != nil {
+		_err := m.Close()
+		if _err != nil {
+			m.log.Error("failed to close manager", log.Error(_err))
+		}
+		return
+	}
+	// the bucket name must not be prefixed with "#retain", because buckets are distinguished by key prefix
+	auditBucket, err = m.store.NewKVBucket("#audit")
+	if err != nil {
+		_err := m.Close()
+		if _err != nil {
+			m.log.Error("failed to close manager", log.Error(_err))
+		}
+		return
+	}
+	m.retainer, err = newRetainer(cfg.Retain, retainBucket, auditBucket)
+	if err != nil {
+		_err := m.Close()
+		if _err != nil {
+			m.log.Error("failed to close manager", log.Error(_err))
+		}
+		return
+	}
+	var bansBucket store.KVBucket
+	bansBucket, err = m.store.NewKVBucket("#bans")
+	if err != nil {
+		_err := m.Close()
+		if _err != nil {
+			m.log.Error("failed to close manager", log.Error(_err))
+		}
+		return
+	}
+	m.guard, err = newGuard(cfg.Guard, bansBucket)
+	if err != nil {
+		_err := m.Close()
+		if _err != nil {
+			m.log.Error("failed to close manager", log.Error(_err))
+		}
+		return
+	}
+	var delayedBucket, publisherBucket store.KVBucket
+	delayedBucket, err = m.store.NewKVBucket("#delayed")
+	if err != nil {
+		_err := m.Close()
+		if _err != nil {
+			m.log.Error("failed to close manager", log.Error(_err))
+		}
+		return
+	}
+	// the bucket name must not be prefixed with "#delayed", because buckets are distinguished by key prefix
+	publisherBucket, err = m.store.NewKVBucket("#publisher")
+	if err != nil {
+		_err := m.Close()
+		if _err != nil {
+			m.log.Error("failed to close manager", log.Error(_err))
+		}
+		return
+	}
+	m.delayer, err = newDelayer(cfg.Delayed, delayedBucket, publisherBucket)
 	if err != nil {
 		_err := m.Close()
 		if _err != nil {
@@ -86,6 +239,27 @@ func NewManager(cfg Config) (m *Manager, err error) {
 		}
 		return
 	}
+	for _, hc := range cfg.History {
+		if !m.checker.CheckTopic(hc.Topic, true) {
+			err = errors.Errorf("history topic (%s) invalid", hc.Topic)
+			_err := m.Close()
+			if _err != nil {
+				m.log.Error("failed to close manager", log.Error(_err))
+			}
+			return
+		}
+		var h *history
+		h, err = newHistory(hc, m.store)
+		if err != nil {
+			_err := m.Close()
+			if _err != nil {
+				m.log.Error("failed to close manager", log.Error(_err))
+			}
+			return
+		}
+		m.exch.Bind(hc.Topic, h)
+		m.histories = append(m.histories, h)
+	}
 	var ss []Info
 	// load stored sessions from backend database
 	err = m.sessionBucket.ListKV(func(data []byte) error {
@@ -122,6 +296,19 @@ func NewManager(cfg Config) (m *Manager, err error) {
 
 		m.sessions.store(si.ID, s)
 	}
+	m.tomb.Go(m.delaying)
+	for _, h := range m.histories {
+		h := h
+		m.tomb.Go(func() error {
+			return h.writing(m.tomb.Dying())
+		})
+	}
+	if cfg.SlowConsumer.MaxBacklog > 0 {
+		m.tomb.Go(m.checking)
+	}
+	if cfg.Retain.TTL > 0 {
+		m.tomb.Go(m.sweeping)
+	}
 	m.log.Info("session manager has initialized")
 	return m, nil
 }
@@ -131,6 +318,23 @@ func (m *Manager) addClient(si Info, c *Client) (s *Session, exists bool, err er
 		return s, exists, errors.Trace(err)
 	}
 
+	if m.flapping.banned(si.ID) {
+		return nil, false, ErrSessionClientIDBanned
+	}
+
+	// checks the owner before the old client is kicked off
+	reset, err := m.checkOwner(si)
+	if err != nil {
+		return nil, false, errors.Trace(err)
+	}
+
+	if v, ok := m.clients.load(si.ID); ok {
+		si, err = m.takeover(si, v.(*Client), c)
+		if err != nil {
+			return nil, false, errors.Trace(err)
+		}
+	}
+
 	defer func() {
 		if err != nil {
 			m.clients.delete(si.ID)
@@ -149,7 +353,7 @@ func (m *Manager) addClient(si Info, c *Client) (s *Session, exists bool, err er
 
 	if v, loaded := m.sessions.load(si.ID); loaded {
 		s = v.(*Session)
-		if !s.info.CleanSession {
+		if !s.info.CleanSession && !reset {
 			exists = true
 			err := s.update(si, c.authorize)
 			if err != nil {
@@ -171,6 +375,81 @@ func (m *Manager) addClient(si Info, c *Client) (s *Session, exists bool, err er
 	return
 }
 
+// takeover applies the takeover policy when the client connects with the client ID of the active client,
+// returns the session info used by the new client
+func (m *Manager) takeover(si Info, old, c *Client) (Info, error) {
+	fields := []log.Field{
+		log.Any("id", si.ID),
+		log.Any("policy", m.cfg.Takeover.Policy),
+		log.Any("old", old.conn.RemoteAddr()),
+		log.Any("new", c.conn.RemoteAddr()),
+	}
+	metrics.Add(metricClientTakeovers, 1)
+	if m.flapping.takeover(si.ID) {
+		metrics.Add(metricClientIDsBanned, 1)
+		m.log.Warn("client ID is banned since it is taken over repeatedly", append(fields, log.Any("duration", m.cfg.Takeover.Flapping.BanDuration))...)
+		return si, ErrSessionClientIDBanned
+	}
+	switch m.cfg.Takeover.Policy {
+	case TakeoverReject:
+		metrics.Add(metricClientTakeoversRejected, 1)
+		m.log.Warn("client is rejected since its client ID is in use", fields...)
+		return si, ErrSessionClientIDInUse
+	case TakeoverAllow:
+		m.log.Info("client ID is shared with another client", fields...)
+		// the new client uses a temporary session identified by its own id
+		si.ID = c.id
+		si.CleanSession = true
+		return si, nil
+	default:
+		m.log.Info("client is kicked off by another client with the same client ID", fields...)
+		return si, nil
+	}
+}
+
+// checkTopicLimits checks the length and levels of the topic or topic filter
+func (m *Manager) checkTopicLimits(topic string, filter bool) error {
+	if max := m.cfg.MaxTopicLength; max > 0 && len(topic) > max {
+		return ErrSessionTopicLengthExceedsLimit
+	}
+	if max := m.cfg.MaxTopicLevels; max > 0 && strings.Count(topic, "/")+1 > max {
+		return ErrSessionTopicLevelsExceedLimit
+	}
+	if filter && m.cfg.DenyLeadingWildcard && strings.HasPrefix(topic, "#") {
+		return ErrSessionTopicLeadingWildcardNotPermitted
+	}
+	return nil
+}
+
+// checkOwner checks whether the identity of client owns the session,
+// returns true if the session needs to be reset since it is owned by another identity
+func (m *Manager) checkOwner(si Info) (bool, error) {
+	v, ok := m.sessions.load(si.ID)
+	if !ok {
+		return false, nil
+	}
+	owner := v.(*Session).owner()
+	// the session without owner is claimed by the first client, such as the session stored before upgrade
+	if owner == "" || owner == si.Owner {
+		return false, nil
+	}
+	switch m.cfg.Ownership {
+	case OwnershipRefuse:
+		m.log.Warn(ErrSessionOwnerNotMatch.Error(), log.Any("id", si.ID), log.Any("owner", owner), log.Any("identity", si.Owner))
+		return false, ErrSessionOwnerNotMatch
+	case OwnershipReset:
+		// the session is reset only if its owner is offline, the connected owner is never kicked off
+		if _, ok := m.clients.load(si.ID); ok {
+			m.log.Warn(ErrSessionOwnerNotMatch.Error(), log.Any("id", si.ID), log.Any("owner", owner), log.Any("identity", si.Owner))
+			return false, ErrSessionOwnerNotMatch
+		}
+		m.log.Warn("session is reset since it is owned by another identity", log.Any("id", si.ID), log.Any("owner", owner), log.Any("identity", si.Owner))
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
 func (m *Manager) delClient(clientID string) error {
 	if err := m.checkQuitState(); err != nil {
 		return errors.Trace(err)
@@ -192,12 +471,120 @@ func (m *Manager) delClient(clientID string) error {
 	return nil
 }
 
+// deleteSession closes the client of the session if connected, and discards the session
+func (m *Manager) deleteSession(id string) error {
+	if err := m.checkQuitState(); err != nil {
+		return errors.Trace(err)
+	}
+
+	if v, ok := m.clients.load(id); ok {
+		err := v.(*Client).close()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		m.clients.delete(id)
+	}
+
+	v, ok := m.sessions.load(id)
+	if !ok {
+		return nil
+	}
+	s := v.(*Session)
+	err := s.discard()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	m.cleanSession(s)
+	return nil
+}
+
 func (m *Manager) cleanSession(s *Session) {
 	m.exch.UnbindAll(s)
 	m.sessions.delete(s.info.ID)
 	s.close()
 }
 
+// checking checks slow consumers periodically
+func (m *Manager) checking() error {
+	m.log.Info("session manager starts to check slow consumers", log.Any("interval", m.cfg.SlowConsumer.CheckInterval))
+	defer m.log.Info("session manager has stopped checking slow consumers")
+
+	ticker := time.NewTicker(m.cfg.SlowConsumer.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.checkSlowConsumers()
+		case <-m.tomb.Dying():
+			return nil
+		}
+	}
+}
+
+// checkSlowConsumers logs the connected sessions whose backlog exceeds the limit and is not decreasing
+// since the last check, and disconnects their clients if configured
+func (m *Manager) checkSlowConsumers() {
+	max := m.cfg.SlowConsumer.MaxBacklog
+	backlogs := make(map[string]int)
+	var count int64
+	for _, v := range m.sessions.values() {
+		s := v.(*Session)
+		id := s.ID()
+		c, ok := m.clients.load(id)
+		if !ok {
+			continue
+		}
+		backlog := s.backlog()
+		backlogs[id] = backlog
+		last, ok := m.backlogs[id]
+		if !ok || backlog <= max || backlog < last {
+			continue
+		}
+		count++
+		metrics.Add(metricSlowConsumersDetected, 1)
+		m.log.Warn("session is a slow consumer", log.Any("id", id), log.Any("backlog", backlog), log.Any("max", max))
+		if !m.cfg.SlowConsumer.Disconnect {
+			continue
+		}
+		err := c.(*Client).close()
+		if err != nil {
+			m.log.Error("failed to close slow consumer", log.Any("id", id), log.Error(err))
+			continue
+		}
+		err = m.delClient(id)
+		if err != nil {
+			m.log.Error("failed to del slow consumer from manager", log.Any("id", id), log.Error(err))
+		}
+		delete(backlogs, id)
+		metrics.Add(metricSlowConsumersDisconnected, 1)
+	}
+	m.backlogs = backlogs
+	v := new(expvar.Int)
+	v.Set(count)
+	metrics.Set(metricSlowConsumers, v)
+}
+
+// Disconnect disconnects the clients whose connections match, such as the ones with revoked certificates
+func (m *Manager) Disconnect(match func(conn mqtt.Connection) bool) {
+	for _, v := range m.clients.values() {
+		c := v.(*Client)
+		if !match(c.conn) {
+			continue
+		}
+		id := c.session.ID()
+		m.log.Warn("client is disconnected", log.Any("id", id), log.Any("remote", c.conn.RemoteAddr()))
+		err := c.close()
+		if err != nil {
+			m.log.Error("failed to close client", log.Any("id", id), log.Error(err))
+			continue
+		}
+		err = m.delClient(id)
+		if err != nil {
+			m.log.Error("failed to del client from manager", log.Any("id", id), log.Error(err))
+		}
+	}
+}
+
 func (m *Manager) checkQuitState() error {
 	if atomic.LoadInt32(&m.quit) == 1 {
 		m.log.Error(ErrSessionManagerClosed.Error())
@@ -233,6 +620,12 @@ func (m *Manager) Close() error {
 
 	atomic.AddInt32(&m.quit, -1)
 
+	m.tomb.Kill(nil)
+	err := m.tomb.Wait()
+	if err != nil {
+		m.log.Error("failed to wait tomb goroutines", log.Error(err))
+	}
+
 	for _, s := range m.sessions.empty() {
 		s.(*Session).close()
 	}
@@ -256,32 +649,193 @@ func (m *Manager) Close() error {
 // * retain message operations
 
 func (m *Manager) listRetainedMessages() ([]*mqtt.Message, error) {
-	msgs := make([]*mqtt.Message, 0)
-	err := m.retainBucket.ListKV(func(data []byte) error {
-		if len(data) == 0 {
-			return store.ErrDataNotFound
+	return m.retainer.all()
+}
+
+// searchRetainedMessages gets the retained messages whose topic matches the topic filter
+func (m *Manager) searchRetainedMessages(filter string) ([]*mqtt.Message, error) {
+	return m.retainer.search(filter)
+}
+
+func (m *Manager) retainMessage(msg *mqtt.Message, clientID, username string) error {
+	err := m.retainer.set(msg, clientID, username)
+	switch err {
+	case ErrSessionRetainedMessageTopicNotPermitted,
+		ErrSessionRetainedMessageCountExceedsLimit,
+		ErrSessionRetainedMessageSizeExceedsLimit:
+		// the message is still routed but not retained
+		m.log.Warn("message is not retained", log.Any("topic", msg.Context.Topic), log.Any("clientid", clientID), log.Error(err))
+		metrics.Add(metricRetainedMessagesRejected, 1)
+		return nil
+	}
+	return errors.Trace(err)
+}
+
+func (m *Manager) unretainMessage(topic string) error {
+	return m.retainer.del(topic)
+}
+
+// ListRetainedMessages lists the audits of all retained messages
+func (m *Manager) ListRetainedMessages() []RetainedMessage {
+	return m.retainer.list()
+}
+
+func (m *Manager) sweeping() error {
+	t := time.NewTicker(m.cfg.Retain.SweepInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			n, err := m.retainer.sweep()
+			if err != nil {
+				m.log.Error("failed to sweep expired retained messages", log.Error(err))
+			}
+			if n > 0 {
+				m.log.Debug("expired retained messages are removed", log.Any("count", n))
+				metrics.Add(metricRetainedMessagesExpired, int64(n))
+			}
+		case <-m.tomb.Dying():
+			return nil
 		}
-		v := new(mqtt.Message)
-		if err := proto.Unmarshal(data, v); err != nil {
-			return errors.Trace(err)
+	}
+}
+
+// * history message operations
+
+// replayMessages reads the logged messages since the given time whose topic matches the filter
+func (m *Manager) replayMessages(filter string, since time.Time) []*mqtt.Message {
+	var msgs []*mqtt.Message
+	for _, h := range m.histories {
+		hmsgs, err := h.read(since, filter)
+		if err != nil {
+			m.log.Error("failed to read history messages", log.Any("history", h.ID()), log.Error(err))
+			continue
 		}
-		msgs = append(msgs, v)
-		return nil
-	})
+		// the message matching the topic filters of more than one history is replayed once
+		msgs = mergeHistories(msgs, hmsgs)
+	}
+	for _, msg := range msgs {
+		msg.Context.TS = 0
+	}
+	return msgs
+}
+
+// * ban operations
+
+// ListBans lists all bans, including the static ones and the ones added at runtime
+func (m *Manager) ListBans() []Ban {
+	return m.guard.list()
+}
+
+// AddBan adds a ban at runtime and disconnects the banned clients
+func (m *Manager) AddBan(b Ban) error {
+	r, err := m.guard.add(b)
 	if err != nil {
-		return nil, errors.Trace(err)
+		return err
+	}
+	m.log.Info("ban is added", log.Any("type", b.Type), log.Any("value", b.Value))
+	for _, v := range m.clients.values() {
+		c := v.(*Client)
+		if c.session == nil || !r.match(remoteIP(c.conn), c.session.ID(), c.username) {
+			continue
+		}
+		id := c.session.ID()
+		m.log.Warn("client is disconnected since it is banned", log.Any("id", id), log.Any("remote", c.conn.RemoteAddr()))
+		err = c.close()
+		if err != nil {
+			m.log.Error("failed to close client", log.Any("id", id), log.Error(err))
+			continue
+		}
+		err = m.delClient(id)
+		if err != nil {
+			m.log.Error("failed to del client from manager", log.Any("id", id), log.Error(err))
+		}
 	}
-	return msgs, nil
+	return nil
 }
 
-func (m *Manager) retainMessage(msg *mqtt.Message) error {
-	data, err := proto.Marshal(msg)
+// DelBan deletes a ban added at runtime
+func (m *Manager) DelBan(b Ban) error {
+	err := m.guard.del(b)
+	if err != nil {
+		return err
+	}
+	m.log.Info("ban is deleted", log.Any("type", b.Type), log.Any("value", b.Value))
+	return nil
+}
+
+// * delayed message operations
+
+// ListDelayedMessages lists all pending delayed messages ordered by due time
+func (m *Manager) ListDelayedMessages() []DelayedMessage {
+	return m.delayer.list()
+}
+
+// CancelDelayedMessage cancels a pending delayed message by id
+func (m *Manager) CancelDelayedMessage(id uint64) error {
+	return m.delayer.cancel(id)
+}
+
+func (m *Manager) delayMessage(msg *mqtt.Message, delay time.Duration, clientID, username string) error {
+	id, err := m.delayer.delay(msg, delay, clientID, username)
 	if err != nil {
 		return errors.Trace(err)
 	}
-	return m.retainBucket.SetKV([]byte(msg.Context.Topic), data)
+	m.log.Debug("message is delayed", log.Any("id", id), log.Any("topic", msg.Context.Topic), log.Any("delay", delay))
+	return nil
 }
 
-func (m *Manager) unretainMessage(topic string) error {
-	return m.retainBucket.DelKV([]byte(topic))
+// delaying routes delayed messages when due
+func (m *Manager) delaying() error {
+	m.log.Info("session manager starts to route delayed messages")
+	defer m.log.Info("session manager has stopped routing delayed messages")
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if d, ok := m.delayer.next(); ok {
+			timer.Reset(d)
+		} else {
+			timer.Reset(time.Hour)
+		}
+		select {
+		case <-timer.C:
+			m.routeDelayedMessages()
+		case <-m.delayer.wakeup:
+		case <-m.tomb.Dying():
+			return nil
+		}
+	}
+}
+
+func (m *Manager) routeDelayedMessages() {
+	msgs, err := m.delayer.due()
+	if err != nil {
+		m.log.Error("failed to read delayed messages", log.Error(err))
+	}
+	for _, due := range msgs {
+		msg := due.msg
+		id := msg.Context.ID
+		msg.Context.ID = 0
+		msg.Context.TS = 0
+		if msg.Context.Flags&0x1 == 0x1 {
+			err = m.retainMessage(msg, due.clientID, due.username)
+			if err != nil {
+				m.log.Error("failed to retain delayed message", log.Any("topic", msg.Context.Topic), log.Error(err))
+			}
+			// change to normal message before exchange
+			msg.Context.Flags &^= 0x1
+		}
+		m.exch.Route(msg, nil)
+		err = m.delayer.done(id)
+		if err != nil {
+			m.log.Error("failed to delete delayed message", log.Any("id", id), log.Error(err))
+		}
+	}
 }
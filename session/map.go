@@ -41,6 +41,16 @@ func (m *syncmap) empty() []interface{} {
 	return res
 }
 
+func (m *syncmap) values() []interface{} {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+	res := make([]interface{}, 0, len(m.data))
+	for _, v := range m.data {
+		res = append(res, v)
+	}
+	return res
+}
+
 func (m *syncmap) load(k string) (interface{}, bool) {
 	m.mut.RLock()
 	defer m.mut.RUnlock()
@@ -0,0 +1,27 @@
+package session
+
+import (
+	"expvar"
+)
+
+// metrics of sessions, exposed by expvar at /debug/vars
+var metrics = expvar.NewMap("broker")
+
+// all metric names
+const (
+	metricSlowConsumers             = "slowConsumers"
+	metricSlowConsumersDetected     = "slowConsumersDetected"
+	metricSlowConsumersDisconnected = "slowConsumersDisconnected"
+	metricRetainedMessagesRejected  = "retainedMessagesRejected"
+	metricRetainedMessagesExpired   = "retainedMessagesExpired"
+	metricClientTakeovers           = "clientTakeovers"
+	metricClientTakeoversRejected   = "clientTakeoversRejected"
+	metricClientIDsBanned           = "clientIDsBanned"
+	metricAuthFailures              = "authFailures"
+	metricAuthBans                  = "authBans"
+	metricConnectionsRejected       = "connectionsRejected"
+	metricRateLimitDelayed          = "rateLimitDelayed"
+	metricRateLimitDropped          = "rateLimitDropped"
+	metricRateLimitDisconnected     = "rateLimitDisconnected"
+	metricHistoryDropped            = "historyDropped"
+)
@@ -11,6 +11,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/baetyl/baetyl-go/v2/errors"
 	"github.com/baetyl/baetyl-go/v2/log"
 	"github.com/baetyl/baetyl-go/v2/mqtt"
 	"github.com/baetyl/baetyl-go/v2/utils"
@@ -36,6 +37,8 @@ session:
   - $baidu
   maxClients: 3
   resendInterval: 1s
+jwt:
+  secret: s1
 
 principals:
 - username: u1
@@ -57,6 +60,7 @@ principals:
     permit: [test, talks]
 - username: u4
   password: p4
+  admin: true
   permissions:
   - action: sub
     permit: [test, talks, '$baidu/iot', '$link/data']
@@ -69,6 +73,214 @@ session:
     queue:
       expireTime: 2s
       cleanInterval: 1s
+`
+	testConfDelayed = `
+session:
+  delayed:
+    maxDelay: 1h
+    maxPending: 2
+`
+	testConfHistory = `
+session:
+  history:
+  - topic: test/#
+    maxCount: 2
+`
+	testConfForceClientID = `
+session:
+  certIdentity:
+    forceClientID: true
+principals:
+- username: u1
+  password: p1
+`
+	testConfHistories = `
+session:
+  history:
+  - topic: sensors/#
+  - topic: sensors/temp
+`
+	testConfDeny = `
+principals:
+- username: u1
+  password: p1
+  permissions:
+  - action: pubsub
+    permit: ["plant/#"]
+  - action: sub
+    effect: deny
+    permit: ["plant/secret/#"]
+`
+	testConfReplayMany = `
+session:
+  maxInflightQOS0Messages: 5
+  history:
+  - topic: many/#
+`
+	testConfRetain = `
+session:
+  retain:
+    ttl: 1s
+    maxCount: 3
+    maxSize: 10
+    sweepInterval: 1h
+    allow:
+    - test/#
+    deny:
+    - test/private/#
+`
+	testConfVariables = `
+principals:
+- username: u1
+  password: p1
+  permissions:
+  - action: pub
+    permit: ["devices/${clientid}/#"]
+  - action: sub
+    permit: ["users/${username}/#"]
+`
+	testConfAnonymous = `
+anonymous:
+  permissions:
+  - action: sub
+    permit: ["telemetry/#"]
+  - action: pub
+    permit: ["clients/${clientid}/#", "users/${username}/#"]
+`
+	testConfOwnership = `
+session:
+  ownership: %s
+principals:
+- username: u1
+  password: p1
+  permissions:
+  - action: pubsub
+    permit: ["test"]
+- username: u2
+  password: p2
+  permissions:
+  - action: pubsub
+    permit: ["test"]
+`
+	testConfTakeover = `
+session:
+  takeover:
+    policy: %s
+    flapping:
+      maxTakeovers: 2
+      window: 1m
+      banDuration: 1s
+`
+	testConfGuard = `
+session:
+  guard:
+    maxFailures: 2
+    delay: 10ms
+    maxDelay: 15ms
+    banDuration: 1s
+    bans:
+    - type: clientid
+      value: banned
+    - type: ip
+      value: 10.0.0.0/8
+principals:
+- username: u1
+  password: p1
+  permissions:
+  - action: pubsub
+    permit: ["test"]
+`
+	testConfJWT = `
+jwt:
+  secret: s1
+  jwks: %s
+  audience: broker
+principals:
+- username: u1
+  password: p1
+  permissions:
+  - action: pubsub
+    permit: ["test"]
+- username: u2
+  password: p.2.x
+  permissions:
+  - action: pubsub
+    permit: ["test"]
+- username: t5
+  password: p5
+  limits:
+    maxQOS: 0
+`
+	testConfRateLimits = `
+session:
+  rateLimits:
+    client:
+      messages: 2
+      action: %s
+    username:
+      messages: 100
+principals:
+- username: u1
+  password: p1
+  permissions:
+  - action: pubsub
+    permit: ["#"]
+`
+	testConfAdmission = `
+session:
+  admission:
+    maxConnectionsPerIP: 2
+    maxConnectionsPerUsername: 1
+    acceptRate: 1
+    acceptBurst: 3
+    connectTimeout: 100ms
+principals:
+- username: u1
+  password: p1
+  permissions:
+  - action: pubsub
+    permit: ["test"]
+`
+	testConfTopicLimits = `
+session:
+  maxSubscriptions: 2
+  maxTopicLength: 10
+  maxTopicLevels: 3
+  denyLeadingWildcard: true
+`
+	testConfMessageLimits = `
+session:
+  maxMessagePayloadSize: 4
+principals:
+- username: device
+  password: p1
+  permissions:
+  - action: pubsub
+    permit: ["#"]
+  limits:
+    maxQOS: 0
+    retain: false
+    will: false
+    topics:
+    - topic: upload/#
+      maxMessagePayloadSize: 8
+      maxQOS: 1
+      retain: true
+      will: true
+- username: service
+  password: p2
+  permissions:
+  - action: pubsub
+    permit: ["#"]
+`
+	testConfSlowConsumer = `
+session:
+  resendInterval: 100s
+  maxInflightQOS1Messages: 1
+  slowConsumer:
+    maxBacklog: 2
+    checkInterval: 100ms
+    disconnect: true
 `
 )
 
@@ -176,11 +388,13 @@ func (b *mockBroker) closeAndClean() {
 // * mqtt mock
 
 type mockConn struct {
-	t      *testing.T
-	c2s    chan mqtt.Packet
-	s2c    chan mqtt.Packet
-	err    chan error
-	closed bool
+	t       *testing.T
+	c2s     chan mqtt.Packet
+	s2c     chan mqtt.Packet
+	err     chan error
+	remote  net.Addr
+	timeout time.Duration
+	closed  bool
 	sync.RWMutex
 }
 
@@ -203,11 +417,19 @@ func (c *mockConn) Send(pkt mqtt.Packet, _ bool) error {
 }
 
 func (c *mockConn) Receive() (mqtt.Packet, error) {
+	var timeout <-chan time.Time
+	c.RLock()
+	if c.timeout > 0 {
+		timeout = time.After(c.timeout)
+	}
+	c.RUnlock()
 	select {
 	case pkt := <-c.c2s:
 		return pkt, nil
 	case err := <-c.err:
 		return nil, err
+	case <-timeout:
+		return nil, errors.New("read timeout")
 	}
 }
 
@@ -219,11 +441,15 @@ func (c *mockConn) Close() error {
 	return nil
 }
 
-func (c *mockConn) SetMaxWriteDelay(t time.Duration)     {}
-func (c *mockConn) SetReadLimit(limit int64)             {}
-func (c *mockConn) SetReadTimeout(timeout time.Duration) {}
-func (c *mockConn) LocalAddr() net.Addr                  { return nil }
-func (c *mockConn) RemoteAddr() net.Addr                 { return nil }
+func (c *mockConn) SetMaxWriteDelay(t time.Duration) {}
+func (c *mockConn) SetReadLimit(limit int64)         {}
+func (c *mockConn) SetReadTimeout(timeout time.Duration) {
+	c.Lock()
+	c.timeout = timeout
+	c.Unlock()
+}
+func (c *mockConn) LocalAddr() net.Addr  { return nil }
+func (c *mockConn) RemoteAddr() net.Addr { return c.remote }
 
 func (c *mockConn) sendC2S(pkt mqtt.Packet) error {
 	select {
@@ -281,6 +507,16 @@ type mockStream struct {
 	sync.RWMutex
 }
 
+func newMockStream(t *testing.T, md metadata.MD) *mockStream {
+	return &mockStream{
+		t:   t,
+		md:  md,
+		c2s: make(chan *mqtt.Message, 20),
+		s2c: make(chan *mqtt.Message, 20),
+		err: make(chan error, 10),
+	}
+}
+
 func (c *mockStream) Send(msg *mqtt.Message) error {
 	select {
 	case c.s2c <- msg:
@@ -2,6 +2,7 @@ package session
 
 import (
 	"io"
+	"net"
 	"regexp"
 	"strings"
 	"sync"
@@ -24,6 +25,16 @@ type Client struct {
 	manager   *Manager
 	session   *Session
 	auth      *Authorizer
+	limits    *Limits // the limits of the principal
+	clientID  string
+	username  string
+	admin     bool            // true if authenticated against an admin principal, the token never grants admin
+	listener  common.ConnInfo // the listener accepting the connection
+	token     string          // the token got from the websocket request
+	limiters  []*limiter
+	rejected  error    // the reason to reject the client when connecting
+	slots     []string // the admission slots taken by the client
+	released  bool
 	conn      mqtt.Connection
 	log       *log.Logger
 	tomb      utils.Tomb
@@ -37,26 +48,36 @@ type Client struct {
 
 // Handle the connection handler to create a new MQTT client
 func (m *Manager) Handle(conn mqtt.Connection, anonymous bool) {
+	m.HandleListener(conn, common.ConnInfo{Anonymous: anonymous})
+}
+
+// HandleListener the connection handler to create a new MQTT client connected to the listener
+func (m *Manager) HandleListener(conn mqtt.Connection, info common.ConnInfo) {
+	c := m.newClient(conn, info)
+	c.tomb.Go(c.receiving)
+}
+
+// newClient creates the client of the connection, the client starts when its receiving goroutine is launched
+func (m *Manager) newClient(conn mqtt.Connection, info common.ConnInfo) *Client {
 	id := strings.ReplaceAll(uuid.Generate().String(), "-", "")
 	c := &Client{
 		id:        id,
 		interval:  m.cfg.ResendInterval,
 		manager:   m,
 		conn:      conn,
-		anonymous: anonymous,
+		anonymous: info.Anonymous,
+		listener:  info,
+		token:     info.Token,
 		log:       log.With(log.Any("type", "mqtt"), log.Any("id", id)),
 	}
 
-	max := m.cfg.MaxClients
-	if max > 0 && m.clients.count() >= max {
-		c.log.Error("number of clients exceeds the limit", log.Any("max", max))
-		err := conn.Close()
-		if err != nil {
-			c.log.Error("failed to close conn", log.Error(err))
-		}
-		return
+	// the client exceeding the limits is rejected after receiving the connect packet
+	if max := m.cfg.MaxClients; max > 0 && m.clients.count() >= max {
+		c.rejected = ErrSessionClientsExceedLimit
+	} else {
+		c.slots, c.rejected = m.admission.admit(remoteIP(conn), info)
 	}
-	c.tomb.Go(c.receiving)
+	return c
 }
 
 func (c *Client) setSession(sid string, s *Session) {
@@ -80,6 +101,7 @@ func (c *Client) close() error {
 	var err error
 	c.once.Do(func() {
 		err = c.conn.Close()
+		c.release()
 	})
 	if err != nil {
 		c.log.Error("failed to close conn", log.Error(err))
@@ -116,6 +138,7 @@ func (c *Client) die(msg string, err error) {
 		if err != nil {
 			c.log.Error("failed to close conn", log.Error(err))
 		}
+		c.release()
 	})
 
 	if c.session != nil {
@@ -126,6 +149,15 @@ func (c *Client) die(msg string, err error) {
 	}
 }
 
+// certIdentity gets the identity of client certificate
+func (c *Client) certIdentity() (string, bool) {
+	certs := common.GetPeerCertificates(c.conn)
+	if len(certs) == 0 {
+		return "", false
+	}
+	return getCertIdentity(c.manager.cfg.CertIdentity.Template, certs[0])
+}
+
 func (c *Client) authorize(action, topic string) bool {
 	return c.auth == nil || c.auth.Authorize(action, topic)
 }
@@ -150,35 +182,63 @@ func (c *Client) sendWillMessage() {
 	c.manager.exch.Route(msg, c.callback)
 }
 
+// messageLimits resolves the limits of the message published to the topic by the client
+func (c *Client) messageLimits(topic string) messageLimits {
+	global := messageLimits{
+		maxPayloadSize: int(c.manager.cfg.MaxMessagePayloadSize),
+		maxQOS:         1,
+		retain:         true,
+		will:           true,
+	}
+	return c.limits.resolve(global, topic)
+}
+
 func (c *Client) retainMessage(msg *mqtt.Message) error {
+	if !c.messageLimits(msg.Context.Topic).retain {
+		// the message is still routed but not retained
+		c.log.Warn("message is not retained", log.Any("topic", msg.Context.Topic), log.Error(ErrSessionRetainedMessageNotPermitted))
+		metrics.Add(metricRetainedMessagesRejected, 1)
+		return nil
+	}
 	if len(msg.Content) == 0 {
 		return c.manager.unretainMessage(msg.Context.Topic)
 	}
-	return c.manager.retainMessage(msg)
+	return c.manager.retainMessage(msg, c.session.ID(), c.username)
 }
 
-// SendRetainMessage sends retain message
-func (c *Client) sendRetainMessage() error {
-	if c.session == nil {
+// sendRetainMessage sends the retained messages matching the new subscriptions
+func (c *Client) sendRetainMessage(subs []mqtt.Subscription) error {
+	if c.session == nil || len(subs) == 0 {
 		return nil
 	}
-	msgs, err := c.manager.listRetainedMessages()
-	if err != nil || len(msgs) == 0 {
-		return errors.Trace(err)
-	}
-	// TODO: improve
-	for _, msg := range msgs {
-		if ok, qos := c.session.matchQOS(msg.Context.Topic); ok {
-			if msg.Context.QOS > qos {
-				msg.Context.QOS = qos
+	var msgs []*mqtt.Message
+	qoss := map[string]uint32{}
+	for _, sub := range subs {
+		matched, err := c.manager.searchRetainedMessages(sub.Topic)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		for _, msg := range matched {
+			qos, ok := qoss[msg.Context.Topic]
+			if !ok {
+				msgs = append(msgs, msg)
 			}
-			e := common.NewEvent(msg, 0, nil)
-			err = c.session.Push(e)
-			if err != nil {
-				return errors.Trace(err)
+			// the retained message is sent once with the maximum QoS of the matched subscriptions
+			if !ok || uint32(sub.QOS) > qos {
+				qoss[msg.Context.Topic] = uint32(sub.QOS)
 			}
 		}
 	}
+	for _, msg := range msgs {
+		if qos := qoss[msg.Context.Topic]; msg.Context.QOS > qos {
+			msg.Context.QOS = qos
+		}
+		e := common.NewEvent(msg, 0, nil)
+		err := c.session.Push(e)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
 	return nil
 }
 
@@ -188,6 +248,10 @@ func (c *Client) receiving() error {
 	c.log.Info("client starts to receive messages")
 	defer c.log.Info("client has stopped receiving messages")
 
+	if timeout := c.manager.cfg.Admission.ConnectTimeout; c.rejected != nil && timeout > 0 {
+		// the connection exceeding the limits is closed if it does not send the connect packet in time
+		c.conn.SetReadTimeout(timeout)
+	}
 	pkt, err := c.conn.Receive()
 	if err != nil {
 		c.die("failed to receive packet at first time", err)
@@ -256,97 +320,191 @@ func (c *Client) receiving() error {
 func (c *Client) onConnect(p *mqtt.Connect) error {
 	if p.ClientID == "" {
 		if p.CleanSession == false {
-			err := c.sendConnack(mqtt.IdentifierRejected, false)
-			if err != nil {
-				c.log.Error("faile to sen connack", log.Error(err))
-			}
-			return ErrConnectionRefuse
+			return c.reject(mqtt.IdentifierRejected, ErrConnectionRefuse)
 		}
 		p.ClientID = c.id
 	}
 
+	c.clientID = p.ClientID
+	c.username = p.Username
 	si := Info{
 		ID:           p.ClientID,
 		CleanSession: p.CleanSession,
 	}
 
+	if c.rejected != nil {
+		return c.reject(mqtt.ServerUnavailable, c.rejected)
+	}
+
 	if p.Version != mqtt.Version31 && p.Version != mqtt.Version311 {
-		err := c.sendConnack(mqtt.InvalidProtocolVersion, false)
-		if err != nil {
-			c.log.Error("faile to sen connack", log.Error(err))
-		}
-		return ErrSessionProtocolVersionInvalid
+		return c.reject(mqtt.InvalidProtocolVersion, ErrSessionProtocolVersionInvalid)
 	}
 
 	if !checkClientID(si.ID) {
-		err := c.sendConnack(mqtt.IdentifierRejected, false)
-		if err != nil {
-			c.log.Error("faile to sen connack", log.Error(err))
-		}
-		return ErrSessionClientIDInvalid
+		return c.reject(mqtt.IdentifierRejected, ErrSessionClientIDInvalid)
 	}
 
-	if !c.anonymous && c.manager.auth != nil {
-		if p.Password != "" {
+	if p.Password == "" && c.token != "" {
+		// the token got from the websocket request is used as the password
+		p.Password = c.token
+	}
+
+	ip := remoteIP(c.conn)
+	if c.manager.guard.banned(ip, si.ID, p.Username) {
+		return c.reject(mqtt.NotAuthorized, ErrSessionClientBanned)
+	}
+
+	authenticated := !c.anonymous && (c.manager.auth != nil || c.manager.jwt != nil)
+	var expires time.Time
+	if authenticated {
+		var tokenAuth *Authorizer
+		var tokenUsername string
+		if p.Password != "" && c.manager.jwt != nil && isToken(p.Password) {
+			var err error
+			tokenAuth, tokenUsername, expires, err = c.manager.jwt.authenticate(p.Password)
+			// the password which looks like a JWT but can't be parsed is verified as the password of account
+			if err != nil && (!isTokenMalformed(err) || c.manager.auth == nil) {
+				c.log.Warn("failed to verify token", log.Error(err))
+				return c.authFailed(ip, p.Username, ErrSessionTokenInvalid)
+			}
+		}
+		if tokenAuth != nil {
+			// token authentication, the username is got from the claims
+			if tokenUsername != p.Username && c.manager.guard.banned(ip, "", tokenUsername) {
+				return c.reject(mqtt.NotAuthorized, ErrSessionClientBanned)
+			}
+			c.auth, c.username = tokenAuth, tokenUsername
+			c.limits = c.manager.limits[tokenUsername]
+		} else if p.Password != "" {
 			// username/password authentication
 			if p.Username == "" {
-				err := c.sendConnack(mqtt.BadUsernameOrPassword, false)
-				if err != nil {
-					c.log.Error("faile to sen connack", log.Error(err))
-				}
-				return ErrSessionUsernameNotSet
+				return c.reject(mqtt.BadUsernameOrPassword, ErrSessionUsernameNotSet)
+			}
+			if c.manager.auth != nil {
+				c.auth = c.manager.auth.AuthenticateAccount(p.Username, p.Password)
 			}
-			c.auth = c.manager.auth.AuthenticateAccount(p.Username, p.Password)
 			if c.auth == nil {
-				err := c.sendConnack(mqtt.BadUsernameOrPassword, false)
-				if err != nil {
-					c.log.Error("faile to sen connack", log.Error(err))
-				}
-				return ErrSessionUsernameNotPermitted
+				return c.authFailed(ip, p.Username, ErrSessionUsernameNotPermitted)
 			}
+			c.limits = c.manager.limits[p.Username]
+			c.admin = c.manager.admins[p.Username]
+		} else if uid, gid, ok := common.GetPeerCredentials(c.conn); ok {
+			// peer credentials authentication of unix socket, the username is got from the matched principal
+			var username string
+			if c.manager.auth != nil {
+				username, c.auth = c.manager.auth.AuthenticatePeer(uid, gid)
+			}
+			if c.auth == nil {
+				c.log.Warn("peer credentials are not permitted", log.Any("uid", uid), log.Any("gid", gid))
+				return c.authFailed(ip, p.Username, ErrSessionPeerCredentialsNotPermitted)
+			}
+			if username != p.Username && c.manager.guard.banned(ip, "", username) {
+				return c.reject(mqtt.NotAuthorized, ErrSessionClientBanned)
+			}
+			c.username = username
+			c.limits = c.manager.limits[username]
+			c.admin = c.manager.admins[username]
 		} else {
-			if cn, ok := mqtt.GetTLSCommonName(c.conn); ok {
+			if identity, ok := c.certIdentity(); ok {
 				// if it is bidirectional authentication, will use certificate authentication
-				c.auth = c.manager.auth.AuthenticateCertificate(cn)
+				if c.manager.auth != nil {
+					c.auth = c.manager.auth.AuthenticateCertificate(identity)
+				}
 				if c.auth == nil {
-					err := c.sendConnack(mqtt.BadUsernameOrPassword, false)
-					if err != nil {
-						c.log.Error("faile to sen connack", log.Error(err))
-					}
-					return ErrSessionCertificateCommonNameNotPermitted
+					return c.authFailed(ip, identity, ErrSessionCertificateIdentityNotPermitted)
 				}
-			} else {
-				err := c.sendConnack(mqtt.BadUsernameOrPassword, false)
-				if err != nil {
-					c.log.Error("faile to sen connack", log.Error(err))
+				if identity != p.Username && c.manager.guard.banned(ip, "", identity) {
+					return c.reject(mqtt.NotAuthorized, ErrSessionClientBanned)
 				}
-				return ErrSessionCertificateCommonNameNotFound
+				c.username = identity
+				c.limits = c.manager.limits[identity]
+				c.admin = c.manager.admins[identity]
+			} else {
+				return c.reject(mqtt.BadUsernameOrPassword, ErrSessionCertificateIdentityNotFound)
 			}
 		}
+		c.manager.guard.succeed(ip, c.username)
 	}
 
-	if p.Will != nil {
-		if len(p.Will.Payload) > int(c.manager.cfg.MaxMessagePayloadSize) {
-			return ErrSessionWillMessagePayloadSizeExceedsLimit
+	if c.anonymous {
+		c.auth = c.manager.anonymous
+		if c.manager.cfg.Anonymous != nil {
+			c.limits = c.manager.cfg.Anonymous.Limits
 		}
+	}
+
+	if c.manager.cfg.CertIdentity.ForceClientID {
+		identity, ok := c.certIdentity()
+		if !ok {
+			// the client ID can't be verified without certificate
+			return c.reject(mqtt.IdentifierRejected, ErrSessionCertificateIdentityNotFound)
+		}
+		if si.ID != identity {
+			if si.ID != c.id || !checkClientID(identity) {
+				return c.reject(mqtt.IdentifierRejected, ErrSessionClientIDNotMatchCertificate)
+			}
+			// the client ID is not set by client, uses the certificate identity instead
+			si.ID = identity
+		}
+	}
+	if c.auth != nil {
+		username := c.username
+		if c.anonymous {
+			// the username of anonymous client is not authenticated
+			username = ""
+		}
+		c.auth = c.auth.Resolve(si.ID, username)
+	}
+
+	if p.Will != nil {
 		if p.Will.QOS > 1 {
 			return ErrSessionWillMessageQosNotSupported
 		}
 		if !c.manager.checker.CheckTopic(p.Will.Topic, false) {
 			return ErrSessionWillMessageTopicInvalid
 		}
+		if err := c.manager.checkTopicLimits(p.Will.Topic, false); err != nil {
+			return err
+		}
+		limits := c.messageLimits(p.Will.Topic)
+		if !limits.will {
+			return c.reject(mqtt.NotAuthorized, ErrSessionWillMessageNotPermitted)
+		}
+		if len(p.Will.Payload) > limits.maxPayloadSize {
+			return ErrSessionWillMessagePayloadSizeExceedsLimit
+		}
+		if p.Will.QOS > limits.maxQOS {
+			return ErrSessionWillMessageQosNotSupported
+		}
 		if !c.authorize(Publish, p.Will.Topic) {
-			err := c.sendConnack(mqtt.NotAuthorized, false)
-			if err != nil {
-				c.log.Error("faile to sen connack", log.Error(err))
-			}
-			return ErrSessionWillMessageTopicNotPermitted
+			return c.reject(mqtt.NotAuthorized, ErrSessionWillMessageTopicNotPermitted)
 		}
 		si.WillMessage = common.NewMessage(&mqtt.Publish{Message: *p.Will})
 	}
 
+	if authenticated {
+		si.Owner = c.username
+	}
+	c.setLimiters(c.manager.limiters.get(si.Owner, c.listener))
+
+	if err := c.admitUsername(si); err != nil {
+		return c.reject(mqtt.ServerUnavailable, err)
+	}
+
 	s, exists, err := c.manager.addClient(si, c)
 	if err != nil {
+		code := mqtt.ConnackCode(0)
+		switch err {
+		case ErrSessionOwnerNotMatch:
+			code = mqtt.NotAuthorized
+		case ErrSessionClientIDInUse:
+			code = mqtt.IdentifierRejected
+		case ErrSessionClientIDBanned:
+			code = mqtt.ServerUnavailable
+		}
+		if code != mqtt.ConnectionAccepted {
+			return c.reject(code, err)
+		}
 		return errors.Trace(err)
 	}
 
@@ -358,28 +516,188 @@ func (c *Client) onConnect(p *mqtt.Connect) error {
 	if err != nil {
 		return errors.Trace(err)
 	}
-	c.log.Info("client is connected")
+	c.log.Info("client is connected", log.Any("remote", c.conn.RemoteAddr()))
 
 	c.tomb.Go(c.sending, c.resending)
+	if !expires.IsZero() {
+		c.tomb.Go(func() error {
+			return c.expiring(expires)
+		})
+	}
+
+	return nil
+}
+
+// expiring disconnects the client when its token expires
+func (c *Client) expiring(expires time.Time) error {
+	timer := time.NewTimer(time.Until(expires))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		c.die("client is disconnected", ErrSessionTokenExpired)
+		return ErrSessionTokenExpired
+	case <-c.tomb.Dying():
+		return nil
+	}
+}
+
+// admitUsername takes the admission slot of the authenticated username,
+// the client kicking off the old client of the same username and client ID is admitted
+func (c *Client) admitUsername(si Info) error {
+	var replacing bool
+	if v, ok := c.manager.clients.load(si.ID); ok && c.manager.cfg.Takeover.Policy == TakeoverKick {
+		replacing = v.(*Client).username == si.Owner
+	}
+	slot, err := c.manager.admission.admitUsername(si.Owner, replacing)
+	if err != nil || slot == "" {
+		return err
+	}
 
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	if c.released {
+		c.manager.admission.release([]string{slot})
+	} else {
+		c.slots = append(c.slots, slot)
+	}
 	return nil
 }
 
+// setLimiters sets the rate limiters of the client, which are released at once if the client is closed
+func (c *Client) setLimiters(ls []*limiter) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	if c.released {
+		c.manager.limiters.release(ls)
+	} else {
+		c.limiters = ls
+	}
+}
+
+// release releases the admission slots and the rate limiters taken by the client
+func (c *Client) release() {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	c.released = true
+	c.manager.admission.release(c.slots)
+	c.slots = nil
+	c.manager.limiters.release(c.limiters)
+}
+
+// limit applies the rate limits to the message, returns false if the message is not published
+func (c *Client) limit(p *mqtt.Publish) (bool, error) {
+	size := len(p.Message.Payload)
+	for _, l := range c.limiters {
+		for wait := l.limit(size); wait > 0; wait = l.limit(size) {
+			switch {
+			case l.action == RateLimitDisconnect:
+				metrics.Add(metricRateLimitDisconnected, 1)
+				return false, ErrSessionMessageRateExceedsLimit
+			case l.action == RateLimitDrop && p.Message.QOS == 0:
+				metrics.Add(metricRateLimitDropped, 1)
+				c.log.Debug("message is dropped for exceeding the rate limit", log.Any("topic", p.Message.Topic))
+				return false, nil
+			}
+			metrics.Add(metricRateLimitDelayed, 1)
+			select {
+			case <-time.After(wait):
+			case <-c.tomb.Dying():
+				return false, nil
+			}
+			if l.action == RateLimitDelay {
+				// the tokens have been consumed
+				break
+			}
+		}
+	}
+	return true, nil
+}
+
+// authFailed records the authentication failure, then rejects the client after the progressive delay
+func (c *Client) authFailed(ip net.IP, username string, reason error) error {
+	metrics.Add(metricAuthFailures, 1)
+	delay, banned := c.manager.guard.fail(ip, username)
+	if banned {
+		metrics.Add(metricAuthBans, 1)
+		c.log.Warn("client is banned temporarily for authentication failures",
+			log.Any("audit", "ban"),
+			log.Any("ip", ip),
+			log.Any("username", username),
+			log.Any("duration", c.manager.cfg.Guard.BanDuration))
+	}
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-c.tomb.Dying():
+		}
+	}
+	return c.reject(mqtt.BadUsernameOrPassword, reason)
+}
+
+// reject sends the connack with the code to reject the client, and writes the audit log
+func (c *Client) reject(code mqtt.ConnackCode, reason error) error {
+	metrics.Add(metricConnectionsRejected, 1)
+	c.log.Warn("client is rejected",
+		log.Any("audit", "reject"),
+		log.Any("code", code),
+		log.Any("reason", reason.Error()),
+		log.Any("clientid", c.clientID),
+		log.Any("username", c.username),
+		log.Any("remote", c.conn.RemoteAddr()))
+	err := c.sendConnack(code, false)
+	if err != nil {
+		c.log.Error("faile to sen connack", log.Error(err))
+	}
+	return reason
+}
+
 func (c *Client) onPublish(p *mqtt.Publish) error {
 	// TODO: improvement, cache auth result
-	if len(p.Message.Payload) > int(c.manager.cfg.MaxMessagePayloadSize) {
-		return ErrSessionMessagePayloadSizeExceedsLimit
-	}
 	if p.Message.QOS > 1 {
 		return ErrSessionMessageQosNotSupported
 	}
-	if !c.manager.checker.CheckTopic(p.Message.Topic, false) {
+	topic, delay, delayed := parseDelayedTopic(p.Message.Topic)
+	if !c.manager.checker.CheckTopic(topic, false) {
 		return ErrSessionMessageTopicInvalid
 	}
-	if !c.authorize(Publish, p.Message.Topic) {
+	if err := c.manager.checkTopicLimits(topic, false); err != nil {
+		return err
+	}
+	if !c.authorize(Publish, topic) {
 		return ErrSessionMessageTopicNotPermitted
 	}
+	limits := c.messageLimits(topic)
+	if len(p.Message.Payload) > limits.maxPayloadSize {
+		return ErrSessionMessagePayloadSizeExceedsLimit
+	}
+	if p.Message.QOS > limits.maxQOS {
+		return ErrSessionMessageQosNotPermitted
+	}
+	if ok, err := c.limit(p); !ok {
+		return err
+	}
 	msg := common.NewMessage(p)
+	if delayed {
+		msg.Context.Topic = topic
+		if msg.Context.Flags&0x1 == 0x1 && !limits.retain {
+			// the delayed message is still routed but not retained
+			c.log.Warn("message is not retained", log.Any("topic", topic), log.Error(ErrSessionRetainedMessageNotPermitted))
+			metrics.Add(metricRetainedMessagesRejected, 1)
+			msg.Context.Flags &^= 0x1
+		}
+		err := c.manager.delayMessage(msg, delay, c.session.ID(), c.username)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if p.Message.QOS == 1 {
+			c.callback(msg.Context.ID)
+		}
+		return nil
+	}
 	if msg.Context.Flags&0x1 == 0x1 {
 		err := c.retainMessage(msg)
 		if err != nil {
@@ -402,7 +720,7 @@ func (c *Client) onSubscribe(p *mqtt.Subscribe) error {
 		return ErrSessionSubscribePayloadEmpty
 	}
 
-	sa, subs := c.genSuback(p)
+	sa, subs, replays := c.genSuback(p)
 	err := c.session.subscribe(subs, sa, c.authorize)
 	if err != nil {
 		return errors.Trace(err)
@@ -411,7 +729,9 @@ func (c *Client) onSubscribe(p *mqtt.Subscribe) error {
 	if err != nil {
 		return errors.Trace(err)
 	}
-	return c.sendRetainMessage()
+	// the history messages are replayed after the suback, since the client may ignore the messages before it
+	c.session.replay(subs, replays)
+	return c.sendRetainMessage(subs)
 }
 
 func (c *Client) onUnsubscribe(p *mqtt.Unsubscribe) error {
@@ -432,16 +752,29 @@ func (c *Client) callback(id uint64) {
 	}
 }
 
-func (c *Client) genSuback(p *mqtt.Subscribe) (*mqtt.Suback, []mqtt.Subscription) {
+func (c *Client) genSuback(p *mqtt.Subscribe) (*mqtt.Suback, []mqtt.Subscription, map[string]time.Time) {
 	sa := &mqtt.Suback{
 		ID:          p.ID,
 		ReturnCodes: make([]mqtt.QOS, len(p.Subscriptions)),
 	}
 	var subs []mqtt.Subscription
+	replays := map[string]time.Time{}
+	added := map[string]bool{}
 	for i, sub := range p.Subscriptions {
+		topic, since, replay := parseReplayTopic(sub.Topic)
+		if replay {
+			sub.Topic = topic
+			replays[topic] = since
+		}
 		if !c.manager.checker.CheckTopic(sub.Topic, true) {
 			c.log.Error("subscribe topic invalid", log.Any("topic", sub.Topic))
 			sa.ReturnCodes[i] = mqtt.QOSFailure
+		} else if err := c.manager.checkTopicLimits(sub.Topic, true); err != nil {
+			c.log.Error(err.Error(), log.Any("topic", sub.Topic))
+			sa.ReturnCodes[i] = mqtt.QOSFailure
+		} else if !c.checkSubscriptions(sub.Topic, added) {
+			c.log.Error(ErrSessionSubscriptionsExceedLimit.Error(), log.Any("topic", sub.Topic), log.Any("max", c.manager.cfg.MaxSubscriptions))
+			sa.ReturnCodes[i] = mqtt.QOSFailure
 		} else if sub.QOS > 1 {
 			c.log.Error("subscribe QOS not supported", log.Any("qos", int(sub.QOS)))
 			sa.ReturnCodes[i] = mqtt.QOSFailure
@@ -451,9 +784,29 @@ func (c *Client) genSuback(p *mqtt.Subscribe) (*mqtt.Suback, []mqtt.Subscription
 		} else {
 			sa.ReturnCodes[i] = sub.QOS
 			subs = append(subs, sub)
+			added[sub.Topic] = true
 		}
 	}
-	return sa, subs
+	return sa, subs, replays
+}
+
+// checkSubscriptions checks whether the new topic filter exceeds the max subscriptions of session,
+// the topic filters already subscribed and added in the same packet are not counted again
+func (c *Client) checkSubscriptions(topic string, added map[string]bool) bool {
+	max := c.manager.cfg.MaxSubscriptions
+	if max <= 0 || added[topic] {
+		return true
+	}
+	subscribed, count := c.session.subscribed(topic)
+	if subscribed {
+		return true
+	}
+	for t := range added {
+		if ok, _ := c.session.subscribed(t); !ok {
+			count++
+		}
+	}
+	return count < max
 }
 
 // * egress
@@ -509,6 +862,8 @@ func (c *Client) sending() error {
 					return nil
 				}
 			}
+			// the message dropped below must not resend the last one
+			msg = nil
 		}
 		select {
 		case evt := <-qos0:
@@ -528,9 +883,15 @@ func (c *Client) sending() error {
 				c.log.Warn("dropped a message whose topic is not permitted when sending", log.Any("topic", evt.Context.Topic))
 				continue
 			}
-			msg = c.wrap(evt)
-			if err := cache.store(msg); err != nil {
-				c.log.Error(err.Error())
+			if evt.Context.QOS == 0 {
+				// the replayed QoS 0 message is sent without acknowledgement
+				evt.Done()
+				msg = newEventWrapper(0, 0, evt)
+			} else {
+				msg = c.wrap(evt)
+				if err := cache.store(msg); err != nil {
+					c.log.Error(err.Error())
+				}
 			}
 		case <-c.tomb.Dying():
 			return nil
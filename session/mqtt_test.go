@@ -1,16 +1,30 @@
 package session
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/baetyl/baetyl-go/v2/mqtt"
 	"github.com/baetyl/baetyl-go/v2/utils"
+	"github.com/golang-jwt/jwt"
 	"github.com/stretchr/testify/assert"
+
+	"github.com/baetyl/baetyl-broker/v2/common"
 )
 
 func TestSessionMqttConnect(t *testing.T) {
@@ -295,7 +309,7 @@ func TestSessionMqttMaxClients(t *testing.T) {
 	// c1 sends connect with cleansession=false
 	c1.sendC2S(&mqtt.Connect{ClientID: t.Name(), Username: "u1", Password: "p1", Version: 3})
 	c1.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
-	b.assertSessionStore(t.Name(), "{\"id\":\""+t.Name()+"\"}", nil)
+	b.assertSessionStore(t.Name(), "{\"id\":\""+t.Name()+"\",\"owner\":\"u1\"}", nil)
 	b.assertSessionCount(1)
 	b.assertClientCount(1)
 
@@ -303,7 +317,7 @@ func TestSessionMqttMaxClients(t *testing.T) {
 	c1.sendC2S(&mqtt.Disconnect{})
 	c1.assertS2CPacketTimeout()
 	c1.assertClosed(true)
-	b.assertSessionStore(t.Name(), "{\"id\":\""+t.Name()+"\"}", nil)
+	b.assertSessionStore(t.Name(), "{\"id\":\""+t.Name()+"\",\"owner\":\"u1\"}", nil)
 	b.assertSessionCount(1)
 	b.assertClientCount(0)
 
@@ -340,8 +354,11 @@ func TestSessionMqttMaxClients(t *testing.T) {
 	b.assertSessionCount(4)
 	b.assertClientCount(3)
 
+	// c5 is rejected with ServerUnavailable
 	c5 := newMockConn(t)
 	b.manager.Handle(c5, false)
+	c5.sendC2S(&mqtt.Connect{ClientID: "c5", CleanSession: true, Username: "u1", Password: "p1", Version: 3})
+	c5.assertS2CPacket("<Connack SessionPresent=false ReturnCode=3>")
 	c5.assertClosed(true)
 
 	// c2 sends disconnect
@@ -374,55 +391,55 @@ func TestSessionMqttSubscribe(t *testing.T) {
 	// subscribe test
 	c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "test", QOS: 0}}})
 	c.assertS2CPacket("<Suback ID=1 ReturnCodes=[0]>")
-	b.assertSessionStore(t.Name(), "{\"id\":\""+t.Name()+"\",\"subs\":{\"test\":0}}", nil)
+	b.assertSessionStore(t.Name(), "{\"id\":\""+t.Name()+"\",\"owner\":\"u4\",\"subs\":{\"test\":0}}", nil)
 	b.assertExchangeCount(1)
 
 	// subscribe talk
 	c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "talks"}, {Topic: "$baidu/iot", QOS: 1}, {Topic: "$link/data", QOS: 1}}})
 	c.assertS2CPacket("<Suback ID=1 ReturnCodes=[0, 1, 1]>")
-	b.assertSessionStore(t.Name(), "{\"id\":\"TestSessionMqttSubscribe\",\"subs\":{\"$baidu/iot\":1,\"$link/data\":1,\"talks\":0,\"test\":0}}", nil)
+	b.assertSessionStore(t.Name(), "{\"id\":\"TestSessionMqttSubscribe\",\"owner\":\"u4\",\"subs\":{\"$baidu/iot\":1,\"$link/data\":1,\"talks\":0,\"test\":0}}", nil)
 	b.assertExchangeCount(4)
 
 	// subscribe talk again
 	c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "talks", QOS: 1}, {Topic: "$baidu/iot", QOS: 1}, {Topic: "$link/data", QOS: 0}}})
 	c.assertS2CPacket("<Suback ID=1 ReturnCodes=[1, 1, 0]>")
-	b.assertSessionStore(t.Name(), "{\"id\":\"TestSessionMqttSubscribe\",\"subs\":{\"$baidu/iot\":1,\"$link/data\":0,\"talks\":1,\"test\":0}}", nil)
+	b.assertSessionStore(t.Name(), "{\"id\":\"TestSessionMqttSubscribe\",\"owner\":\"u4\",\"subs\":{\"$baidu/iot\":1,\"$link/data\":0,\"talks\":1,\"test\":0}}", nil)
 	b.assertExchangeCount(4)
 
 	// subscribe wrong qos
 	c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "test", QOS: 2}}})
 	c.assertS2CPacket("<Suback ID=1 ReturnCodes=[128]>")
-	b.assertSessionStore(t.Name(), "{\"id\":\"TestSessionMqttSubscribe\",\"subs\":{\"$baidu/iot\":1,\"$link/data\":0,\"talks\":1,\"test\":0}}", nil)
+	b.assertSessionStore(t.Name(), "{\"id\":\"TestSessionMqttSubscribe\",\"owner\":\"u4\",\"subs\":{\"$baidu/iot\":1,\"$link/data\":0,\"talks\":1,\"test\":0}}", nil)
 	b.assertExchangeCount(4)
 
 	// wrong topic
 	c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "talks1#/", QOS: 1}}})
 	c.assertS2CPacket("<Suback ID=1 ReturnCodes=[128]>")
-	b.assertSessionStore(t.Name(), "{\"id\":\"TestSessionMqttSubscribe\",\"subs\":{\"$baidu/iot\":1,\"$link/data\":0,\"talks\":1,\"test\":0}}", nil)
+	b.assertSessionStore(t.Name(), "{\"id\":\"TestSessionMqttSubscribe\",\"owner\":\"u4\",\"subs\":{\"$baidu/iot\":1,\"$link/data\":0,\"talks\":1,\"test\":0}}", nil)
 	b.assertExchangeCount(4)
 
 	// no permit
 	c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "$unknown/data", QOS: 1}}})
 	c.assertS2CPacket("<Suback ID=1 ReturnCodes=[128]>")
-	b.assertSessionStore(t.Name(), "{\"id\":\"TestSessionMqttSubscribe\",\"subs\":{\"$baidu/iot\":1,\"$link/data\":0,\"talks\":1,\"test\":0}}", nil)
+	b.assertSessionStore(t.Name(), "{\"id\":\"TestSessionMqttSubscribe\",\"owner\":\"u4\",\"subs\":{\"$baidu/iot\":1,\"$link/data\":0,\"talks\":1,\"test\":0}}", nil)
 	b.assertExchangeCount(4)
 
 	// no permit
 	c.sendC2S(&mqtt.Unsubscribe{ID: 1, Topics: []string{"nonexists"}})
 	c.assertS2CPacket("<Unsuback ID=1>")
-	b.assertSessionStore(t.Name(), "{\"id\":\"TestSessionMqttSubscribe\",\"subs\":{\"$baidu/iot\":1,\"$link/data\":0,\"talks\":1,\"test\":0}}", nil)
+	b.assertSessionStore(t.Name(), "{\"id\":\"TestSessionMqttSubscribe\",\"owner\":\"u4\",\"subs\":{\"$baidu/iot\":1,\"$link/data\":0,\"talks\":1,\"test\":0}}", nil)
 	b.assertExchangeCount(4)
 
 	// unsubscribe test
 	c.sendC2S(&mqtt.Unsubscribe{ID: 1, Topics: []string{"test"}})
 	c.assertS2CPacket("<Unsuback ID=1>")
-	b.assertSessionStore(t.Name(), "{\"id\":\"TestSessionMqttSubscribe\",\"subs\":{\"$baidu/iot\":1,\"$link/data\":0,\"talks\":1}}", nil)
+	b.assertSessionStore(t.Name(), "{\"id\":\"TestSessionMqttSubscribe\",\"owner\":\"u4\",\"subs\":{\"$baidu/iot\":1,\"$link/data\":0,\"talks\":1}}", nil)
 	b.assertExchangeCount(3)
 
 	// subscribe test
 	c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "test", QOS: 0}}})
 	c.assertS2CPacket("<Suback ID=1 ReturnCodes=[0]>")
-	b.assertSessionStore(t.Name(), "{\"id\":\"TestSessionMqttSubscribe\",\"subs\":{\"$baidu/iot\":1,\"$link/data\":0,\"talks\":1,\"test\":0}}", nil)
+	b.assertSessionStore(t.Name(), "{\"id\":\"TestSessionMqttSubscribe\",\"owner\":\"u4\",\"subs\":{\"$baidu/iot\":1,\"$link/data\":0,\"talks\":1,\"test\":0}}", nil)
 	b.assertExchangeCount(4)
 
 	c.sendC2S(&mqtt.Disconnect{})
@@ -465,7 +482,7 @@ func TestSessionMqttPublish(t *testing.T) {
 	// subscribe test
 	c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "test", QOS: 1}, {Topic: "$baidu/iot", QOS: 1}, {Topic: "$link/data", QOS: 1}}})
 	c.assertS2CPacket("<Suback ID=1 ReturnCodes=[1, 1, 1]>")
-	b.assertSessionStore(t.Name(), "{\"id\":\""+t.Name()+"\",\"subs\":{\"$baidu/iot\":1,\"$link/data\":1,\"test\":1}}", nil)
+	b.assertSessionStore(t.Name(), "{\"id\":\""+t.Name()+"\",\"owner\":\"u1\",\"subs\":{\"$baidu/iot\":1,\"$link/data\":1,\"test\":1}}", nil)
 	b.assertExchangeCount(3)
 
 	fmt.Println("--> publish topic test qos 0 <--")
@@ -559,9 +576,9 @@ func TestSessionMqttCleanSession(t *testing.T) {
 	pktpub1.Message.Topic = "test"
 	pktpub1.Message.Payload = []byte("hi1")
 	pub.sendC2S(pktpub0)
+	sub.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"test\" QOS=0 Retain=false Payload=686930> Dup=false>")
 	pub.sendC2S(pktpub1)
 	pub.assertS2CPacket("<Puback ID=1>")
-	sub.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"test\" QOS=0 Retain=false Payload=686930> Dup=false>")
 	sub.assertS2CPacket("<Publish ID=1 Message=<Message Topic=\"test\" QOS=1 Retain=false Payload=686931> Dup=false>")
 	sub.sendC2S(&mqtt.Puback{ID: 1})
 	sub.sendC2S(&mqtt.Disconnect{})
@@ -634,9 +651,9 @@ func TestSessionMqttCleanSession(t *testing.T) {
 	b.assertExchangeCount(1)
 
 	pub.sendC2S(pktpub0)
+	sub.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"test\" QOS=0 Retain=false Payload=686930> Dup=false>")
 	pub.sendC2S(pktpub1)
 	pub.assertS2CPacket("<Puback ID=1>")
-	sub.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"test\" QOS=0 Retain=false Payload=686930> Dup=false>")
 	sub.assertS2CPacket("<Publish ID=1 Message=<Message Topic=\"test\" QOS=1 Retain=false Payload=686931> Dup=false>")
 	sub.sendC2S(&mqtt.Puback{ID: 1})
 	sub.sendC2S(&mqtt.Disconnect{})
@@ -816,7 +833,7 @@ func TestSessionMqttPubSubQOS(t *testing.T) {
 
 	sub.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "test", QOS: 1}}})
 	sub.assertS2CPacket("<Suback ID=1 ReturnCodes=[1]>")
-	b.assertSessionStore("sub", "{\"id\":\"sub\",\"subs\":{\"test\":1}}", nil)
+	b.assertSessionStore("sub", "{\"id\":\"sub\",\"owner\":\"u1\",\"subs\":{\"test\":1}}", nil)
 	b.assertExchangeCount(1)
 
 	pktpub := &mqtt.Publish{}
@@ -844,7 +861,7 @@ func TestSessionMqttPubSubQOS(t *testing.T) {
 
 	sub.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "test", QOS: 0}}})
 	sub.assertS2CPacket("<Suback ID=1 ReturnCodes=[0]>")
-	b.assertSessionStore("sub", "{\"id\":\"sub\",\"subs\":{\"test\":0}}", nil)
+	b.assertSessionStore("sub", "{\"id\":\"sub\",\"owner\":\"u1\",\"subs\":{\"test\":0}}", nil)
 	b.assertExchangeCount(1)
 
 	pub.sendC2S(pktpub)
@@ -884,7 +901,7 @@ func TestSessionMqttSystemTopicIsolation(t *testing.T) {
 	pktsub.Subscriptions = []mqtt.Subscription{{Topic: "#", QOS: 0}}
 	subc.sendC2S(pktsub)
 	subc.assertS2CPacket("<Suback ID=1 ReturnCodes=[0]>")
-	b.assertSessionStore("subc", "{\"id\":\"subc\",\"subs\":{\"#\":0}}", nil)
+	b.assertSessionStore("subc", "{\"id\":\"subc\",\"owner\":\"u1\",\"subs\":{\"#\":0}}", nil)
 	b.assertExchangeCount(1)
 
 	fmt.Println("\n--> pubc publish message with topic test, subc will receive message <--")
@@ -916,7 +933,7 @@ func TestSessionMqttSystemTopicIsolation(t *testing.T) {
 	pktunsub.Topics = []string{"#"}
 	subc.sendC2S(pktunsub)
 	subc.assertS2CPacket("<Unsuback ID=1>")
-	b.assertSessionStore("subc", "{\"id\":\"subc\"}", nil)
+	b.assertSessionStore("subc", "{\"id\":\"subc\",\"owner\":\"u1\"}", nil)
 	b.assertExchangeCount(0)
 
 	// subc subscribe topic $link/#
@@ -925,7 +942,7 @@ func TestSessionMqttSystemTopicIsolation(t *testing.T) {
 	pktsub.Subscriptions = []mqtt.Subscription{{Topic: "$link/#", QOS: 0}}
 	subc.sendC2S(pktsub)
 	subc.assertS2CPacket("<Suback ID=2 ReturnCodes=[0]>")
-	b.assertSessionStore("subc", "{\"id\":\"subc\",\"subs\":{\"$link/#\":0}}", nil)
+	b.assertSessionStore("subc", "{\"id\":\"subc\",\"owner\":\"u1\",\"subs\":{\"$link/#\":0}}", nil)
 	b.assertExchangeCount(1)
 
 	fmt.Println("\n--> pubc publish message with topic test, subc will not receive message <--")
@@ -979,7 +996,7 @@ func TestSessionMqttSystemTopicIsolation(t *testing.T) {
 	pktsub.Subscriptions = []mqtt.Subscription{{Topic: "$SYS/data", QOS: 0}}
 	subc.sendC2S(pktsub)
 	subc.assertS2CPacket("<Suback ID=3 ReturnCodes=[128]>")
-	b.assertSessionStore("subc", "{\"id\":\"subc\",\"subs\":{\"$link/#\":0}}", nil)
+	b.assertSessionStore("subc", "{\"id\":\"subc\",\"owner\":\"u1\",\"subs\":{\"$link/#\":0}}", nil)
 	subc.assertClosed(false)
 }
 
@@ -1036,7 +1053,7 @@ func TestSessionMqttReCheckNonPermittedTopic(t *testing.T) {
 	sub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
 	sub.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "test", QOS: 1}}})
 	sub.assertS2CPacket("<Suback ID=1 ReturnCodes=[1]>")
-	b.assertSessionStore("sub", "{\"id\":\"sub\",\"subs\":{\"test\":1}}", nil)
+	b.assertSessionStore("sub", "{\"id\":\"sub\",\"owner\":\"u1\",\"subs\":{\"test\":1}}", nil)
 	b.assertExchangeCount(1)
 	b.assertSessionCount(1)
 	b.assertClientCount(1)
@@ -1063,14 +1080,14 @@ principals:
 	defer b.closeAndClean()
 
 	// load the stored session
-	b.assertSessionStore("sub", "{\"id\":\"sub\",\"subs\":{\"test\":1}}", nil)
+	b.assertSessionStore("sub", "{\"id\":\"sub\",\"owner\":\"u1\",\"subs\":{\"test\":1}}", nil)
 	b.assertExchangeCount(1)
 	sub = newMockConn(t)
 	b.manager.Handle(sub, false)
 	sub.sendC2S(&mqtt.Connect{ClientID: "sub", Username: "u1", Password: "p1", Version: 3})
 	sub.assertS2CPacket("<Connack SessionPresent=true ReturnCode=0>")
 	// * auto subscribe when cleansession=false
-	b.assertSessionStore("sub", "{\"id\":\"sub\"}", nil)
+	b.assertSessionStore("sub", "{\"id\":\"sub\",\"owner\":\"u1\"}", nil)
 	b.assertExchangeCount(0)
 
 	sub.sendC2S(&mqtt.Disconnect{})
@@ -1383,6 +1400,906 @@ func TestSessionMqttRetain(t *testing.T) {
 	assert.Equal(t, []byte("hi"), msgs[0].Content)
 }
 
+func TestSessionMqttRetainIndex(t *testing.T) {
+	b := newMockBroker(t, testConfDefault)
+
+	pub := newMockConn(t)
+	b.manager.Handle(pub, false)
+	pub.sendC2S(&mqtt.Connect{ClientID: "pub", Version: 3})
+	pub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+
+	for i, topic := range []string{"a/1", "a/2", "b/1"} {
+		pktpub := &mqtt.Publish{}
+		pktpub.ID = mqtt.ID(i + 1)
+		pktpub.Message.QOS = 1
+		pktpub.Message.Topic = topic
+		pktpub.Message.Payload = []byte(topic)
+		pktpub.Message.Retain = true
+		pub.sendC2S(pktpub)
+		pub.assertS2CPacket(fmt.Sprintf("<Puback ID=%d>", i+1))
+	}
+	assert.Len(t, b.manager.retainer.index.Search("#"), 3)
+
+	receive := func(c *mockConn, n int) []string {
+		var topics []string
+		for i := 0; i < n; i++ {
+			pkt, ok := c.receiveS2C().(*mqtt.Publish)
+			assert.True(t, ok)
+			assert.True(t, pkt.Message.Retain)
+			assert.Equal(t, mqtt.QOS(0), pkt.Message.QOS)
+			topics = append(topics, pkt.Message.Topic)
+		}
+		c.assertS2CPacketTimeout()
+		sort.Strings(topics)
+		return topics
+	}
+
+	sub := newMockConn(t)
+	b.manager.Handle(sub, false)
+	sub.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+	sub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+
+	// only the retained messages matching the new filter are sent
+	sub.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "a/+", QOS: 0}}})
+	sub.assertS2CPacket("<Suback ID=1 ReturnCodes=[0]>")
+	assert.Equal(t, []string{"a/1", "a/2"}, receive(sub, 2))
+
+	// the retained messages of the existing subscriptions are not sent again
+	sub.sendC2S(&mqtt.Subscribe{ID: 2, Subscriptions: []mqtt.Subscription{{Topic: "b/#", QOS: 0}}})
+	sub.assertS2CPacket("<Suback ID=2 ReturnCodes=[0]>")
+	assert.Equal(t, []string{"b/1"}, receive(sub, 1))
+
+	// the retained message matching several new filters is sent once
+	sub.sendC2S(&mqtt.Subscribe{ID: 3, Subscriptions: []mqtt.Subscription{{Topic: "a/1", QOS: 0}, {Topic: "+/1", QOS: 0}}})
+	sub.assertS2CPacket("<Suback ID=3 ReturnCodes=[0, 0]>")
+	assert.Equal(t, []string{"a/1", "b/1"}, receive(sub, 2))
+
+	// clear the retained message of topic a/1
+	pktpub := &mqtt.Publish{}
+	pktpub.ID = 4
+	pktpub.Message.QOS = 1
+	pktpub.Message.Topic = "a/1"
+	pktpub.Message.Retain = true
+	pub.sendC2S(pktpub)
+	pub.assertS2CPacket("<Puback ID=4>")
+	assert.Len(t, b.manager.retainer.index.Search("#"), 2)
+	// the retained message stored without audit
+	assert.NoError(t, b.manager.retainer.audits.DelKV([]byte("a/2")))
+	b.close()
+
+	fmt.Println("--> restart broker <--")
+
+	b = newMockBrokerNotClean(t, testConfDefault)
+	assert.Len(t, b.manager.retainer.index.Search("#"), 2)
+	audited := b.manager.retainer.metas["a/2"].Time
+	b.close()
+
+	fmt.Println("--> restart broker again <--")
+
+	// the audit is stored when loaded first, so the time isn't reset by restart
+	b = newMockBrokerNotClean(t, testConfDefault)
+	defer b.closeAndClean()
+	assert.True(t, audited.Equal(b.manager.retainer.metas["a/2"].Time))
+
+	sub = newMockConn(t)
+	b.manager.Handle(sub, false)
+	sub.sendC2S(&mqtt.Connect{ClientID: "sub2", Version: 3})
+	sub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	sub.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "#", QOS: 0}}})
+	sub.assertS2CPacket("<Suback ID=1 ReturnCodes=[0]>")
+	assert.Equal(t, []string{"a/2", "b/1"}, receive(sub, 2))
+}
+
+func TestSessionMqttRetainLimits(t *testing.T) {
+	b := newMockBroker(t, testConfRetain)
+	defer b.closeAndClean()
+
+	pub := newMockConn(t)
+	b.manager.Handle(pub, false)
+	pub.sendC2S(&mqtt.Connect{ClientID: "pub", Username: "u1", Version: 3})
+	pub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+
+	var id mqtt.ID
+	publish := func(topic, payload string) {
+		id++
+		pktpub := &mqtt.Publish{ID: id}
+		pktpub.Message.QOS = 1
+		pktpub.Message.Topic = topic
+		pktpub.Message.Payload = []byte(payload)
+		pktpub.Message.Retain = true
+		pub.sendC2S(pktpub)
+		pub.assertS2CPacket(fmt.Sprintf("<Puback ID=%d>", id))
+	}
+	topics := func() []string {
+		var res []string
+		for _, v := range b.manager.ListRetainedMessages() {
+			res = append(res, v.Topic)
+		}
+		return res
+	}
+
+	publish("test/a", "12345")
+	rms := b.manager.ListRetainedMessages()
+	assert.Len(t, rms, 1)
+	assert.Equal(t, "test/a", rms[0].Topic)
+	assert.Equal(t, uint32(1), rms[0].QOS)
+	assert.Equal(t, 5, rms[0].Size)
+	assert.Equal(t, "pub", rms[0].ClientID)
+	assert.Equal(t, "u1", rms[0].Username)
+
+	// the topics denied or not allowed are not retained
+	publish("test/private/a", "1")
+	publish("other", "1")
+	assert.Equal(t, []string{"test/a"}, topics())
+
+	// the total size exceeds the limit
+	publish("test/b", "123456")
+	assert.Equal(t, []string{"test/a"}, topics())
+	publish("test/b", "12")
+	publish("test/c", "1")
+	assert.Equal(t, []string{"test/a", "test/b", "test/c"}, topics())
+
+	// the count exceeds the limit
+	publish("test/d", "1")
+	assert.Equal(t, []string{"test/a", "test/b", "test/c"}, topics())
+
+	// the retained message can be replaced within the limits
+	publish("test/a", "123")
+	assert.Equal(t, int64(6), b.manager.retainer.size)
+	publish("test/c", "")
+	assert.Equal(t, []string{"test/a", "test/b"}, topics())
+	assert.Equal(t, int64(5), b.manager.retainer.size)
+
+	// the expired retained messages are removed on read
+	time.Sleep(time.Second + 100*time.Millisecond)
+	assert.Empty(t, topics())
+	publish("test/e", "1")
+	assert.Equal(t, []string{"test/e"}, topics())
+
+	sub := newMockConn(t)
+	b.manager.Handle(sub, false)
+	sub.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+	sub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	sub.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "test/a", QOS: 1}}})
+	sub.assertS2CPacket("<Suback ID=1 ReturnCodes=[1]>")
+	sub.assertS2CPacketTimeout()
+	assert.Len(t, b.manager.retainer.metas, 2)
+	assert.Len(t, b.manager.retainer.index.Search("#"), 2)
+
+	// the expired retained messages are removed by sweeping
+	time.Sleep(time.Second + 100*time.Millisecond)
+	n, err := b.manager.retainer.sweep()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Len(t, b.manager.retainer.index.Search("#"), 0)
+	assert.Equal(t, int64(0), b.manager.retainer.size)
+	msgs, err := b.manager.listRetainedMessages()
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 0)
+}
+
+func TestSessionMqttDisconnect(t *testing.T) {
+	b := newMockBroker(t, testConfDefault)
+	defer b.closeAndClean()
+
+	c1 := newMockConn(t)
+	b.manager.Handle(c1, false)
+	c1.sendC2S(&mqtt.Connect{ClientID: "c1", Version: 3})
+	c1.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+
+	c2 := newMockConn(t)
+	b.manager.Handle(c2, false)
+	c2.sendC2S(&mqtt.Connect{ClientID: "c2", Version: 3})
+	c2.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	b.assertClientCount(2)
+
+	b.manager.Disconnect(func(conn mqtt.Connection) bool {
+		return conn == c1
+	})
+	c1.assertClosed(true)
+	c2.assertClosed(false)
+	b.assertClientCount(1)
+}
+
+func TestSessionMqttPermitVariables(t *testing.T) {
+	b := newMockBroker(t, testConfVariables)
+	defer b.closeAndClean()
+
+	c := newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: "d1", Username: "u1", Password: "p1", Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+
+	c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "users/u1/#", QOS: 0}, {Topic: "users/u2/#", QOS: 0}}})
+	c.assertS2CPacket("<Suback ID=1 ReturnCodes=[0, 128]>")
+
+	pktpub := &mqtt.Publish{ID: 1}
+	pktpub.Message.QOS = 1
+	pktpub.Message.Topic = "devices/d1/data"
+	c.sendC2S(pktpub)
+	c.assertS2CPacket("<Puback ID=1>")
+
+	pktpub.ID = 2
+	pktpub.Message.Topic = "devices/d2/data"
+	c.sendC2S(pktpub)
+	c.assertS2CPacketTimeout()
+	c.assertClosed(true)
+}
+
+func TestSessionMqttAnonymous(t *testing.T) {
+	b := newMockBroker(t, testConfAnonymous)
+	defer b.closeAndClean()
+
+	c := newMockConn(t)
+	b.manager.Handle(c, true)
+	c.sendC2S(&mqtt.Connect{ClientID: "c1", Username: "u1", Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+
+	c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "telemetry/a", QOS: 1}, {Topic: "cmd/a", QOS: 1}}})
+	c.assertS2CPacket("<Suback ID=1 ReturnCodes=[1, 128]>")
+
+	pktpub := &mqtt.Publish{ID: 1}
+	pktpub.Message.QOS = 1
+	pktpub.Message.Topic = "clients/c1/data"
+	c.sendC2S(pktpub)
+	c.assertS2CPacket("<Puback ID=1>")
+
+	// the username of anonymous client is not authenticated
+	pktpub.ID = 2
+	pktpub.Message.Topic = "users/u1/data"
+	c.sendC2S(pktpub)
+	c.assertS2CPacketTimeout()
+	c.assertClosed(true)
+
+	// the will message is also checked
+	c = newMockConn(t)
+	b.manager.Handle(c, true)
+	pktwill := &mqtt.Publish{}
+	pktwill.Message.Topic = "telemetry/a"
+	c.sendC2S(&mqtt.Connect{ClientID: "c2", Version: 3, Will: &pktwill.Message})
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=5>")
+}
+
+func TestSessionMqttOwnership(t *testing.T) {
+	b := newMockBroker(t, fmt.Sprintf(testConfOwnership, "refuse"))
+
+	c1 := newMockConn(t)
+	b.manager.Handle(c1, false)
+	c1.sendC2S(&mqtt.Connect{ClientID: "c1", Username: "u1", Password: "p1", Version: 3})
+	c1.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	c1.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "test", QOS: 1}}})
+	c1.assertS2CPacket("<Suback ID=1 ReturnCodes=[1]>")
+	b.assertSessionStore("c1", "{\"id\":\"c1\",\"owner\":\"u1\",\"subs\":{\"test\":1}}", nil)
+
+	// another identity is refused and the owner is not kicked off
+	c2 := newMockConn(t)
+	b.manager.Handle(c2, false)
+	c2.sendC2S(&mqtt.Connect{ClientID: "c1", Username: "u2", Password: "p2", Version: 3})
+	c2.assertS2CPacket("<Connack SessionPresent=false ReturnCode=5>")
+	c2.assertClosed(true)
+	c1.assertClosed(false)
+	b.assertClientCount(1)
+
+	// the owner takes over its session
+	c3 := newMockConn(t)
+	b.manager.Handle(c3, false)
+	c3.sendC2S(&mqtt.Connect{ClientID: "c1", Username: "u1", Password: "p1", Version: 3})
+	c3.assertS2CPacket("<Connack SessionPresent=true ReturnCode=0>")
+	c1.assertClosed(true)
+	b.closeAndClean()
+
+	b = newMockBroker(t, fmt.Sprintf(testConfOwnership, "reset"))
+	defer b.closeAndClean()
+
+	c1 = newMockConn(t)
+	b.manager.Handle(c1, false)
+	c1.sendC2S(&mqtt.Connect{ClientID: "c1", Username: "u1", Password: "p1", Version: 3})
+	c1.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	c1.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "test", QOS: 1}}})
+	c1.assertS2CPacket("<Suback ID=1 ReturnCodes=[1]>")
+
+	// another identity is refused while the owner is online
+	c2 = newMockConn(t)
+	b.manager.Handle(c2, false)
+	c2.sendC2S(&mqtt.Connect{ClientID: "c1", Username: "u2", Password: "p2", Version: 3})
+	c2.assertS2CPacket("<Connack SessionPresent=false ReturnCode=5>")
+	c2.assertClosed(true)
+	c1.assertClosed(false)
+
+	// another identity starts a new session after the owner is offline
+	c1.sendC2S(&mqtt.Disconnect{})
+	b.waitClientReady("c1", true)
+	c2 = newMockConn(t)
+	b.manager.Handle(c2, false)
+	c2.sendC2S(&mqtt.Connect{ClientID: "c1", Username: "u2", Password: "p2", Version: 3})
+	c2.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	b.assertSessionStore("c1", "{\"id\":\"c1\",\"owner\":\"u2\"}", nil)
+	b.assertExchangeCount(0)
+}
+
+func TestSessionMqttTakeover(t *testing.T) {
+	// reject
+	b := newMockBroker(t, fmt.Sprintf(testConfTakeover, "reject"))
+
+	c1 := newMockConn(t)
+	b.manager.Handle(c1, false)
+	c1.sendC2S(&mqtt.Connect{ClientID: "c1", Version: 3})
+	c1.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+
+	c2 := newMockConn(t)
+	b.manager.Handle(c2, false)
+	c2.sendC2S(&mqtt.Connect{ClientID: "c1", Version: 3})
+	c2.assertS2CPacket("<Connack SessionPresent=false ReturnCode=2>")
+	c2.assertClosed(true)
+	c1.assertClosed(false)
+	b.closeAndClean()
+
+	// allow
+	b = newMockBroker(t, fmt.Sprintf(testConfTakeover, "allow"))
+
+	c1 = newMockConn(t)
+	b.manager.Handle(c1, false)
+	c1.sendC2S(&mqtt.Connect{ClientID: "c1", Version: 3})
+	c1.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	c1.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "test", QOS: 0}}})
+	c1.assertS2CPacket("<Suback ID=1 ReturnCodes=[0]>")
+
+	c2 = newMockConn(t)
+	b.manager.Handle(c2, false)
+	c2.sendC2S(&mqtt.Connect{ClientID: "c1", Version: 3})
+	c2.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	c2.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "test", QOS: 0}}})
+	c2.assertS2CPacket("<Suback ID=1 ReturnCodes=[0]>")
+	c1.assertClosed(false)
+	b.assertClientCount(2)
+	b.assertSessionCount(2)
+
+	// both receive the message
+	pktpub := &mqtt.Publish{}
+	pktpub.Message.Topic = "test"
+	pktpub.Message.Payload = []byte("hi")
+	c2.sendC2S(pktpub)
+	c1.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"test\" QOS=0 Retain=false Payload=6869> Dup=false>")
+	c2.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"test\" QOS=0 Retain=false Payload=6869> Dup=false>")
+
+	// the temporary session is cleaned
+	c2.sendC2S(&mqtt.Disconnect{})
+	b.waitClientReady("c1", false)
+	for b.manager.sessions.count() != 1 {
+		time.Sleep(time.Millisecond * 10)
+	}
+	b.assertClientCount(1)
+	b.closeAndClean()
+
+	// kick and flapping
+	b = newMockBroker(t, fmt.Sprintf(testConfTakeover, "kick"))
+	defer b.closeAndClean()
+
+	var cs []*mockConn
+	for i := 0; i < 3; i++ {
+		c := newMockConn(t)
+		b.manager.Handle(c, false)
+		c.sendC2S(&mqtt.Connect{ClientID: "c1", Version: 3})
+		c.assertS2CPacket(fmt.Sprintf("<Connack SessionPresent=%v ReturnCode=0>", i > 0))
+		cs = append(cs, c)
+	}
+	cs[0].assertClosed(true)
+	cs[1].assertClosed(true)
+
+	// the third takeover exceeds the limit
+	c3 := newMockConn(t)
+	b.manager.Handle(c3, false)
+	c3.sendC2S(&mqtt.Connect{ClientID: "c1", Version: 3})
+	c3.assertS2CPacket("<Connack SessionPresent=false ReturnCode=3>")
+	cs[2].assertClosed(false)
+
+	// the client ID is banned
+	cs[2].sendC2S(&mqtt.Disconnect{})
+	b.waitClientReady("c1", true)
+	c4 := newMockConn(t)
+	b.manager.Handle(c4, false)
+	c4.sendC2S(&mqtt.Connect{ClientID: "c1", Version: 3})
+	c4.assertS2CPacket("<Connack SessionPresent=false ReturnCode=3>")
+
+	// the ban is expired
+	time.Sleep(time.Second)
+	c5 := newMockConn(t)
+	b.manager.Handle(c5, false)
+	c5.sendC2S(&mqtt.Connect{ClientID: "c1", Version: 3})
+	c5.assertS2CPacket("<Connack SessionPresent=true ReturnCode=0>")
+}
+
+func TestSessionMqttGuard(t *testing.T) {
+	b := newMockBroker(t, testConfGuard)
+	defer func() {
+		b.closeAndClean()
+	}()
+
+	connectFrom := func(ip, clientID, username, password string, code mqtt.ConnackCode) *mockConn {
+		c := newMockConn(t)
+		if ip != "" {
+			c.remote = &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}
+		}
+		b.manager.Handle(c, false)
+		c.sendC2S(&mqtt.Connect{ClientID: clientID, Username: username, Password: password, Version: 3})
+		c.assertS2CPacket(fmt.Sprintf("<Connack SessionPresent=false ReturnCode=%d>", code))
+		return c
+	}
+	connect := func(clientID, username, password string, code mqtt.ConnackCode) *mockConn {
+		return connectFrom("", clientID, username, password, code)
+	}
+
+	// static ban
+	connect("banned", "u1", "p1", mqtt.NotAuthorized)
+
+	// the failure is delayed progressively
+	start := time.Now()
+	connect("c1", "u1", "wrong", mqtt.BadUsernameOrPassword)
+	assert.True(t, time.Since(start) >= time.Millisecond*10)
+	// the username is banned temporarily since failures exceed the limit
+	start = time.Now()
+	connect("c1", "u1", "wrong", mqtt.BadUsernameOrPassword)
+	assert.True(t, time.Since(start) >= time.Millisecond*15)
+	connect("c1", "u1", "p1", mqtt.NotAuthorized)
+	time.Sleep(time.Second)
+	c := connect("c1", "u1", "p1", mqtt.ConnectionAccepted)
+
+	// runtime ban disconnects the online client
+	assert.Len(t, b.manager.ListBans(), 2)
+	assert.Equal(t, ErrSessionBanInvalid, b.manager.AddBan(Ban{Type: "ip", Value: "10.0.0.0/33"}))
+	assert.Equal(t, ErrSessionBanInvalid, b.manager.AddBan(Ban{Type: "topic", Value: "test"}))
+	assert.NoError(t, b.manager.AddBan(Ban{Type: "username", Value: "u1"}))
+	c.assertClosed(true)
+	assert.Equal(t, []Ban{{Type: "clientid", Value: "banned"}, {Type: "ip", Value: "10.0.0.0/8"}, {Type: "username", Value: "u1"}}, b.manager.ListBans())
+	connect("c2", "u1", "p1", mqtt.NotAuthorized)
+
+	assert.Equal(t, ErrSessionBanNotDeletable, b.manager.DelBan(Ban{Type: "clientid", Value: "banned"}))
+	assert.Equal(t, ErrSessionBanNotFound, b.manager.DelBan(Ban{Type: "clientid", Value: "c2"}))
+	assert.NoError(t, b.manager.AddBan(Ban{Type: "clientid", Value: "c3"}))
+	assert.NoError(t, b.manager.DelBan(Ban{Type: "username", Value: "u1"}))
+	connect("c2", "u1", "p1", mqtt.ConnectionAccepted)
+
+	// the runtime bans are persisted
+	b.close()
+	b = newMockBrokerNotClean(t, testConfGuard)
+	assert.Equal(t, []Ban{{Type: "clientid", Value: "banned"}, {Type: "clientid", Value: "c3"}, {Type: "ip", Value: "10.0.0.0/8"}}, b.manager.ListBans())
+
+	// the failures of a username from an IP don't lock out the user from other IPs
+	connectFrom("10.1.2.3", "c4", "u1", "p1", mqtt.NotAuthorized)
+	connectFrom("192.168.0.1", "c4", "u1", "wrong", mqtt.BadUsernameOrPassword)
+	connectFrom("192.168.0.1", "c4", "u1", "wrong", mqtt.BadUsernameOrPassword)
+	connectFrom("192.168.0.1", "c4", "u1", "p1", mqtt.NotAuthorized)
+	connectFrom("192.168.0.2", "c4", "u1", "p1", mqtt.ConnectionAccepted)
+
+	// ip
+	rule, err := newBanRule(Ban{Type: "ip", Value: "10.0.0.0/8"}, false)
+	assert.NoError(t, err)
+	assert.True(t, rule.match(net.ParseIP("10.1.2.3"), "", ""))
+	assert.False(t, rule.match(net.ParseIP("11.1.2.3"), "", ""))
+	assert.False(t, rule.match(nil, "", ""))
+	rule, err = newBanRule(Ban{Type: "ip", Value: "::1"}, true)
+	assert.NoError(t, err)
+	assert.True(t, rule.match(net.ParseIP("::1"), "", ""))
+	_, err = newBanRule(Ban{Type: "ip", Value: "10.0.0.0/33"}, true)
+	assert.Equal(t, ErrSessionBanInvalid, err)
+}
+
+func TestSessionMqttForceClientID(t *testing.T) {
+	b := newMockBroker(t, testConfForceClientID)
+	defer b.closeAndClean()
+
+	// the client without certificate is refused, since its client ID can't be verified
+	c := newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: "c1", Username: "u1", Password: "p1", Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=2>")
+	c.assertClosed(true)
+	b.assertClientCount(0)
+}
+
+func TestSessionMqttJWT(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	assert.NoError(t, err)
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	jwks := filepath.Join(dir, "jwks.json")
+	data := fmt.Sprintf(`{"keys":[{"kty":"EC","kid":"k1","crv":"P-256","x":"%s","y":"%s"}]}`,
+		base64.RawURLEncoding.EncodeToString(key.X.Bytes()),
+		base64.RawURLEncoding.EncodeToString(key.Y.Bytes()))
+	assert.NoError(t, ioutil.WriteFile(jwks, []byte(data), 0644))
+
+	b := newMockBroker(t, fmt.Sprintf(testConfJWT, jwks))
+	defer b.closeAndClean()
+
+	permissions := []map[string]interface{}{
+		{"action": "pub", "permit": []string{"jwt/${username}"}},
+		{"action": "sub", "permit": []string{"jwt/#"}},
+	}
+	hmac := func(claims jwt.MapClaims) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("s1"))
+		assert.NoError(t, err)
+		return token
+	}
+	es256 := func(claims jwt.MapClaims) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+		token.Header["kid"] = "k1"
+		res, err := token.SignedString(key)
+		assert.NoError(t, err)
+		return res
+	}
+	connect := func(clientID, password string, code mqtt.ConnackCode) *mockConn {
+		c := newMockConn(t)
+		b.manager.Handle(c, false)
+		c.sendC2S(&mqtt.Connect{ClientID: clientID, Username: "u1", Password: password, Version: 3})
+		c.assertS2CPacket(fmt.Sprintf("<Connack SessionPresent=false ReturnCode=%d>", code))
+		return c
+	}
+	exp := time.Now().Add(time.Hour).Unix()
+
+	// invalid tokens
+	connect("c1", hmac(jwt.MapClaims{"sub": "t1", "aud": "other", "exp": exp}), mqtt.BadUsernameOrPassword)
+	connect("c1", hmac(jwt.MapClaims{"sub": "t1", "aud": "broker", "exp": time.Now().Add(-time.Hour).Unix()}), mqtt.BadUsernameOrPassword)
+	connect("c1", hmac(jwt.MapClaims{"sub": "t1", "aud": "broker", "nbf": exp}), mqtt.BadUsernameOrPassword)
+	connect("c1", hmac(jwt.MapClaims{"sub": "t1", "aud": "broker", "nbf": exp, "exp": exp + 60}), mqtt.BadUsernameOrPassword)
+	// the token without exp never expires, so it is refused
+	connect("c1", hmac(jwt.MapClaims{"sub": "t1", "aud": "broker"}), mqtt.BadUsernameOrPassword)
+	connect("c1", hmac(jwt.MapClaims{"aud": "broker", "exp": exp}), mqtt.BadUsernameOrPassword)
+	connect("c1", hmac(jwt.MapClaims{"sub": "t1", "aud": "broker", "permissions": []map[string]interface{}{{"action": "any", "permit": []string{"#"}}}}), mqtt.BadUsernameOrPassword)
+	invalid := hmac(jwt.MapClaims{"sub": "t1", "aud": "broker"})
+	connect("c1", invalid[:len(invalid)-2], mqtt.BadUsernameOrPassword)
+	// the key of other signing method can't be used
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "t1", "aud": "broker"}).SignedString([]byte("wrong"))
+	assert.NoError(t, err)
+	connect("c1", token, mqtt.BadUsernameOrPassword)
+
+	// the username and password still work
+	connect("c0", "p1", mqtt.ConnectionAccepted)
+	// the password which looks like a JWT is verified as the password of account if it isn't a token
+	c := newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: "c6", Username: "u2", Password: "p.2.x", Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+
+	// hmac token with permissions
+	c1 := connect("c1", hmac(jwt.MapClaims{"sub": "t1", "aud": []string{"broker", "other"}, "exp": exp, "permissions": permissions}), mqtt.ConnectionAccepted)
+	b.assertSessionStore("c1", `{"id":"c1","owner":"t1"}`, nil)
+	c1.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "jwt/#"}, {Topic: "test"}}})
+	c1.assertS2CPacket("<Suback ID=1 ReturnCodes=[0, 128]>")
+
+	// the NumericDate may be a non-integer value
+	connect("c9", hmac(jwt.MapClaims{"sub": "t7", "aud": "broker", "exp": float64(exp) + 0.5}), mqtt.ConnectionAccepted)
+	connect("c10", hmac(jwt.MapClaims{"sub": "t8", "aud": "broker", "exp": json.Number(fmt.Sprintf("%de0", exp))}), mqtt.ConnectionAccepted)
+	connect("c10", hmac(jwt.MapClaims{"sub": "t8", "aud": "broker", "exp": float64(time.Now().Add(-time.Hour).Unix()) + 0.5}), mqtt.BadUsernameOrPassword)
+
+	// ecdsa token of jwks
+	c2 := connect("c2", es256(jwt.MapClaims{"sub": "t2", "aud": "broker", "exp": exp, "permissions": permissions}), mqtt.ConnectionAccepted)
+	pkt := &mqtt.Publish{}
+	pkt.Message.Topic = "jwt/t2"
+	pkt.Message.Payload = []byte("hi")
+	c2.sendC2S(pkt)
+	c1.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"jwt/t2\" QOS=0 Retain=false Payload=6869> Dup=false>")
+	pkt.Message.Topic = "jwt/t1"
+	c2.sendC2S(pkt)
+	c2.assertS2CPacketTimeout()
+	c2.assertClosed(true)
+
+	// the client is disconnected when the token expires
+	c3 := connect("c3", hmac(jwt.MapClaims{"sub": "t3", "aud": "broker", "exp": time.Now().Add(time.Second).Unix()}), mqtt.ConnectionAccepted)
+	c3.assertClosed(false)
+	time.Sleep(time.Millisecond * 1100)
+	c3.assertClosed(true)
+	c1.assertClosed(false)
+
+	// the token got from the websocket request is used if the password is not set
+	c4 := newMockConn(t)
+	b.manager.HandleListener(c4, common.ConnInfo{Token: hmac(jwt.MapClaims{"sub": "t4", "aud": "broker", "exp": exp})})
+	c4.sendC2S(&mqtt.Connect{ClientID: "c4", Version: 3})
+	c4.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	b.assertSessionStore("c4", `{"id":"c4","owner":"t4"}`, nil)
+	c5 := newMockConn(t)
+	b.manager.HandleListener(c5, common.ConnInfo{Token: "p1"})
+	c5.sendC2S(&mqtt.Connect{ClientID: "c5", Username: "u1", Version: 3})
+	c5.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+
+	// the limits of the principal are applied to the token of the same username
+	c7 := connect("c7", hmac(jwt.MapClaims{"sub": "t5", "aud": "broker", "exp": exp, "permissions": permissions}), mqtt.ConnectionAccepted)
+	pkt = &mqtt.Publish{ID: 1}
+	pkt.Message.Topic = "jwt/t5"
+	pkt.Message.QOS = 1
+	c7.sendC2S(pkt)
+	c7.assertS2CPacketTimeout()
+	c7.assertClosed(true)
+}
+
+func TestSessionMqttRateLimits(t *testing.T) {
+	connect := func(b *mockBroker, c *mockConn, clientID string, listener common.ConnInfo) {
+		b.manager.HandleListener(c, listener)
+		c.sendC2S(&mqtt.Connect{ClientID: clientID, Version: 3})
+		c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	}
+	publish := func(c *mockConn, id int, qos mqtt.QOS, payload string) {
+		pkt := &mqtt.Publish{ID: mqtt.ID(id)}
+		pkt.Message.Topic = "test"
+		pkt.Message.QOS = qos
+		pkt.Message.Payload = []byte(payload)
+		c.sendC2S(pkt)
+	}
+	received := func(c *mockConn, payload string) {
+		c.assertS2CPacket(fmt.Sprintf("<Publish ID=0 Message=<Message Topic=\"test\" QOS=0 Retain=false Payload=%x> Dup=false>", payload))
+	}
+	newBroker := func(action string) (*mockBroker, *mockConn, *mockConn) {
+		b := newMockBroker(t, fmt.Sprintf(testConfRateLimits, action))
+		sub := newMockConn(t)
+		connect(b, sub, "sub", common.ConnInfo{Anonymous: true})
+		sub.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "test"}}})
+		sub.assertS2CPacket("<Suback ID=1 ReturnCodes=[0]>")
+		pub := newMockConn(t)
+		connect(b, pub, "pub", common.ConnInfo{Anonymous: true})
+		return b, sub, pub
+	}
+
+	// delay
+	b, sub, pub := newBroker("delay")
+	start := time.Now()
+	publish(pub, 0, 0, "a")
+	publish(pub, 0, 0, "b")
+	publish(pub, 0, 0, "c")
+	received(sub, "a")
+	received(sub, "b")
+	received(sub, "c")
+	assert.True(t, time.Since(start) >= time.Millisecond*400)
+	b.closeAndClean()
+
+	// drop
+	b, sub, pub = newBroker("drop")
+	publish(pub, 0, 0, "a")
+	publish(pub, 0, 0, "b")
+	publish(pub, 0, 0, "c")
+	received(sub, "a")
+	received(sub, "b")
+	sub.assertS2CPacketTimeout()
+	// the QoS 1 message is delayed
+	publish(pub, 1, 1, "d")
+	pub.assertS2CPacket("<Puback ID=1>")
+	received(sub, "d")
+	b.closeAndClean()
+
+	// disconnect
+	b, sub, pub = newBroker("disconnect")
+	publish(pub, 0, 0, "a")
+	publish(pub, 0, 0, "b")
+	publish(pub, 0, 0, "c")
+	received(sub, "a")
+	received(sub, "b")
+	pub.assertS2CPacketTimeout()
+	pub.assertClosed(true)
+
+	// the bytes limit of listener is shared by the clients
+	listener := common.ConnInfo{Anonymous: true, Address: "tcp://0.0.0.0:1883", RateLimit: common.RateLimit{Bytes: 10, Action: RateLimitDisconnect}}
+	c1 := newMockConn(t)
+	connect(b, c1, "c1", listener)
+	c2 := newMockConn(t)
+	connect(b, c2, "c2", listener)
+	publish(c1, 0, 0, "12345678")
+	received(sub, "12345678")
+	publish(c2, 0, 0, "12345678")
+	c2.assertS2CPacketTimeout()
+	c2.assertClosed(true)
+	c1.assertClosed(false)
+	b.closeAndClean()
+
+	// the limit of username is shared by the clients
+	ls := newLimiters(RateLimits{Username: common.RateLimit{Messages: 1}})
+	assert.Len(t, ls.get("", common.ConnInfo{}), 0)
+	u1 := ls.get("u1", common.ConnInfo{})
+	assert.Len(t, u1, 1)
+	u2 := ls.get("u1", common.ConnInfo{})
+	assert.True(t, u1[0] == u2[0])
+	u3 := ls.get("u2", common.ConnInfo{})
+	assert.True(t, u1[0] != u3[0])
+	// the limiter of username is removed after all its clients are closed
+	ls.release(u1)
+	ls.release(u3)
+	assert.Len(t, ls.usernames, 1)
+	ls.release(u2)
+	assert.Len(t, ls.usernames, 0)
+	assert.True(t, u1[0] != ls.get("u1", common.ConnInfo{})[0])
+
+	// the limiter of username is released by the closed client
+	b = newMockBroker(t, fmt.Sprintf(testConfRateLimits, "delay"))
+	defer b.closeAndClean()
+	c3 := newMockConn(t)
+	b.manager.HandleListener(c3, common.ConnInfo{})
+	c3.sendC2S(&mqtt.Connect{ClientID: "c3", Username: "u1", Password: "p1", Version: 3})
+	c3.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	b.manager.limiters.mut.Lock()
+	assert.Len(t, b.manager.limiters.usernames, 1)
+	b.manager.limiters.mut.Unlock()
+	c3.sendC2S(&mqtt.Disconnect{})
+	b.waitClientReady("c3", true)
+	b.manager.limiters.mut.Lock()
+	assert.Len(t, b.manager.limiters.usernames, 0)
+	b.manager.limiters.mut.Unlock()
+}
+
+func TestSessionMqttAdmission(t *testing.T) {
+	b := newMockBroker(t, testConfAdmission)
+	defer b.closeAndClean()
+
+	connect := func(clientID string, listener common.ConnInfo, ip string, code mqtt.ConnackCode) *mockConn {
+		c := newMockConn(t)
+		if ip != "" {
+			c.remote = &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}
+		}
+		b.manager.HandleListener(c, listener)
+		c.sendC2S(&mqtt.Connect{ClientID: clientID, CleanSession: true, Username: "u1", Password: "p1", Version: 3})
+		c.assertS2CPacket(fmt.Sprintf("<Connack SessionPresent=false ReturnCode=%d>", code))
+		return c
+	}
+
+	// the connections of listener
+	listener := common.ConnInfo{Address: "tcp://0.0.0.0:1883", MaxConnections: 1}
+	c1 := connect("c1", listener, "10.0.0.1", mqtt.ConnectionAccepted)
+	connect("c2", listener, "10.0.0.2", mqtt.ServerUnavailable)
+	// the connections of username
+	connect("c2", common.ConnInfo{}, "10.0.0.1", mqtt.ServerUnavailable)
+	// the client of the same username and client ID kicks off the old one
+	c1 = connect("c1", common.ConnInfo{}, "10.0.0.1", mqtt.ConnectionAccepted)
+	c1.sendC2S(&mqtt.Disconnect{})
+	c1.assertS2CPacketTimeout()
+	c1.assertClosed(true)
+
+	// the accept rate, the burst is used up
+	connect("c2", common.ConnInfo{}, "10.0.0.3", mqtt.ServerUnavailable)
+	time.Sleep(time.Second * 3)
+
+	// the connections of IP, the client without username does not take the slot of username
+	c3 := newMockConn(t)
+	c3.remote = &net.TCPAddr{IP: net.ParseIP("10.0.0.4"), Port: 1234}
+	b.manager.Handle(c3, false)
+	c4 := newMockConn(t)
+	c4.remote = c3.remote
+	b.manager.Handle(c4, false)
+	connect("c5", common.ConnInfo{}, "10.0.0.4", mqtt.ServerUnavailable)
+	c3.Close()
+	c3.assertClosed(true)
+	time.Sleep(time.Millisecond * 100)
+	connect("c5", common.ConnInfo{}, "10.0.0.4", mqtt.ConnectionAccepted)
+	c4.assertClosed(false)
+
+	// the connection exceeding the limits is closed if it does not send the connect packet in time
+	c6 := newMockConn(t)
+	c6.remote = c3.remote
+	b.manager.Handle(c6, false)
+	time.Sleep(time.Millisecond * 300)
+	c6.assertClosed(true)
+	c4.assertClosed(false)
+}
+
+func TestSessionMqttTopicLimits(t *testing.T) {
+	b := newMockBroker(t, testConfTopicLimits)
+	defer b.closeAndClean()
+
+	c := newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: t.Name(), Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+
+	// the topic length, levels and leading wildcard
+	c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{
+		{Topic: "0123456789a"},
+		{Topic: "a/b/c/d"},
+		{Topic: "#"},
+		{Topic: "a/b/c", QOS: 1},
+	}})
+	c.assertS2CPacket("<Suback ID=1 ReturnCodes=[128, 128, 128, 1]>")
+
+	// the max subscriptions, the topic filters subscribed are not counted again
+	c.sendC2S(&mqtt.Subscribe{ID: 2, Subscriptions: []mqtt.Subscription{
+		{Topic: "a/b/c"},
+		{Topic: "a/+"},
+		{Topic: "a/+", QOS: 1},
+		{Topic: "a/#"},
+	}})
+	c.assertS2CPacket("<Suback ID=2 ReturnCodes=[0, 0, 1, 128]>")
+	c.sendC2S(&mqtt.Unsubscribe{ID: 3, Topics: []string{"a/b/c"}})
+	c.assertS2CPacket("<Unsuback ID=3>")
+	c.sendC2S(&mqtt.Subscribe{ID: 4, Subscriptions: []mqtt.Subscription{{Topic: "a/#"}}})
+	c.assertS2CPacket("<Suback ID=4 ReturnCodes=[0]>")
+
+	// the topic published
+	pkt := &mqtt.Publish{}
+	pkt.Message.Topic = "a/b"
+	c.sendC2S(pkt)
+	c.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"a/b\" QOS=0 Retain=false Payload=> Dup=false>")
+	pkt.Message.Topic = "a/b/c/d"
+	c.sendC2S(pkt)
+	c.assertS2CPacketTimeout()
+	c.assertClosed(true)
+
+	c = newMockConn(t)
+	b.manager.Handle(c, false)
+	pktwill := &mqtt.Publish{}
+	pktwill.Message.Topic = "0123456789a"
+	c.sendC2S(&mqtt.Connect{ClientID: t.Name(), Version: 3, Will: &pktwill.Message})
+	c.assertS2CPacketTimeout()
+	c.assertClosed(true)
+}
+
+func TestSessionMqttMessageLimits(t *testing.T) {
+	b := newMockBroker(t, testConfMessageLimits)
+	defer b.closeAndClean()
+
+	connect := func(clientID, username, password string, will *mqtt.Publish, code mqtt.ConnackCode) *mockConn {
+		c := newMockConn(t)
+		b.manager.Handle(c, false)
+		pkt := &mqtt.Connect{ClientID: clientID, Username: username, Password: password, Version: 3}
+		if will != nil {
+			pkt.Will = &will.Message
+		}
+		c.sendC2S(pkt)
+		if code == mqtt.ConnectionAccepted || code == mqtt.NotAuthorized {
+			c.assertS2CPacket(fmt.Sprintf("<Connack SessionPresent=false ReturnCode=%d>", code))
+		} else {
+			c.assertS2CPacketTimeout()
+			c.assertClosed(true)
+		}
+		return c
+	}
+	publish := func(c *mockConn, topic string, qos mqtt.QOS, retain bool, payload string) {
+		pkt := &mqtt.Publish{ID: 1}
+		pkt.Message.Topic = topic
+		pkt.Message.QOS = qos
+		pkt.Message.Retain = retain
+		pkt.Message.Payload = []byte(payload)
+		c.sendC2S(pkt)
+	}
+
+	// will message
+	pktwill := &mqtt.Publish{}
+	pktwill.Message.Topic = "test"
+	connect("d1", "device", "p1", pktwill, mqtt.NotAuthorized)
+	pktwill.Message.Topic = "upload/will"
+	pktwill.Message.Payload = []byte("123456789")
+	connect("d1", "device", "p1", pktwill, mqtt.ServerUnavailable)
+	pktwill.Message.Payload = []byte("12345678")
+	d1 := connect("d1", "device", "p1", pktwill, mqtt.ConnectionAccepted)
+
+	s1 := connect("s1", "service", "p2", nil, mqtt.ConnectionAccepted)
+	s1.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "#"}}})
+	s1.assertS2CPacket("<Suback ID=1 ReturnCodes=[0]>")
+
+	// the retained message of device is routed but not retained
+	publish(d1, "test", 0, true, "1234")
+	s1.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"test\" QOS=0 Retain=false Payload=31323334> Dup=false>")
+	publish(d1, "upload/a", 1, true, "12345678")
+	d1.assertS2CPacket("<Puback ID=1>")
+	s1.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"upload/a\" QOS=0 Retain=false Payload=3132333435363738> Dup=false>")
+	msgs, err := b.manager.listRetainedMessages()
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 1)
+	assert.Equal(t, "upload/a", msgs[0].Context.Topic)
+
+	// the delayed retained message of device is routed but not retained
+	publish(d1, "$delayed/1/test", 0, true, "1234")
+	s1.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"test\" QOS=0 Retain=false Payload=31323334> Dup=false>")
+	msgs, err = b.manager.listRetainedMessages()
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 1)
+
+	// the QoS of device is limited
+	publish(d1, "test", 1, false, "1234")
+	// the will message is sent
+	s1.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"upload/will\" QOS=0 Retain=false Payload=3132333435363738> Dup=false>")
+	d1.assertClosed(true)
+
+	// the payload size of service is limited by the global limit
+	publish(s1, "upload/a", 0, false, "12345")
+	s1.assertS2CPacketTimeout()
+	s1.assertClosed(true)
+}
+
 func TestSessionMqttDefaultMaxMessagePayload(t *testing.T) {
 	b := newMockBroker(t, testConfDefault)
 	defer b.closeAndClean()
@@ -1692,6 +2609,336 @@ func TestCleanExpiredMessages(t *testing.T) {
 	fmt.Println("--> tests finished <--")
 }
 
+func TestSessionMqttSlowConsumer(t *testing.T) {
+	b := newMockBroker(t, testConfSlowConsumer)
+	defer b.closeAndClean()
+
+	pub := newMockConn(t)
+	b.manager.Handle(pub, false)
+	pub.sendC2S(&mqtt.Connect{ClientID: "pub", Version: 3})
+	pub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+
+	sub := newMockConn(t)
+	b.manager.Handle(sub, false)
+	sub.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+	sub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	sub.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "test", QOS: 1}}})
+	sub.assertS2CPacket("<Suback ID=1 ReturnCodes=[1]>")
+	b.waitClientReady("sub", false)
+
+	// the subscriber never acknowledges, but the publisher is not blocked
+	for i := 1; i <= 5; i++ {
+		pktpub := &mqtt.Publish{}
+		pktpub.ID = mqtt.ID(i)
+		pktpub.Message.QOS = 1
+		pktpub.Message.Topic = "test"
+		pktpub.Message.Payload = []byte("hi")
+		pub.sendC2S(pktpub)
+		pub.assertS2CPacket(fmt.Sprintf("<Puback ID=%d>", i))
+	}
+
+	// the subscriber is disconnected since its backlog exceeds the limit
+	b.waitClientReady("sub", true)
+	sub.assertClosed(true)
+	b.assertSessionCount(2)
+	b.assertClientCount(1)
+
+	// the messages are kept for the next connection
+	sub = newMockConn(t)
+	b.manager.Handle(sub, false)
+	sub.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+	sub.assertS2CPacket("<Connack SessionPresent=true ReturnCode=0>")
+	pkt, ok := sub.receiveS2C().(*mqtt.Publish)
+	assert.True(t, ok)
+	assert.Equal(t, "test", pkt.Message.Topic)
+	assert.Equal(t, []byte("hi"), pkt.Message.Payload)
+}
+
+func TestSessionMqttDelayed(t *testing.T) {
+	b := newMockBroker(t, testConfDelayed)
+	defer b.closeAndClean()
+
+	sub := newMockConn(t)
+	b.manager.Handle(sub, false)
+	sub.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+	sub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	sub.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "test", QOS: 1}}})
+	sub.assertS2CPacket("<Suback ID=1 ReturnCodes=[1]>")
+
+	pub := newMockConn(t)
+	b.manager.Handle(pub, false)
+	pub.sendC2S(&mqtt.Connect{ClientID: "pub", Version: 3})
+	pub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+
+	fmt.Println("--> publish delayed messages <--")
+
+	pktpub := &mqtt.Publish{}
+	pktpub.ID = 1
+	pktpub.Message.QOS = 1
+	pktpub.Message.Topic = "$delayed/1/test"
+	pktpub.Message.Payload = []byte("hi1")
+	pub.sendC2S(pktpub)
+	pub.assertS2CPacket("<Puback ID=1>")
+
+	pktpub.ID = 2
+	pktpub.Message.Topic = "$delayed/100/test"
+	pktpub.Message.Payload = []byte("hi2")
+	pub.sendC2S(pktpub)
+	pub.assertS2CPacket("<Puback ID=2>")
+
+	ms := b.manager.ListDelayedMessages()
+	assert.Len(t, ms, 2)
+	assert.Equal(t, "test", ms[0].Topic)
+	assert.Equal(t, uint32(1), ms[0].QOS)
+	assert.True(t, ms[0].Due.Before(ms[1].Due))
+
+	// the message is not routed until due
+	sub.assertS2CPacketTimeout()
+	sub.assertS2CPacket("<Publish ID=1 Message=<Message Topic=\"test\" QOS=1 Retain=false Payload=686931> Dup=false>")
+	sub.sendC2S(&mqtt.Puback{ID: 1})
+
+	fmt.Println("--> cancel delayed message <--")
+
+	ms = b.manager.ListDelayedMessages()
+	assert.Len(t, ms, 1)
+	assert.NoError(t, b.manager.CancelDelayedMessage(ms[0].ID))
+	assert.Equal(t, ErrSessionDelayedMessageNotFound, b.manager.CancelDelayedMessage(ms[0].ID))
+	assert.Len(t, b.manager.ListDelayedMessages(), 0)
+
+	fmt.Println("--> delay exceeds the limit <--")
+
+	pktpub.ID = 3
+	pktpub.Message.Topic = "$delayed/3601/test"
+	pub.sendC2S(pktpub)
+	pub.assertS2CPacketTimeout()
+	pub.assertClosed(true)
+	sub.assertS2CPacketTimeout()
+}
+
+func TestSessionMqttDelayedRestart(t *testing.T) {
+	b := newMockBroker(t, testConfDelayed)
+
+	pub := newMockConn(t)
+	b.manager.Handle(pub, false)
+	pub.sendC2S(&mqtt.Connect{ClientID: "pub", Version: 3})
+	pub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+
+	pktpub := &mqtt.Publish{}
+	pktpub.ID = 1
+	pktpub.Message.QOS = 1
+	pktpub.Message.Topic = "$delayed/2/test"
+	pktpub.Message.Payload = []byte("hi1")
+	pub.sendC2S(pktpub)
+	pub.assertS2CPacket("<Puback ID=1>")
+
+	pktpub.ID = 2
+	pktpub.Message.Topic = "$delayed/2/test"
+	pktpub.Message.Retain = true
+	pktpub.Message.Payload = []byte("hi2")
+	pub.sendC2S(pktpub)
+	pub.assertS2CPacket("<Puback ID=2>")
+
+	// the pending count exceeds the limit
+	pktpub.ID = 3
+	pub.sendC2S(pktpub)
+	pub.assertS2CPacketTimeout()
+	pub.assertClosed(true)
+	b.close()
+
+	fmt.Println("--> restart broker <--")
+
+	b = newMockBrokerNotClean(t, testConfDelayed)
+	defer b.closeAndClean()
+	ms := b.manager.ListDelayedMessages()
+	assert.Len(t, ms, 2)
+	assert.Equal(t, "pub", ms[1].ClientID)
+
+	sub := newMockConn(t)
+	b.manager.Handle(sub, false)
+	sub.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+	sub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	sub.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "test", QOS: 0}}})
+	sub.assertS2CPacket("<Suback ID=1 ReturnCodes=[0]>")
+
+	sub.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"test\" QOS=0 Retain=false Payload=686931> Dup=false>")
+	sub.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"test\" QOS=0 Retain=false Payload=686932> Dup=false>")
+	assert.Len(t, b.manager.ListDelayedMessages(), 0)
+
+	// the publisher of the delayed message is kept in the audit of the retained message
+	rms := b.manager.ListRetainedMessages()
+	assert.Len(t, rms, 1)
+	assert.Equal(t, "pub", rms[0].ClientID)
+}
+
+func TestSessionMqttReplay(t *testing.T) {
+	b := newMockBroker(t, testConfHistory)
+	defer b.closeAndClean()
+	b.assertExchangeCount(1)
+
+	pub := newMockConn(t)
+	b.manager.Handle(pub, false)
+	pub.sendC2S(&mqtt.Connect{ClientID: "pub", Version: 3})
+	pub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+
+	for i := 1; i <= 3; i++ {
+		pktpub := &mqtt.Publish{}
+		pktpub.ID = mqtt.ID(i)
+		pktpub.Message.QOS = 1
+		pktpub.Message.Topic = "test/a"
+		pktpub.Message.Payload = []byte("hi" + strconv.Itoa(i))
+		pub.sendC2S(pktpub)
+		pub.assertS2CPacket(fmt.Sprintf("<Puback ID=%d>", i))
+	}
+	pktpub := &mqtt.Publish{}
+	pktpub.Message.Topic = "talks"
+	pktpub.Message.Payload = []byte("hi")
+	pub.sendC2S(pktpub)
+
+	fmt.Println("--> subscribe with replay request <--")
+
+	sub := newMockConn(t)
+	b.manager.Handle(sub, false)
+	sub.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+	sub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	sub.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "$replay/0/test/+", QOS: 0}, {Topic: "$replay/1h/talks", QOS: 0}}})
+	sub.assertS2CPacket("<Suback ID=1 ReturnCodes=[0, 0]>")
+	b.assertSessionStore("sub", "{\"id\":\"sub\",\"subs\":{\"talks\":0,\"test/+\":0}}", nil)
+
+	// only the latest messages within the max count are replayed, the topic 'talks' has no history
+	sub.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"test/a\" QOS=0 Retain=false Payload=686932> Dup=false>")
+	sub.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"test/a\" QOS=0 Retain=false Payload=686933> Dup=false>")
+	sub.assertS2CPacketTimeout()
+
+	// live messages after history
+	pktpub.Message.Topic = "test/b"
+	pktpub.Message.Payload = []byte("hi4")
+	pub.sendC2S(pktpub)
+	sub.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"test/b\" QOS=0 Retain=false Payload=686934> Dup=false>")
+
+	fmt.Println("--> subscribe with replay request since now <--")
+
+	sub2 := newMockConn(t)
+	b.manager.Handle(sub2, false)
+	sub2.sendC2S(&mqtt.Connect{ClientID: "sub2", Version: 3})
+	sub2.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	sub2.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "$replay/" + strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10) + "/test/#", QOS: 1}, {Topic: "$replay/x/test", QOS: 1}}})
+	sub2.assertS2CPacket("<Suback ID=1 ReturnCodes=[1, 128]>")
+	sub2.assertS2CPacketTimeout()
+}
+
+func TestSessionMqttReplayOverlapped(t *testing.T) {
+	b := newMockBroker(t, testConfHistories)
+	defer b.closeAndClean()
+
+	pub := newMockConn(t)
+	b.manager.Handle(pub, false)
+	pub.sendC2S(&mqtt.Connect{ClientID: "pub", Version: 3})
+	pub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+
+	for i, topic := range []string{"sensors/temp", "sensors/humi", "sensors/temp", "sensors/temp"} {
+		pktpub := &mqtt.Publish{}
+		pktpub.ID = mqtt.ID(i + 1)
+		pktpub.Message.QOS = 1
+		pktpub.Message.Topic = topic
+		// the same message is published twice
+		pktpub.Message.Payload = []byte("hi" + strconv.Itoa(i/3))
+		pub.sendC2S(pktpub)
+		pub.assertS2CPacket(fmt.Sprintf("<Puback ID=%d>", i+1))
+	}
+
+	// the message logged by both histories is replayed once, and the messages are replayed in time order
+	sub := newMockConn(t)
+	b.manager.Handle(sub, false)
+	sub.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+	sub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	sub.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "$replay/1h/sensors/#", QOS: 0}}})
+	sub.assertS2CPacket("<Suback ID=1 ReturnCodes=[0]>")
+	sub.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"sensors/temp\" QOS=0 Retain=false Payload=686930> Dup=false>")
+	sub.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"sensors/humi\" QOS=0 Retain=false Payload=686930> Dup=false>")
+	sub.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"sensors/temp\" QOS=0 Retain=false Payload=686930> Dup=false>")
+	sub.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"sensors/temp\" QOS=0 Retain=false Payload=686931> Dup=false>")
+	sub.assertS2CPacketTimeout()
+
+	// the messages of different seconds are merged in time order
+	v := func(ts uint64, topic string) *mqtt.Message {
+		return &mqtt.Message{Context: mqtt.Context{TS: ts, Topic: topic}}
+	}
+	msgs := mergeHistories([]*mqtt.Message{v(1, "a"), v(3, "a"), v(3, "b")}, []*mqtt.Message{v(2, "b"), v(3, "b"), v(4, "b")})
+	var res []string
+	for _, msg := range msgs {
+		res = append(res, fmt.Sprintf("%d%s", msg.Context.TS, msg.Context.Topic))
+	}
+	assert.Equal(t, []string{"1a", "2b", "3a", "3b", "4b"}, res)
+
+	// the message is dropped instead of blocking the routing if the writer falls behind
+	h, err := newHistory(History{Topic: "blocked", MaxCount: 2}, b.manager.store)
+	assert.NoError(t, err)
+	var acked int32
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, h.Push(common.NewEvent(&mqtt.Message{Context: mqtt.Context{ID: uint64(i + 1), Topic: "blocked"}}, 1, func(uint64) {
+			atomic.AddInt32(&acked, 1)
+		})))
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&acked))
+	assert.Len(t, h.events, 2)
+}
+
+func TestSessionMqttDeny(t *testing.T) {
+	b := newMockBroker(t, testConfDeny)
+	defer b.closeAndClean()
+
+	c := newMockConn(t)
+	b.manager.Handle(c, false)
+	c.sendC2S(&mqtt.Connect{ClientID: "c1", Username: "u1", Password: "p1", Version: 3})
+	c.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+
+	// the subscription covering the denied topics is allowed, and the messages of denied topics are not sent
+	c.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "plant/#"}, {Topic: "plant/secret/#"}}})
+	c.assertS2CPacket("<Suback ID=1 ReturnCodes=[0, 128]>")
+	for _, topic := range []string{"plant/a", "plant/secret/a", "plant/b"} {
+		pkt := &mqtt.Publish{}
+		pkt.Message.Topic = topic
+		c.sendC2S(pkt)
+	}
+	c.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"plant/a\" QOS=0 Retain=false Payload=> Dup=false>")
+	c.assertS2CPacket("<Publish ID=0 Message=<Message Topic=\"plant/b\" QOS=0 Retain=false Payload=> Dup=false>")
+	c.assertS2CPacketTimeout()
+}
+
+func TestSessionMqttReplayMany(t *testing.T) {
+	b := newMockBroker(t, testConfReplayMany)
+	defer b.closeAndClean()
+
+	pub := newMockConn(t)
+	b.manager.Handle(pub, false)
+	pub.sendC2S(&mqtt.Connect{ClientID: "pub", Version: 3})
+	pub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	for i := 0; i < 30; i++ {
+		pktpub := &mqtt.Publish{}
+		pktpub.Message.Topic = "many/" + strconv.Itoa(i)
+		pub.sendC2S(pktpub)
+	}
+	for i := 0; i < 100 && len(b.manager.replayMessages("many/#", time.Time{})) < 30; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// the replayed messages more than the inflight QoS 0 messages are not dropped, and are sent after the suback
+	sub := newMockConn(t)
+	b.manager.Handle(sub, false)
+	sub.sendC2S(&mqtt.Connect{ClientID: "sub", Version: 3})
+	sub.assertS2CPacket("<Connack SessionPresent=false ReturnCode=0>")
+	sub.sendC2S(&mqtt.Subscribe{ID: 1, Subscriptions: []mqtt.Subscription{{Topic: "$replay/1h/many/#", QOS: 1}}})
+	sub.assertS2CPacket("<Suback ID=1 ReturnCodes=[1]>")
+	for i := 0; i < 30; i++ {
+		sub.assertS2CPacket(fmt.Sprintf("<Publish ID=0 Message=<Message Topic=\"many/%d\" QOS=0 Retain=false Payload=> Dup=false>", i))
+	}
+	sub.assertS2CPacketTimeout()
+	// the replayed QoS 0 messages are removed from the persistent queue once sent
+	v, ok := b.manager.sessions.load("sub")
+	assert.True(t, ok)
+	assert.Equal(t, 0, v.(*Session).backlog())
+}
+
 func genRandomString(n int) string {
 	c := []byte("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_")
 	b := make([]byte, n)
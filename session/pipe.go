@@ -0,0 +1,191 @@
+package session
+
+import (
+	"context"
+	"crypto/x509"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/baetyl/baetyl-go/v2/errors"
+	"github.com/baetyl/baetyl-go/v2/log"
+	"github.com/baetyl/baetyl-go/v2/mqtt"
+	"google.golang.org/grpc/codes"
+
+	"github.com/baetyl/baetyl-broker/v2/common"
+)
+
+// pipeConn the in-memory connection between the client and the gateway serving it, such as the grpc and http listeners
+type pipeConn struct {
+	ctx    context.Context
+	remote net.Addr
+	certs  []*x509.Certificate
+	c2s    chan mqtt.Packet
+	s2c    chan mqtt.Packet
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newPipeConn(ctx context.Context, remote net.Addr, certs []*x509.Certificate) *pipeConn {
+	return &pipeConn{
+		ctx:    ctx,
+		remote: remote,
+		certs:  certs,
+		c2s:    make(chan mqtt.Packet),
+		s2c:    make(chan mqtt.Packet),
+		done:   make(chan struct{}),
+	}
+}
+
+// Send sends the packet to the gateway
+func (c *pipeConn) Send(pkt mqtt.Packet, _ bool) error {
+	select {
+	case c.s2c <- pkt:
+		return nil
+	case <-c.done:
+		return io.EOF
+	case <-c.ctx.Done():
+		return io.EOF
+	}
+}
+
+// Receive receives the packet from the gateway, returns io.EOF if the request of the gateway is finished
+func (c *pipeConn) Receive() (mqtt.Packet, error) {
+	select {
+	case pkt := <-c.c2s:
+		return pkt, nil
+	case <-c.done:
+		return nil, io.EOF
+	case <-c.ctx.Done():
+		return nil, io.EOF
+	}
+}
+
+// Close closes the connection
+func (c *pipeConn) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+	})
+	return nil
+}
+
+func (c *pipeConn) SetMaxWriteDelay(time.Duration) {}
+func (c *pipeConn) SetReadLimit(int64)             {}
+func (c *pipeConn) SetReadTimeout(time.Duration)   {}
+func (c *pipeConn) LocalAddr() net.Addr            { return nil }
+func (c *pipeConn) RemoteAddr() net.Addr           { return c.remote }
+
+// PeerCertificates returns the certificates of the peer verified by the gateway
+func (c *pipeConn) PeerCertificates() []*x509.Certificate {
+	return c.certs
+}
+
+// put sends the packet to the client
+func (c *pipeConn) put(pkt mqtt.Packet) error {
+	select {
+	case c.c2s <- pkt:
+		return nil
+	case <-c.done:
+		return io.EOF
+	}
+}
+
+// get receives the packet from the client
+func (c *pipeConn) get() (mqtt.Packet, error) {
+	select {
+	case pkt := <-c.s2c:
+		return pkt, nil
+	case <-c.done:
+		return nil, io.EOF
+	}
+}
+
+// connectPipe connects the client through the pipe connection, returns the reason if the client is refused
+func (m *Manager) connectPipe(conn *pipeConn, info common.ConnInfo, p *mqtt.Connect, typ string) (*Client, error) {
+	p.Version = mqtt.Version311
+	c := m.newClient(conn, info)
+	c.log = log.With(log.Any("type", typ), log.Any("id", c.id))
+	c.tomb.Go(c.receiving)
+
+	if err := conn.put(p); err != nil {
+		return nil, clientReason(c)
+	}
+	pkt, err := conn.get()
+	if err != nil {
+		return nil, clientReason(c)
+	}
+	if ack, ok := pkt.(*mqtt.Connack); !ok || ack.ReturnCode != mqtt.ConnectionAccepted {
+		conn.Close()
+		return nil, clientReason(c)
+	}
+	return c, nil
+}
+
+// publishPipe publishes the message by the client, returns after the message is routed,
+// the QoS 1 message is acknowledged by puback, and the QoS 0 message is followed by a ping as the barrier
+func publishPipe(c *Client, conn *pipeConn, pkt *mqtt.Publish) error {
+	if pkt.Message.QOS > 0 && pkt.ID == 0 {
+		pkt.ID = 1
+	}
+	if err := conn.put(pkt); err != nil {
+		return clientReason(c)
+	}
+	if pkt.Message.QOS == 0 {
+		if err := conn.put(&mqtt.Pingreq{}); err != nil {
+			return clientReason(c)
+		}
+	}
+	for {
+		res, err := conn.get()
+		if err != nil {
+			return clientReason(c)
+		}
+		switch res.(type) {
+		case *mqtt.Puback, *mqtt.Pingresp:
+			return nil
+		}
+	}
+}
+
+// disconnect disconnects the client normally, and waits until the client is dead
+func disconnect(c *Client, conn *pipeConn) {
+	conn.put(&mqtt.Disconnect{})
+	<-c.tomb.Dead()
+}
+
+// clientReason waits until the client is dead, and returns the reason
+func clientReason(c *Client) error {
+	<-c.tomb.Dead()
+	err := errors.Cause(c.tomb.Err())
+	if err == nil || err == io.EOF {
+		return ErrSessionClientAlreadyClosed
+	}
+	return err
+}
+
+// reasonCode classifies the reason why the client is refused or closed by the grpc code,
+// which is also mapped to the http status
+func reasonCode(err error) codes.Code {
+	switch err {
+	case ErrSessionUsernameNotSet, ErrSessionUsernameNotPermitted, ErrSessionTokenInvalid, ErrSessionTokenExpired,
+		ErrSessionCertificateIdentityNotFound, ErrSessionCertificateIdentityNotPermitted, ErrSessionPeerCredentialsNotPermitted:
+		return codes.Unauthenticated
+	case ErrSessionClientBanned, ErrSessionOwnerNotMatch, ErrSessionMessageTopicNotPermitted, ErrSessionMessageQosNotPermitted,
+		ErrSessionRetainedMessageNotPermitted, ErrSessionRetainedMessageTopicNotPermitted:
+		return codes.PermissionDenied
+	case ErrConnectionRefuse, ErrSessionClientIDInvalid, ErrSessionClientIDNotMatchCertificate, ErrSessionMessageQosNotSupported,
+		ErrSessionMessageTopicInvalid, ErrSessionTopicLengthExceedsLimit, ErrSessionTopicLevelsExceedLimit,
+		ErrSessionTopicLeadingWildcardNotPermitted, ErrSessionMessagePayloadSizeExceedsLimit, ErrSessionSubscribePayloadEmpty:
+		return codes.InvalidArgument
+	case ErrSessionClientsExceedLimit, ErrSessionListenerConnectionsExceedLimit, ErrSessionIPConnectionsExceedLimit,
+		ErrSessionUsernameConnectionsExceedLimit, ErrSessionConnectionRateExceedsLimit, ErrSessionMessageRateExceedsLimit,
+		ErrSessionSubscriptionsExceedLimit, ErrSessionRetainedMessageCountExceedsLimit, ErrSessionRetainedMessageSizeExceedsLimit,
+		ErrSessionDelayedMessageDelayExceedsLimit, ErrSessionDelayedMessagePendingExceedsLimit:
+		return codes.ResourceExhausted
+	case ErrSessionClientIDInUse, ErrSessionClientIDBanned, ErrSessionManagerClosed:
+		return codes.Unavailable
+	default:
+		return codes.Aborted
+	}
+}
@@ -0,0 +1,272 @@
+package session
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/baetyl/baetyl-go/v2/errors"
+	"github.com/baetyl/baetyl-go/v2/mqtt"
+	"github.com/gogo/protobuf/proto"
+
+	"github.com/baetyl/baetyl-broker/v2/store"
+)
+
+// RetainedMessage the audit of a retained message
+type RetainedMessage struct {
+	Topic    string    `json:"topic"`
+	QOS      uint32    `json:"qos"`
+	Size     int       `json:"size"`
+	ClientID string    `json:"clientid,omitempty"` // the client who set the retained message last
+	Username string    `json:"username,omitempty"` // the username of the client who set the retained message last
+	Time     time.Time `json:"time"`               // the time when the retained message was set last
+}
+
+// retainer keeps retained messages in store and indexes their topics
+type retainer struct {
+	cfg    Retain
+	bucket store.KVBucket // topic -> retained message
+	audits store.KVBucket // topic -> audit of retained message
+	index  *mqtt.Trie     // the index of retained message topics
+	allow  *mqtt.Trie
+	deny   *mqtt.Trie
+	metas  map[string]*RetainedMessage
+	size   int64 // the total payload size of retained messages
+	mut    sync.Mutex
+}
+
+func newRetainer(cfg Retain, bucket, audits store.KVBucket) (*retainer, error) {
+	r := &retainer{
+		cfg:    cfg,
+		bucket: bucket,
+		audits: audits,
+		index:  mqtt.NewTrie(),
+		allow:  mqtt.NewTrie(),
+		deny:   mqtt.NewTrie(),
+		metas:  make(map[string]*RetainedMessage),
+	}
+	for _, f := range cfg.Allow {
+		r.allow.Set(f, f)
+	}
+	for _, f := range cfg.Deny {
+		r.deny.Set(f, f)
+	}
+	err := audits.ListKV(func(data []byte) error {
+		if len(data) == 0 {
+			return store.ErrDataNotFound
+		}
+		v := new(RetainedMessage)
+		if err := json.Unmarshal(data, v); err != nil {
+			return errors.Trace(err)
+		}
+		r.metas[v.Topic] = v
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	msgs, err := r.all()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	metas := make(map[string]*RetainedMessage, len(msgs))
+	for _, msg := range msgs {
+		meta, ok := r.metas[msg.Context.Topic]
+		if !ok {
+			// the retained message stored without audit, such as the one stored before upgrade,
+			// is audited when loaded first, the audit is stored so that its ttl isn't restarted by the next restart
+			meta = newRetainedMessage(msg, "", "")
+			audit, err := json.Marshal(meta)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			err = audits.SetKV([]byte(meta.Topic), audit)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+		metas[msg.Context.Topic] = meta
+		r.index.Set(msg.Context.Topic, msg.Context.Topic)
+		r.size += int64(meta.Size)
+	}
+	r.metas = metas
+	return r, nil
+}
+
+func newRetainedMessage(msg *mqtt.Message, clientID, username string) *RetainedMessage {
+	return &RetainedMessage{
+		Topic:    msg.Context.Topic,
+		QOS:      msg.Context.QOS,
+		Size:     len(msg.Content),
+		ClientID: clientID,
+		Username: username,
+		Time:     time.Now(),
+	}
+}
+
+// permitted checks whether the topic is allowed to retain, deny takes precedence over allow
+func (r *retainer) permitted(topic string) bool {
+	if len(r.deny.Match(topic)) > 0 {
+		return false
+	}
+	return len(r.cfg.Allow) == 0 || len(r.allow.Match(topic)) > 0
+}
+
+func (r *retainer) expired(meta *RetainedMessage) bool {
+	return r.cfg.TTL > 0 && time.Since(meta.Time) > r.cfg.TTL
+}
+
+func (r *retainer) set(msg *mqtt.Message, clientID, username string) error {
+	if !r.permitted(msg.Context.Topic) {
+		return ErrSessionRetainedMessageTopicNotPermitted
+	}
+	meta := newRetainedMessage(msg, clientID, username)
+
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	count, size := len(r.metas), r.size+int64(meta.Size)
+	if old, ok := r.metas[meta.Topic]; ok {
+		size -= int64(old.Size)
+	} else {
+		count++
+	}
+	if r.cfg.MaxCount > 0 && count > r.cfg.MaxCount {
+		return ErrSessionRetainedMessageCountExceedsLimit
+	}
+	if r.cfg.MaxSize > 0 && size > int64(r.cfg.MaxSize) {
+		return ErrSessionRetainedMessageSizeExceedsLimit
+	}
+
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	audit, err := json.Marshal(meta)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	err = r.bucket.SetKV([]byte(meta.Topic), data)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	err = r.audits.SetKV([]byte(meta.Topic), audit)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	r.metas[meta.Topic] = meta
+	r.index.Set(meta.Topic, meta.Topic)
+	r.size = size
+	return nil
+}
+
+func (r *retainer) del(topic string) error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	return r.delLocked(topic)
+}
+
+func (r *retainer) delLocked(topic string) error {
+	err := r.bucket.DelKV([]byte(topic))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	err = r.audits.DelKV([]byte(topic))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if meta, ok := r.metas[topic]; ok {
+		r.size -= int64(meta.Size)
+		delete(r.metas, topic)
+	}
+	r.index.Empty(topic)
+	return nil
+}
+
+// search gets the retained messages whose topic matches the topic filter, the expired ones are removed
+func (r *retainer) search(filter string) ([]*mqtt.Message, error) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	topics := r.index.Search(filter)
+	msgs := make([]*mqtt.Message, 0, len(topics))
+	for _, v := range topics {
+		topic := v.(string)
+		if meta, ok := r.metas[topic]; ok && r.expired(meta) {
+			err := r.delLocked(topic)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			continue
+		}
+		msg := new(mqtt.Message)
+		err := r.bucket.GetKV([]byte(topic), func(data []byte) error {
+			if len(data) == 0 {
+				return store.ErrDataNotFound
+			}
+			return errors.Trace(proto.Unmarshal(data, msg))
+		})
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+// sweep removes all expired retained messages
+func (r *retainer) sweep() (int, error) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	var n int
+	for topic, meta := range r.metas {
+		if !r.expired(meta) {
+			continue
+		}
+		err := r.delLocked(topic)
+		if err != nil {
+			return n, errors.Trace(err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// list lists the audits of unexpired retained messages ordered by topic
+func (r *retainer) list() []RetainedMessage {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	res := make([]RetainedMessage, 0, len(r.metas))
+	for _, meta := range r.metas {
+		if !r.expired(meta) {
+			res = append(res, *meta)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Topic < res[j].Topic
+	})
+	return res
+}
+
+// all lists all retained messages in store
+func (r *retainer) all() ([]*mqtt.Message, error) {
+	msgs := make([]*mqtt.Message, 0)
+	err := r.bucket.ListKV(func(data []byte) error {
+		if len(data) == 0 {
+			return store.ErrDataNotFound
+		}
+		v := new(mqtt.Message)
+		if err := proto.Unmarshal(data, v); err != nil {
+			return errors.Trace(err)
+		}
+		msgs = append(msgs, v)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return msgs, nil
+}
@@ -3,6 +3,7 @@ package session
 import (
 	"encoding/json"
 	"sync"
+	"time"
 
 	"github.com/baetyl/baetyl-go/v2/errors"
 	"github.com/baetyl/baetyl-go/v2/log"
@@ -15,6 +16,7 @@ import (
 // Info session information
 type Info struct {
 	ID            string              `json:"id,omitempty"`
+	Owner         string              `json:"owner,omitempty"` // the authenticated username or certificate identity
 	WillMessage   *mqtt.Message       `json:"will,omitempty"`
 	Subscriptions map[string]mqtt.QOS `json:"subs,omitempty"`
 	CleanSession  bool                `json:"-"`
@@ -108,6 +110,7 @@ func (s *Session) update(si Info, auth func(action, topic string) bool) error {
 
 	s.info.WillMessage = si.WillMessage
 	s.info.CleanSession = si.CleanSession
+	s.info.Owner = si.Owner
 
 	for topic := range s.info.Subscriptions {
 		if auth != nil && !auth(Subscribe, topic) {
@@ -144,6 +147,12 @@ func (s *Session) update(si Info, auth func(action, topic string) bool) error {
 	return errors.Trace(s.persistent())
 }
 
+func (s *Session) owner() string {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	return s.info.Owner
+}
+
 func (s *Session) disableQos1() {
 	s.mut.Lock()
 	defer s.mut.Unlock()
@@ -158,6 +167,10 @@ func (s *Session) Push(e *common.Event) error {
 	s.mut.Lock()
 	defer s.mut.Unlock()
 
+	return s.push(e)
+}
+
+func (s *Session) push(e *common.Event) error {
 	// always flow message with qos 0 into qos0 queue
 	if e.Context.QOS == 0 {
 		return s.qos0msg.Push(e)
@@ -181,6 +194,14 @@ func (s *Session) Push(e *common.Event) error {
 	return s.qos0msg.Push(e)
 }
 
+// backlog returns the number of messages waiting to be sent or acknowledged
+func (s *Session) backlog() int {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+
+	return s.qos0msg.Backlog() + s.qos1msg.Backlog()
+}
+
 // ID id
 func (s *Session) ID() string {
 	s.mut.Lock()
@@ -191,6 +212,8 @@ func (s *Session) ID() string {
 
 // * the following operations are only used by mqtt client
 
+// subscribe binds the subscriptions, and pushes the history messages of the subscriptions with replay request
+// before any live message
 func (s *Session) subscribe(subs []mqtt.Subscription, sa *mqtt.Suback, auth func(action, topic string) bool) error {
 	if len(subs) == 0 {
 		return nil
@@ -217,6 +240,37 @@ func (s *Session) subscribe(subs []mqtt.Subscription, sa *mqtt.Suback, auth func
 	return errors.Trace(s.persistent())
 }
 
+// replay pushes the history messages of the subscriptions with replay request into the persistent queue,
+// so that they are neither dropped by the in-memory queue nor block the routing, the QoS of the messages is kept
+func (s *Session) replay(subs []mqtt.Subscription, replays map[string]time.Time) {
+	if len(replays) == 0 {
+		return
+	}
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	for _, v := range subs {
+		since, ok := replays[v.Topic]
+		if !ok {
+			continue
+		}
+		if _, ok = s.info.Subscriptions[v.Topic]; !ok {
+			// the subscription is refused
+			continue
+		}
+		for _, msg := range s.manager.replayMessages(v.Topic, since) {
+			if msg.Context.QOS > uint32(v.QOS) {
+				msg.Context.QOS = uint32(v.QOS)
+			}
+			err := s.qos1msg.Push(common.NewEvent(msg, 0, nil))
+			if err != nil {
+				s.log.Error("failed to push history message", log.Any("topic", msg.Context.Topic), log.Error(err))
+			}
+		}
+	}
+}
+
 func (s *Session) unsubscribe(topics []string) error {
 	if len(topics) == 0 {
 		return nil
@@ -234,6 +288,33 @@ func (s *Session) unsubscribe(topics []string) error {
 	return errors.Trace(s.persistent())
 }
 
+// subscribed returns whether the topic filter is subscribed and the number of subscriptions
+func (s *Session) subscribed(topic string) (bool, int) {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	_, ok := s.info.Subscriptions[topic]
+	return ok, len(s.info.Subscriptions)
+}
+
+func (s *Session) subscriptions() map[string]mqtt.QOS {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+
+	subs := make(map[string]mqtt.QOS, len(s.info.Subscriptions))
+	for topic, qos := range s.info.Subscriptions {
+		subs[topic] = qos
+	}
+	return subs
+}
+
+// discard marks the session as clean session and deletes it from store, the queues are deleted when it is closed
+func (s *Session) discard() error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.info.CleanSession = true
+	return errors.Trace(s.persistent())
+}
+
 func (s *Session) will() *mqtt.Message {
 	s.mut.RLock()
 	defer s.mut.RUnlock()
@@ -253,12 +334,6 @@ func (s *Session) cleanWill() error {
 	return errors.Trace(s.persistent())
 }
 
-func (s *Session) matchQOS(topic string) (bool, uint32) {
-	s.mut.RLock()
-	defer s.mut.RUnlock()
-	return mqtt.MatchTopicQOS(s.subs, topic)
-}
-
 func (s *Session) acknowledge(id uint64) {
 	s.mut.RLock()
 	defer s.mut.RUnlock()
@@ -0,0 +1,74 @@
+package session
+
+import (
+	"sync"
+	"time"
+)
+
+// flapping detects the client ID which is taken over repeatedly, and bans it temporarily
+type flapping struct {
+	cfg     Flapping
+	records map[string]*takeovers
+	mut     sync.Mutex
+}
+
+// takeovers the takeover times of a client ID in the window
+type takeovers struct {
+	times  []time.Time
+	banned time.Time // the client ID is banned until this time
+}
+
+func newFlapping(cfg Flapping) *flapping {
+	return &flapping{
+		cfg:     cfg,
+		records: map[string]*takeovers{},
+	}
+}
+
+// banned checks whether the client ID is banned
+func (f *flapping) banned(id string) bool {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	r, ok := f.records[id]
+	return ok && time.Now().Before(r.banned)
+}
+
+// takeover records a takeover of the client ID, returns true if it is banned since takeovers exceed the limit
+func (f *flapping) takeover(id string) bool {
+	if f.cfg.MaxTakeovers <= 0 {
+		return false
+	}
+
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	now := time.Now()
+	f.prune(now)
+	r, ok := f.records[id]
+	if !ok {
+		r = &takeovers{}
+		f.records[id] = r
+	}
+	r.times = append(r.times, now)
+	if len(r.times) <= f.cfg.MaxTakeovers {
+		return false
+	}
+	r.times = nil
+	r.banned = now.Add(f.cfg.BanDuration)
+	return true
+}
+
+// prune removes the takeovers out of the window and the expired bans
+func (f *flapping) prune(now time.Time) {
+	for id, r := range f.records {
+		i := 0
+		for i < len(r.times) && now.Sub(r.times[i]) > f.cfg.Window {
+			i++
+		}
+		r.times = r.times[i:]
+		if len(r.times) == 0 && !now.Before(r.banned) {
+			delete(f.records, id)
+		}
+	}
+}
@@ -30,6 +30,7 @@ type BatchBucket interface {
 	Set(offset uint64, value []byte) error
 	Get(offset uint64, length int, op func([]byte, uint64) error) error
 	MaxOffset() (uint64, error)
+	MinOffset() (uint64, error)
 	DelBeforeID(uint64) error
 	DelBeforeTS(ts uint64) error
 	Close(clean bool) (err error)
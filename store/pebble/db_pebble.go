@@ -103,6 +103,18 @@ func (b *pebbleBucket) MaxOffset() (uint64, error) {
 	return offset, nil
 }
 
+func (b *pebbleBucket) MinOffset() (uint64, error) {
+	var offset uint64
+	iter := b.db.NewIter(b.prefixIterOpts)
+	if iter.First() {
+		offset, _ = decodeBatchKey(iter.Key(), b.name)
+	}
+	if err := iter.Close(); err != nil {
+		return offset, errors.Trace(err)
+	}
+	return offset, nil
+}
+
 // DelBeforeID deletes values whose keys are not greater than the given id from DB
 func (b *pebbleBucket) DelBeforeID(id uint64) error {
 	start := b.name
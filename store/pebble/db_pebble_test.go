@@ -648,6 +648,10 @@ func TestDatabasePebbleReopen(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, maxOffset2, uint64(3+count))
 
+	minOffset, err := bucket2.MinOffset()
+	assert.NoError(t, err)
+	assert.Equal(t, minOffset, uint64(1))
+
 	err = db2.Close()
 	assert.NoError(t, err)
 
@@ -696,6 +700,10 @@ func TestDatabasePebbleReopen(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, maxOffset4, uint64(0))
 
+	minOffset4, err := bucket4.MinOffset()
+	assert.NoError(t, err)
+	assert.Equal(t, minOffset4, uint64(0))
+
 	for i := 1; i <= count; i++ {
 		v := mockStruct{
 			ID:    i,